@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// cacheUsage describes the arguments of the cache command.
+const cacheUsage = `usage: brgeo cache <command> [flags]
+
+commands:
+  export  write the cache of the running server as JSON lines
+  import  load JSON lines written by export into the cache of the running server
+
+The cache lives in the memory of the server, so the command calls its
+/cache/export and /cache/import endpoints.`
+
+// cacheTimeout bounds a call to the server made by the cache command.
+const cacheTimeout = 5 * time.Minute
+
+// runCache executes the cache command with the arguments that follow it.
+func runCache(cfg *config.Config, args []string) error {
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		return errors.New(cacheUsage)
+	}
+	command := args[0]
+
+	flags := flag.NewFlagSet("cache "+command, flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "usage: brgeo cache %s [flags]\n", command)
+		flags.PrintDefaults()
+	}
+	server := flags.String("url", "http://localhost:"+strconv.Itoa(cfg.Server.Port), "url of the running server")
+	apiKey := flags.String("api-key", cfg.Auth.AdminKey, "api key granted the admin scope, ADMIN_API_KEY by default")
+	file := flags.String("file", "", "file to write or read, standard output or input when omitted")
+	if err := flags.Parse(args[1:]); err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: cacheTimeout}
+	url := strings.TrimSuffix(*server, "/") + "/cache/" + command
+	if command == "export" {
+		return exportServerCache(client, url, *apiKey, *file)
+	}
+	return importServerCache(client, url, *apiKey, *file)
+}
+
+// exportServerCache writes the cache exported by the server at url to the file,
+// or to standard output.
+func exportServerCache(client *http.Client, url, apiKey, path string) error {
+	resp, err := callServer(client, http.MethodGet, url, apiKey, nil)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var w io.Writer = os.Stdout
+	if path != "" {
+		file, err := os.Create(path)
+		if err != nil {
+			return errors.New(err)
+		}
+		defer func() { _ = file.Close() }()
+		w = file
+	}
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// importServerCache sends the JSON lines of the file, or of standard input, to
+// the server at url and reports the entries imported.
+func importServerCache(client *http.Client, url, apiKey, path string) error {
+	var r io.Reader = os.Stdin
+	if path != "" {
+		file, err := os.Open(path)
+		if err != nil {
+			return errors.New(err)
+		}
+		defer func() { _ = file.Close() }()
+		r = file
+	}
+
+	resp, err := callServer(client, http.MethodPost, url, apiKey, r)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	var result api.ImportResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return errors.New(err)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d cache entries, skipped %d, %d invalid\n", result.Imported, result.Skipped, result.Invalid)
+	return nil
+}
+
+// callServer makes a call to the cache endpoints with the api key, and returns
+// the error body of the server when the call does not succeed.
+func callServer(client *http.Client, method, url, apiKey string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	if apiKey != "" {
+		req.Header.Set("Authorization", "Bearer "+apiKey)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, errors.Errorf("%s %s: %s %s", method, url, resp.Status, strings.TrimSpace(string(message)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// exportFilters are the history filters accepted as flags by the export command.
+var exportFilters = []struct{ name, usage string }{
+	{"ip", "only lookups of this ip address"},
+	{"cidr", "only lookups of addresses in this network block"},
+	{"country", "only lookups located in this country code"},
+	{"from", "only lookups at or after this RFC 3339 time"},
+	{"to", "only lookups before this RFC 3339 time"},
+	{"status", "only lookups that ended in success or failure"},
+	{"provider", "only lookups made against this provider"},
+	{"sort", "asc for the oldest lookups first, desc (the default) for the newest"},
+}
+
+// runExport executes the export command with the arguments that follow it,
+// writing the recorded lookups to a file or to standard output.
+func runExport(cfg *config.Config, args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "usage: brgeo export [flags]")
+		flags.PrintDefaults()
+	}
+	format := flags.String("format", string(api.ExportCSV), "file format: csv, ndjson or parquet")
+	output := flags.String("out", "", "file to write, standard output when omitted")
+	values := map[string]*string{}
+	for _, filter := range exportFilters {
+		values[filter.name] = flags.String(filter.name, "", filter.usage)
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	exportFormat, err := api.ParseExportFormat(*format)
+	if err != nil {
+		return err
+	}
+	filter, err := api.ParseHistoryFilter(func(key string) string {
+		if v, ok := values[key]; ok {
+			return *v
+		}
+		return ""
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := api.OpenDatabase(cfg.Database); err != nil {
+		return err
+	}
+	if !api.DatabaseEnabled() {
+		return errors.New("the database is disabled, set DB_DRIVER to export")
+	}
+	if err := api.CheckSchemaVersion(); err != nil {
+		return err
+	}
+	if err := api.InitPrivacy(cfg.Storage); err != nil {
+		return err
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return errors.New(err)
+		}
+		defer func() { _ = file.Close() }()
+		w = file
+	}
+
+	buffered := bufio.NewWriter(w)
+	count, err := api.ExportHistory(buffered, exportFormat, filter)
+	if err != nil {
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		return errors.New(err)
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d lookup(s)\n", count)
+	return nil
+}
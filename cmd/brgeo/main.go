@@ -1,70 +1,223 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"log/slog"
 
 	"github.com/charmbracelet/log"
-	"github.com/joho/godotenv"
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
 	"github.com/jvanrhyn/brgeo/controller"
 	"github.com/jvanrhyn/brgeo/internal/api"
 )
 
-// init is the function that initializes the application by reading Configuration data
-// from the .env file in the project.
-// If the .env file cannot be found in the project directory, it attempts to find the file
-// using the getEnvFilePath function.
-// If the .env file still cannot be found, an error message is printed to the console and the application panics.
-// The function uses the godotenv package to load the .env file.
-func init() {
-
-	// Read Configuration data from the .env file in the project
-	err := godotenv.Load()
-	if err != nil {
-		envPath := api.GetEnvFilePath()
-		err = godotenv.Load(envPath)
-		if err != nil {
-			panic("Error loading .env file : " + err.Error())
-		}
-	}
-}
-
 // main is the entry point of the application.
 // It initializes the logger, sets up the global logger with custom options,
 // and starts the application by calling the InitDatabase and StartAndServe functions.
 // It uses the slog package for logging.
 //
-// The logger is initialized with the log.New function and set with the provided options.
-// The SetLevel function sets the logging level to Debug.
-// The SetTimeFormat function sets the time format to time.Kitchen.
-// The SetReportTimestamp function enables reporting timestamps in logs.
+// The logger is set up by setupLogging once the configuration is loaded, writing text or
+// JSON as configured through api.LogHandler, which applies the level and the sampling,
+// redacts sensitive values and adds the request and trace ids to the log lines.
 //
-// The slog package is used to set the default logger to the created logger.
+// The configuration is loaded with loadConfig from the arguments, the environment,
+// an optional .env file and the configuration file. When the flags are followed by the migrate,
+// export or cache command, as in "brgeo --env-file prod.env migrate up", that command is run
+// with it instead of the server. Otherwise it is handed to the api package with api.Configure.
+// The settings that can change at runtime are reloaded on SIGHUP, when one of the files changes,
+// or on POST /admin/config/reload.
 //
 // The Info log message "Starting the application" is printed using the slog.Info function.
 //
+// The InitTracing function (api.InitTracing) exports the traces as configured.
+//
 // The Debug log message "InitDatabase called" is printed using the slog.Debug function.
 // The InitDatabase function (api.InitDatabase) is then called to initialize the database.
+// If the database cannot be opened, the error is logged and the application exits.
+// The InitPrivacy function (api.InitPrivacy) selects how ip addresses are stored with lookups.
+// The StartRecorder function (api.StartRecorder) starts writing lookups to the database in the background,
+// and StopRecorder writes the lookups still queued once the server stops.
+// The StartRetention function (api.StartRetention) purges old lookups on a schedule.
+// The StartKeyUsage function (api.StartKeyUsage) writes the usage of the API keys in the background.
+// The InitCache function (api.InitCache) selects the configured cache backend,
+// which the WarmCache function (controller.WarmCache) preloads from a snapshot.
 //
-// The StartAndServe function (controller.StartAndServe) is called to start and serve the application.
+// The StartAndServe function (controller.StartAndServe) is called to start and serve the application
+// until SIGINT or SIGTERM, when it drains the requests in flight and the shutdown function stops
+// the background jobs, flushes the recorder and the cache snapshot and closes the database.
 //
 // This function does not return anything.
 func main() {
-	w := os.Stderr
-	handler := log.New(w)
-	handler.SetLevel(log.DebugLevel)
-	handler.SetTimeFormat(time.Kitchen)
-	handler.SetReportTimestamp(true)
-
-	// set global logger with custom options
-	slog.SetDefault(slog.New(
-		handler))
+	args := os.Args[1:]
+	cfg, command := loadConfig(args)
+	setupLogging(cfg.Log)
+	if len(command) > 0 {
+		runCommand(cfg, command)
+		return
+	}
+
+	applyConfig := func(cfg *config.Config) {
+		api.ConfigureLogging(cfg.Log)
+		api.Configure(cfg)
+	}
+	applyConfig(cfg)
+
+	reloader := config.NewReloader(cfg, func() (*config.Config, error) {
+		return config.Load(args, os.LookupEnv)
+	}, applyConfig)
+	if err := reloader.Watch(); err != nil {
+		slog.Error("Error watching configuration, reload with the admin endpoint", "error", err)
+	}
+	controller.EnableReload(reloader)
+
 	slog.Info("Starting the application")
 
+	shutdownTracing, err := api.InitTracing(context.Background(), cfg.Tracing)
+	if err != nil {
+		slog.Error("Error initializing tracing", "error", err)
+		os.Exit(1)
+	}
+
 	slog.Debug("InitDatabase called")
 
-	api.InitDatabase()
-	controller.StartAndServe()
+	err = api.InitDatabase(cfg.Database)
+	if err != nil {
+		slog.Error("Error initializing database", "error", err)
+		os.Exit(1)
+	}
+	if err := api.InitPrivacy(cfg.Storage); err != nil {
+		slog.Error("Error initializing storage privacy", "error", err)
+		os.Exit(1)
+	}
+	api.StartRecorder(cfg.Recorder)
+	api.StartRetention(cfg.Retention)
+	api.StartKeyUsage()
+	api.InitCache(cfg.Cache)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	controller.WarmCache(ctx, cfg.Cache)
+	serveErr := controller.StartAndServe(ctx, cfg.Server)
+	if serveErr != nil {
+		slog.Error("Error starting server", "error", serveErr)
+	}
+
+	// A second signal stops the application without waiting for the shutdown
+	stop()
+	shutdown(cfg, reloader, shutdownTracing)
+	if serveErr != nil {
+		os.Exit(1)
+	}
+}
+
+// setupLogging sets the default logger, writing to the standard error in the
+// configured format through api.LogHandler. The format needs a restart to
+// change, the level and the sampling are applied again on a reload.
+func setupLogging(cfg config.LogConfig) {
+	var handler slog.Handler
+	if cfg.Format == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug})
+	} else {
+		text := log.New(os.Stderr)
+		text.SetLevel(log.DebugLevel)
+		text.SetTimeFormat(time.DateTime)
+		text.SetReportTimestamp(true)
+		handler = text
+	}
+
+	api.ConfigureLogging(cfg)
+	slog.SetDefault(slog.New(api.LogHandler(handler)))
+}
+
+// shutdown stops the background jobs once the server has stopped, writes the
+// lookups still queued within the shutdown timeout and the usage of the API
+// keys, saves the cache snapshot so the next start is warm, closes the database
+// connections and exports the spans still buffered.
+func shutdown(cfg *config.Config, reloader *config.Reloader, shutdownTracing func(context.Context) error) {
+	reloader.Stop()
+	api.StopRetention()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := api.StopRecorder(ctx); err != nil {
+		slog.Error("Error stopping recorder", "error", err)
+	}
+
+	if err := api.StopKeyUsage(); err != nil {
+		slog.Error("Error writing api key usage", "error", err)
+	}
+
+	if path := api.Settings().Cache.SnapshotFile; path != "" {
+		if saved, err := api.SaveCacheSnapshot(path); err != nil {
+			slog.Error("Error saving cache snapshot", "path", path, "error", err)
+		} else {
+			slog.Info("Saved cache snapshot", "path", path, "entries", saved)
+		}
+	}
+
+	if err := api.CloseDatabase(); err != nil {
+		slog.Error("Error closing database", "error", err)
+	}
+
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error exporting the remaining spans", "error", err)
+	}
+}
+
+// commandUsage lists the ways the application is started.
+const commandUsage = `usage: brgeo [flags]
+       brgeo [flags] migrate <command> [steps]
+       brgeo [flags] export [flags]
+       brgeo [flags] cache export|import [flags]`
+
+// commands are run instead of the server when named after the flags, with the
+// configuration loaded from them.
+var commands = map[string]struct {
+	run     func(cfg *config.Config, args []string) error
+	failure string
+}{
+	"migrate": {run: runMigrate, failure: "Migration failed"},
+	"export":  {run: runExport, failure: "Export failed"},
+	"cache":   {run: runCache, failure: "Cache command failed"},
+}
+
+// runCommand runs the command named by the first of args with the arguments
+// that follow it, and exits when it fails.
+func runCommand(cfg *config.Config, args []string) {
+	command, ok := commands[args[0]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s\n", args[0], commandUsage)
+		os.Exit(2)
+	}
+	if err := command.run(cfg, args[1:]); err != nil {
+		slog.Error(command.failure, "error", err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig loads the configuration from the flags in args, the environment, the .env file
+// and the configuration file, and returns it with the command that follows the flags, if any.
+// None of the files is required: when a required setting is missing or any setting is invalid,
+// the problems are reported in full and the application exits.
+func loadConfig(args []string) (*config.Config, []string) {
+	cfg, command, err := config.LoadCommand(args, os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		fmt.Fprintln(os.Stderr, commandUsage+"\n\nflags:")
+		config.Usage(os.Stderr)
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid configuration, see brgeo --help:")
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	return cfg, command
 }
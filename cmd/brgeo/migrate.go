@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// migrateUsage describes the arguments of the migrate command.
+const migrateUsage = `usage: brgeo migrate <command> [steps]
+
+commands:
+  up [steps]    apply pending migrations, all of them when steps is omitted
+  down [steps]  roll back applied migrations, one when steps is omitted
+  status        list the applied migrations and the schema version`
+
+// runMigrate executes the migrate command with the arguments that follow it.
+// The database is opened without applying migrations, so that the schema
+// can be inspected or rolled back.
+func runMigrate(cfg *config.Config, args []string) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	steps := 0
+	if len(args) > 1 {
+		n, err := strconv.Atoi(args[1])
+		if err != nil || n < 1 {
+			return errors.Errorf("steps must be a positive number, got %q\n\n%s", args[1], migrateUsage)
+		}
+		steps = n
+	}
+
+	if err := api.OpenDatabase(cfg.Database); err != nil {
+		return err
+	}
+	if !api.DatabaseEnabled() {
+		return errors.New("the database is disabled, set DB_DRIVER to migrate")
+	}
+
+	switch args[0] {
+	case "up":
+		if err := api.CheckSchemaVersion(); err != nil {
+			return err
+		}
+		applied, err := api.MigrateUp(steps)
+		fmt.Printf("Applied %d migration(s)\n", applied)
+		if err != nil {
+			return err
+		}
+	case "down":
+		rolledBack, err := api.MigrateDown(steps)
+		fmt.Printf("Rolled back %d migration(s)\n", rolledBack)
+		if err != nil {
+			return err
+		}
+	case "status":
+		applied, err := api.AppliedMigrations()
+		if err != nil {
+			return err
+		}
+		for _, m := range applied {
+			fmt.Printf("%04d  %-30s  %s\n", m.Version, m.Name, m.AppliedAt.Format("2006-01-02 15:04:05"))
+		}
+	default:
+		return errors.Errorf("unknown migrate command %q\n\n%s", args[0], migrateUsage)
+	}
+
+	current, err := api.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest, err := api.LatestSchemaVersion(api.DatabaseDriver())
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Schema version %d, latest %d\n", current, latest)
+	return nil
+}
@@ -2,9 +2,9 @@ package main
 
 import (
 	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/joho/godotenv"
-	"github.com/jvanrhyn/brgeo/internal/api"
+	"github.com/jvanrhyn/brgeo/config"
 	"io"
 	"net/http"
 	"os"
@@ -30,20 +30,30 @@ var (
 	ipAddress string
 )
 
-func init() {
+// uiURL is the lookup endpoint of the server, read from UI_URL.
+var uiURL string
 
-	// Read Configuration data from the .env file in the project
-	err := godotenv.Load()
+// loadUIURL reads UI_URL from the environment or from the .env file given with
+// --env-file, falling back to the default .env file when there is one. The
+// client exits with a message when it is not set.
+func loadUIURL() {
+	envFile := flag.String("env-file", "", "file of environment variables, .env in the working directory or next to the executable by default")
+	flag.Parse()
+
+	lookupEnv, err := config.WithEnvFile(*envFile, os.LookupEnv)
 	if err != nil {
-		envPath := api.GetEnvFilePath()
-		err = godotenv.Load(envPath)
-		if err != nil {
-			panic("Error loading .env file : " + err.Error())
-		}
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	uiURL, _ = lookupEnv("UI_URL")
+	if uiURL == "" {
+		fmt.Fprintln(os.Stderr, "UI_URL is not set: set it to the lookup url of the server, such as http://localhost:3000/api/lookup, in the environment or in a .env file given with --env-file")
+		os.Exit(2)
 	}
 }
 
 func main() {
+	loadUIURL()
 	form := huh.NewForm(
 		huh.NewGroup(
 			huh.NewInput().
@@ -87,7 +97,7 @@ func main() {
 }
 
 func getGeoInfo(ipAddress string) (*GeoInfo, error) {
-	resp, err := http.Get(fmt.Sprintf("%s/%s", os.Getenv("UI_URL"), ipAddress))
+	resp, err := http.Get(fmt.Sprintf("%s/%s", uiURL, ipAddress))
 	if err != nil {
 		return nil, err
 	}
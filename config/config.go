@@ -0,0 +1,290 @@
+// Package config holds the typed configuration of brgeo.
+//
+// A Config starts from Default and is overlaid, in order of precedence, by a
+// YAML file, by environment variables and by command-line flags; see Load.
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+type (
+	// Config is the complete configuration of the server.
+	Config struct {
+		Server    ServerConfig    `yaml:"server"`
+		Provider  ProviderConfig  `yaml:"provider"`
+		Cache     CacheConfig     `yaml:"cache"`
+		Database  DatabaseConfig  `yaml:"database"`
+		Recorder  RecorderConfig  `yaml:"recorder"`
+		Retention RetentionConfig `yaml:"retention"`
+		Storage   StorageConfig   `yaml:"storage"`
+		Log       LogConfig       `yaml:"log"`
+		Tracing   TracingConfig   `yaml:"tracing"`
+		Auth      AuthConfig      `yaml:"auth"`
+
+		// Sources are the files the configuration was loaded from.
+		Sources Sources `yaml:"-"`
+	}
+
+	// ServerConfig configures the HTTP server.
+	ServerConfig struct {
+		Port int `yaml:"port"`
+		// ShutdownTimeout bounds each step of a graceful shutdown: draining
+		// the requests in flight and writing the lookups still queued.
+		ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	}
+
+	// ProviderConfig configures the upstream geolocation service.
+	ProviderConfig struct {
+		ServiceURL string `yaml:"service_url"`
+		UserAgent  string `yaml:"user_agent"`
+		MaxRetries int    `yaml:"max_retries"`
+	}
+
+	// CacheConfig configures the in-memory lookup cache.
+	CacheConfig struct {
+		// Timeout is the soft TTL after which entries are refreshed,
+		// HardTimeout the TTL after which they are removed.
+		Timeout         time.Duration `yaml:"timeout"`
+		HardTimeout     time.Duration `yaml:"hard_timeout"`
+		NotFoundTimeout time.Duration `yaml:"not_found_timeout"`
+		FailureTimeout  time.Duration `yaml:"failure_timeout"`
+
+		// Backend is "memory" for an unbounded cache or "bounded".
+		Backend        string `yaml:"backend"`
+		MaxEntries     int    `yaml:"max_entries"`
+		MaxBytes       int64  `yaml:"max_bytes"`
+		EvictionPolicy string `yaml:"eviction_policy"`
+
+		PrefixMode  bool `yaml:"prefix_mode"`
+		PrefixV4Len int  `yaml:"prefix_v4_len"`
+		PrefixV6Len int  `yaml:"prefix_v6_len"`
+
+		SnapshotFile string `yaml:"snapshot_file"`
+		WarmupTop    int    `yaml:"warmup_top"`
+	}
+
+	// DatabaseConfig configures where lookups are recorded.
+	DatabaseConfig struct {
+		Driver      string        `yaml:"driver"`
+		Connection  string        `yaml:"connection"`
+		AutoMigrate bool          `yaml:"auto_migrate"`
+		CacheMaxAge time.Duration `yaml:"cache_max_age"`
+	}
+
+	// RecorderConfig configures the background writing of lookups.
+	RecorderConfig struct {
+		QueueSize     int           `yaml:"queue_size"`
+		BatchSize     int           `yaml:"batch_size"`
+		FlushInterval time.Duration `yaml:"flush_interval"`
+		DropPolicy    string        `yaml:"drop_policy"`
+	}
+
+	// RetentionConfig limits how long recorded lookups are kept. Zero limits are off.
+	RetentionConfig struct {
+		MaxAge   time.Duration `yaml:"max_age"`
+		MaxRows  int64         `yaml:"max_rows"`
+		Interval time.Duration `yaml:"interval"`
+	}
+
+	// StorageConfig configures how the ip addresses of lookups are stored.
+	StorageConfig struct {
+		PrivacyMode string `yaml:"privacy_mode"`
+		HMACKeys    string `yaml:"hmac_keys"`
+	}
+
+	// LogConfig configures the log output.
+	LogConfig struct {
+		// Level is the lowest level logged: debug, info, warn or error.
+		Level string `yaml:"level"`
+		// Format is "text" for a human readable output or "json".
+		Format string `yaml:"format"`
+		// SampleInitial is the number of debug and info records with the same
+		// message logged each second before the following ones are sampled,
+		// keeping one in SampleThereafter. Zero logs every record.
+		SampleInitial    int `yaml:"sample_initial"`
+		SampleThereafter int `yaml:"sample_thereafter"`
+	}
+
+	// TracingConfig configures the export of OpenTelemetry traces.
+	TracingConfig struct {
+		// Exporter is "none", "stdout" to write the spans to the standard
+		// output, or "otlp" to send them to a collector over OTLP/HTTP.
+		Exporter string `yaml:"exporter"`
+		// Endpoint is the url of the OTLP collector, such as http://localhost:4318;
+		// when empty the OTEL_EXPORTER_OTLP_* variables apply.
+		Endpoint string `yaml:"endpoint"`
+		// SampleRatio is the share of the traces started here that are kept.
+		SampleRatio float64 `yaml:"sample_ratio"`
+	}
+
+	// AuthConfig configures the API keys required by the endpoints.
+	AuthConfig struct {
+		// Enabled requires an API key for every endpoint but the probes and
+		// the metrics. The keys are stored in the database.
+		Enabled bool `yaml:"enabled"`
+		// AdminKey is accepted with every scope and without limits, to create
+		// the first keys. Empty disables it.
+		AdminKey string `yaml:"admin_key"`
+		// RateLimit, in requests per minute, and DailyQuota, in requests per
+		// day, are given to the keys created without limits of their own.
+		// Zero does not limit.
+		RateLimit  int   `yaml:"rate_limit"`
+		DailyQuota int64 `yaml:"daily_quota"`
+	}
+
+	// Sources names the configuration file and the .env file read by Load,
+	// empty when there was none. They are read again on a reload.
+	Sources struct {
+		ConfigFile string
+		EnvFile    string
+	}
+)
+
+// minAdminKeyLength keeps the admin key from being guessed.
+const minAdminKeyLength = 16
+
+// Default returns the configuration used for every setting that is not set
+// in a file, the environment or a flag.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Port:            3000,
+			ShutdownTimeout: 30 * time.Second,
+		},
+		Provider: ProviderConfig{
+			ServiceURL: "https://tools.keycdn.com/geo.json",
+			UserAgent:  "keycdn-tools:https://www.github.com/jvanrhyn",
+			MaxRetries: 3,
+		},
+		Cache: CacheConfig{
+			Timeout:         60 * time.Second,
+			NotFoundTimeout: 60 * time.Second,
+			FailureTimeout:  10 * time.Second,
+			Backend:         "memory",
+			MaxEntries:      10000,
+			EvictionPolicy:  "lru",
+			PrefixV4Len:     24,
+			PrefixV6Len:     48,
+		},
+		Database: DatabaseConfig{
+			Driver:      "postgres",
+			AutoMigrate: true,
+			CacheMaxAge: 24 * time.Hour,
+		},
+		Recorder: RecorderConfig{
+			QueueSize:     1000,
+			BatchSize:     100,
+			FlushInterval: time.Second,
+			DropPolicy:    "drop_newest",
+		},
+		Retention: RetentionConfig{
+			Interval: time.Hour,
+		},
+		Storage: StorageConfig{
+			PrivacyMode: "full",
+		},
+		Log: LogConfig{
+			Level:            "debug",
+			Format:           "text",
+			SampleThereafter: 100,
+		},
+		Tracing: TracingConfig{
+			Exporter:    "none",
+			SampleRatio: 1,
+		},
+		Auth: AuthConfig{
+			RateLimit:  60,
+			DailyQuota: 10000,
+		},
+	}
+}
+
+// complete fills in the settings derived from others when they are not set:
+// the hard cache timeout defaults to twice the soft one.
+func (c *Config) complete() {
+	if c.Cache.HardTimeout == 0 {
+		c.Cache.HardTimeout = 2 * c.Cache.Timeout
+	}
+}
+
+// Validate checks every setting and reports all invalid ones together.
+func (c *Config) Validate() error {
+	var problems []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			problems = append(problems, fmt.Errorf(format, args...))
+		}
+	}
+	oneOf := func(name, value string, allowed ...string) {
+		for _, a := range allowed {
+			if value == a {
+				return
+			}
+		}
+		problems = append(problems, fmt.Errorf("%s %q must be one of %v", name, value, allowed))
+	}
+
+	check(c.Server.Port > 0 && c.Server.Port < 65536, "server port %d must be between 1 and 65535", c.Server.Port)
+	check(c.Server.ShutdownTimeout > 0, "server shutdown timeout %s must be positive", c.Server.ShutdownTimeout)
+
+	if u, err := url.Parse(c.Provider.ServiceURL); err != nil || u.Scheme == "" || u.Host == "" {
+		problems = append(problems, fmt.Errorf("provider service url %q must be an absolute url", c.Provider.ServiceURL))
+	}
+	check(c.Provider.MaxRetries >= 1, "provider max retries %d must be at least 1", c.Provider.MaxRetries)
+
+	check(c.Cache.Timeout > 0, "cache timeout %s must be positive", c.Cache.Timeout)
+	check(c.Cache.HardTimeout >= c.Cache.Timeout, "cache hard timeout %s must not be shorter than the timeout %s", c.Cache.HardTimeout, c.Cache.Timeout)
+	check(c.Cache.NotFoundTimeout > 0, "cache not found timeout %s must be positive", c.Cache.NotFoundTimeout)
+	check(c.Cache.FailureTimeout > 0, "cache failure timeout %s must be positive", c.Cache.FailureTimeout)
+	oneOf("cache backend", c.Cache.Backend, "memory", "bounded")
+	check(c.Cache.MaxEntries >= 0, "cache max entries %d must not be negative", c.Cache.MaxEntries)
+	check(c.Cache.MaxBytes >= 0, "cache max bytes %d must not be negative", c.Cache.MaxBytes)
+	oneOf("cache eviction policy", c.Cache.EvictionPolicy, "lru", "lfu")
+	check(c.Cache.PrefixV4Len >= 0 && c.Cache.PrefixV4Len <= 32, "cache prefix v4 length %d must be between 0 and 32", c.Cache.PrefixV4Len)
+	check(c.Cache.PrefixV6Len >= 0 && c.Cache.PrefixV6Len <= 128, "cache prefix v6 length %d must be between 0 and 128", c.Cache.PrefixV6Len)
+	check(c.Cache.WarmupTop >= 0, "cache warmup top %d must not be negative", c.Cache.WarmupTop)
+
+	oneOf("database driver", c.Database.Driver, "postgres", "sqlite", "none")
+	check(c.Database.Driver == "none" || c.Database.Connection != "",
+		"database connection must be set for driver %q: set CONNECTION, --connection or database.connection in the config file, or DB_DRIVER=none to run without a database",
+		c.Database.Driver)
+	check(c.Database.CacheMaxAge >= 0, "database cache max age %s must not be negative", c.Database.CacheMaxAge)
+
+	check(c.Recorder.QueueSize > 0, "recorder queue size %d must be positive", c.Recorder.QueueSize)
+	check(c.Recorder.BatchSize > 0, "recorder batch size %d must be positive", c.Recorder.BatchSize)
+	check(c.Recorder.FlushInterval > 0, "recorder flush interval %s must be positive", c.Recorder.FlushInterval)
+	oneOf("recorder drop policy", c.Recorder.DropPolicy, "drop_newest", "drop_oldest", "block")
+
+	check(c.Retention.MaxAge >= 0, "retention max age %s must not be negative", c.Retention.MaxAge)
+	check(c.Retention.MaxRows >= 0, "retention max rows %d must not be negative", c.Retention.MaxRows)
+	check(c.Retention.Interval > 0, "retention interval %s must be positive", c.Retention.Interval)
+
+	oneOf("storage privacy mode", c.Storage.PrivacyMode, "full", "truncate", "hmac")
+	check(c.Storage.PrivacyMode != "hmac" || c.Storage.HMACKeys != "", "storage hmac keys must be set for the hmac privacy mode")
+
+	oneOf("log level", c.Log.Level, "debug", "info", "warn", "error")
+	oneOf("log format", c.Log.Format, "text", "json")
+	check(c.Log.SampleInitial >= 0, "log sample initial %d must not be negative", c.Log.SampleInitial)
+	check(c.Log.SampleThereafter >= 1, "log sample thereafter %d must be at least 1", c.Log.SampleThereafter)
+
+	oneOf("tracing exporter", c.Tracing.Exporter, "none", "stdout", "otlp")
+	if c.Tracing.Endpoint != "" {
+		if u, err := url.Parse(c.Tracing.Endpoint); err != nil || u.Scheme == "" || u.Host == "" {
+			problems = append(problems, fmt.Errorf("tracing endpoint %q must be an absolute url", c.Tracing.Endpoint))
+		}
+	}
+	check(c.Tracing.SampleRatio >= 0 && c.Tracing.SampleRatio <= 1, "tracing sample ratio %g must be between 0 and 1", c.Tracing.SampleRatio)
+
+	check(!c.Auth.Enabled || c.Database.Driver != "none" || c.Auth.AdminKey != "",
+		"auth needs a database to store the api keys, or an admin api key: set DB_DRIVER or ADMIN_API_KEY")
+	check(c.Auth.AdminKey == "" || len(c.Auth.AdminKey) >= minAdminKeyLength, "auth admin key must be at least %d characters long", minAdminKeyLength)
+	check(c.Auth.RateLimit >= 0, "auth rate limit %d must not be negative", c.Auth.RateLimit)
+	check(c.Auth.DailyQuota >= 0, "auth daily quota %d must not be negative", c.Auth.DailyQuota)
+
+	return errors.Join(problems...)
+}
@@ -0,0 +1,165 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// env returns a lookupEnv reading from the map.
+func env(values map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := values[name]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "brgeo.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+
+	cfg, err := Load(nil, env(map[string]string{"CONNECTION": ":memory:"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 3000 || cfg.Cache.Timeout != time.Minute || cfg.Database.Driver != "postgres" {
+		t.Errorf("unexpected defaults %+v", cfg)
+	}
+	if cfg.Cache.HardTimeout != 2*time.Minute {
+		t.Errorf("expected the hard timeout to default to twice the timeout but got %s", cfg.Cache.HardTimeout)
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+
+	path := writeFile(t, `
+server:
+  port: 4000
+cache:
+  timeout: 5m
+  backend: bounded
+database:
+  driver: sqlite
+  connection: file.db
+`)
+
+	cfg, err := Load([]string{"-port", "5000"}, env(map[string]string{
+		FileVariable:        path,
+		"PORT":              "4500",
+		"CACHE_TIMEOUT_SEC": "120",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Server.Port != 5000 {
+		t.Errorf("expected the flag to override the environment but got port %d", cfg.Server.Port)
+	}
+	if cfg.Cache.Timeout != 2*time.Minute {
+		t.Errorf("expected the environment to override the file but got timeout %s", cfg.Cache.Timeout)
+	}
+	if cfg.Cache.Backend != "bounded" || cfg.Database.Driver != "sqlite" || cfg.Database.Connection != "file.db" {
+		t.Errorf("expected the file to override the defaults but got %+v", cfg)
+	}
+	if cfg.Cache.NotFoundTimeout != time.Minute {
+		t.Errorf("expected unset settings to keep their default but got %s", cfg.Cache.NotFoundTimeout)
+	}
+}
+
+func TestLoadConfigFlag(t *testing.T) {
+
+	path := writeFile(t, "database:\n  driver: none\n")
+
+	cfg, err := Load([]string{"-config", path}, env(map[string]string{FileVariable: "missing.yaml"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Driver != "none" {
+		t.Errorf("expected the -config flag to override %s but got driver %q", FileVariable, cfg.Database.Driver)
+	}
+}
+
+func TestLoadRejectsUnknownFileKeys(t *testing.T) {
+
+	path := writeFile(t, "database:\n  drvier: none\n")
+
+	_, err := Load([]string{"-config", path}, env(map[string]string{"CONNECTION": ":memory:"}))
+	if err == nil || !strings.Contains(err.Error(), "drvier") {
+		t.Errorf("expected the misspelt key to be reported but got %v", err)
+	}
+}
+
+func TestLoadReportsAllProblems(t *testing.T) {
+
+	_, err := Load([]string{"-max-retries", "many"}, env(map[string]string{
+		"PORT":                 "70000",
+		"CACHE_TIMEOUT_SEC":    "soon",
+		"CACHE_BACKEND":        "disk",
+		"STORAGE_PRIVACY_MODE": "hmac",
+		"TRACING_SAMPLE_RATIO": "2",
+		"ADMIN_API_KEY":        "short",
+	}))
+	if err == nil {
+		t.Fatal("expected the configuration to be invalid")
+	}
+
+	for _, want := range []string{
+		"-max-retries",
+		"CACHE_TIMEOUT_SEC",
+		"server port 70000",
+		"cache backend",
+		"database connection",
+		"storage hmac keys",
+		"tracing sample ratio",
+		"auth admin key",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("expected %q to be reported in %v", want, err)
+		}
+	}
+}
+
+func TestLoadExampleFile(t *testing.T) {
+
+	cfg, err := Load([]string{"-config", "brgeo.example.yaml"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := Default()
+	want.complete()
+	want.Database.Connection = cfg.Database.Connection
+	want.Sources = cfg.Sources
+	if *cfg != want {
+		t.Errorf("expected the example file to hold the defaults but got %+v", cfg)
+	}
+}
+
+func TestLoadCommand(t *testing.T) {
+
+	path := writeFile(t, "database:\n  driver: sqlite\n  connection: brgeo.db\n")
+
+	cfg, command, err := LoadCommand([]string{"-config", path, "-port", "8080", "migrate", "up", "2"}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Connection != "brgeo.db" || cfg.Server.Port != 8080 {
+		t.Errorf("expected the flags before the command to apply but got %+v", cfg.Database)
+	}
+	if strings.Join(command, " ") != "migrate up 2" {
+		t.Errorf("expected the command and its arguments but got %v", command)
+	}
+
+	if _, err := Load([]string{"-port", "8080", "migrate"}, env(map[string]string{"CONNECTION": ":memory:"})); err == nil {
+		t.Error("expected Load to refuse a command")
+	}
+}
@@ -0,0 +1,64 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/go-errors/errors"
+	"github.com/joho/godotenv"
+)
+
+// envFileName is the name of the .env file looked for when none is given.
+const envFileName = ".env"
+
+// WithEnvFile returns a lookupEnv that falls back to the variables of a .env
+// file for those lookupEnv does not set, so the real environment always wins.
+//
+// A path that is given must exist. Without one, the .env file in the working
+// directory or else the one next to the executable is read, when there is one;
+// lookupEnv is returned as is when there is neither.
+func WithEnvFile(path string, lookupEnv func(string) (string, bool)) (func(string) (string, bool), error) {
+	lookupEnv, _, err := withEnvFile(path, lookupEnv)
+	return lookupEnv, err
+}
+
+// withEnvFile is WithEnvFile, also returning the path of the .env file read.
+func withEnvFile(path string, lookupEnv func(string) (string, bool)) (func(string) (string, bool), string, error) {
+	if path == "" {
+		path = findEnvFile()
+		if path == "" {
+			return lookupEnv, "", nil
+		}
+	}
+
+	values, err := godotenv.Read(path)
+	if err != nil {
+		return nil, "", errors.Errorf("env file: %v", err)
+	}
+	slog.Debug("Read env file", "path", path, "variables", len(values))
+
+	return func(name string) (string, bool) {
+		if value, ok := lookupEnv(name); ok {
+			return value, true
+		}
+		value, ok := values[name]
+		return value, ok
+	}, path, nil
+}
+
+// findEnvFile returns the .env file in the working directory or next to
+// the executable, or "" when there is none.
+func findEnvFile() string {
+	candidates := []string{envFileName}
+	if ex, err := os.Executable(); err == nil {
+		candidates = append(candidates, filepath.Join(filepath.Dir(ex), envFileName))
+	}
+
+	for _, candidate := range candidates {
+		if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+			return candidate
+		}
+	}
+	return ""
+}
@@ -0,0 +1,68 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWithEnvFile(t *testing.T) {
+
+	path := filepath.Join(t.TempDir(), "brgeo.env")
+	content := "PORT=4000\nCONNECTION=\"host=db user=brgeo\"\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	lookupEnv, err := WithEnvFile(path, env(map[string]string{"PORT": "5000"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := lookupEnv("PORT"); port != "5000" {
+		t.Errorf("expected the environment to override the env file but got %q", port)
+	}
+	if conn, _ := lookupEnv("CONNECTION"); conn != "host=db user=brgeo" {
+		t.Errorf("expected the env file to fill in the environment but got %q", conn)
+	}
+	if _, ok := lookupEnv("DB_DRIVER"); ok {
+		t.Error("expected a variable set nowhere to be missing")
+	}
+
+	cfg, err := Load([]string{"-env-file", path}, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Port != 4000 || cfg.Database.Connection != "host=db user=brgeo" {
+		t.Errorf("expected the settings of the env file but got %+v", cfg)
+	}
+}
+
+func TestWithEnvFileMissing(t *testing.T) {
+
+	if _, err := WithEnvFile(filepath.Join(t.TempDir(), "missing.env"), env(nil)); err == nil {
+		t.Error("expected an env file that was given to be required")
+	}
+
+	// Without a .env file in the working directory or next to the test binary,
+	// the environment is used as is
+	lookupEnv, err := WithEnvFile("", env(map[string]string{"PORT": "5000"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if port, _ := lookupEnv("PORT"); port != "5000" {
+		t.Errorf("unexpected port %q", port)
+	}
+}
+
+func TestLoadReportsMissingConnection(t *testing.T) {
+
+	_, err := Load(nil, env(nil))
+	if err == nil || !strings.Contains(err.Error(), "set CONNECTION") {
+		t.Errorf("expected the missing connection to be explained but got %v", err)
+	}
+
+	if _, err := Load([]string{"-db-driver", "none"}, env(nil)); err != nil {
+		t.Errorf("expected no connection to be needed without a database but got %v", err)
+	}
+}
@@ -0,0 +1,278 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// FileVariable names the environment variable holding the path of the
+// configuration file, when it is not given with the -config flag.
+const FileVariable = "CONFIG_FILE"
+
+// option is a setting that can be given as an environment variable and as a
+// flag. The flag is the lower case form of the variable, with dashes for
+// underscores: CACHE_TIMEOUT_SEC is set with -cache-timeout-sec.
+type option struct {
+	name  string
+	usage string
+	set   func(c *Config, value string) error
+}
+
+// options lists every setting that can be given in the environment or as a flag.
+var options = []option{
+	intOption("PORT", "port the server listens on", func(c *Config) *int { return &c.Server.Port }),
+	durationOption("SHUTDOWN_TIMEOUT_SEC", time.Second, "seconds to drain requests and queued lookups on shutdown", func(c *Config) *time.Duration { return &c.Server.ShutdownTimeout }),
+
+	stringOption("SERVICE_URL", "url of the upstream geolocation service", func(c *Config) *string { return &c.Provider.ServiceURL }),
+	stringOption("USER_AGENT", "user agent sent to the upstream service", func(c *Config) *string { return &c.Provider.UserAgent }),
+	intOption("MAX_RETRIES", "attempts made for an upstream lookup", func(c *Config) *int { return &c.Provider.MaxRetries }),
+
+	durationOption("CACHE_TIMEOUT_SEC", time.Second, "seconds before a cached lookup is refreshed", func(c *Config) *time.Duration { return &c.Cache.Timeout }),
+	durationOption("CACHE_HARD_TIMEOUT_SEC", time.Second, "seconds before a cached lookup is removed, twice the timeout by default", func(c *Config) *time.Duration { return &c.Cache.HardTimeout }),
+	durationOption("CACHE_NOT_FOUND_TIMEOUT_SEC", time.Second, "seconds an address without data is cached", func(c *Config) *time.Duration { return &c.Cache.NotFoundTimeout }),
+	durationOption("CACHE_FAILURE_TIMEOUT_SEC", time.Second, "seconds a failed lookup is cached", func(c *Config) *time.Duration { return &c.Cache.FailureTimeout }),
+	stringOption("CACHE_BACKEND", "memory or bounded", func(c *Config) *string { return &c.Cache.Backend }),
+	intOption("CACHE_MAX_ENTRIES", "entries kept by the bounded cache", func(c *Config) *int { return &c.Cache.MaxEntries }),
+	int64Option("CACHE_MAX_BYTES", "approximate bytes kept by the bounded cache, 0 for no limit", func(c *Config) *int64 { return &c.Cache.MaxBytes }),
+	stringOption("CACHE_EVICTION_POLICY", "lru or lfu", func(c *Config) *string { return &c.Cache.EvictionPolicy }),
+	boolOption("CACHE_PREFIX_MODE", "also cache lookups per network block", func(c *Config) *bool { return &c.Cache.PrefixMode }),
+	intOption("CACHE_PREFIX_V4_LEN", "length of the IPv4 network blocks", func(c *Config) *int { return &c.Cache.PrefixV4Len }),
+	intOption("CACHE_PREFIX_V6_LEN", "length of the IPv6 network blocks", func(c *Config) *int { return &c.Cache.PrefixV6Len }),
+	stringOption("CACHE_SNAPSHOT_FILE", "cache snapshot loaded at startup", func(c *Config) *string { return &c.Cache.SnapshotFile }),
+	intOption("CACHE_WARMUP_TOP", "most frequent addresses looked up at startup", func(c *Config) *int { return &c.Cache.WarmupTop }),
+
+	stringOption("DB_DRIVER", "postgres, sqlite or none", func(c *Config) *string { return &c.Database.Driver }),
+	stringOption("CONNECTION", "database connection string or sqlite file", func(c *Config) *string { return &c.Database.Connection }),
+	boolOption("DB_AUTO_MIGRATE", "apply pending migrations at startup", func(c *Config) *bool { return &c.Database.AutoMigrate }),
+	durationOption("DB_CACHE_MAX_AGE_SEC", time.Second, "seconds a stored geolocation answers lookups, 0 to disable", func(c *Config) *time.Duration { return &c.Database.CacheMaxAge }),
+
+	intOption("RECORDER_QUEUE_SIZE", "lookups queued for recording", func(c *Config) *int { return &c.Recorder.QueueSize }),
+	intOption("RECORDER_BATCH_SIZE", "lookups recorded per batch", func(c *Config) *int { return &c.Recorder.BatchSize }),
+	durationOption("RECORDER_FLUSH_INTERVAL_MS", time.Millisecond, "milliseconds between batches", func(c *Config) *time.Duration { return &c.Recorder.FlushInterval }),
+	stringOption("RECORDER_DROP_POLICY", "drop_newest, drop_oldest or block", func(c *Config) *string { return &c.Recorder.DropPolicy }),
+
+	durationOption("RETENTION_MAX_AGE_DAYS", 24*time.Hour, "days recorded lookups are kept, 0 to keep them", func(c *Config) *time.Duration { return &c.Retention.MaxAge }),
+	int64Option("RETENTION_MAX_ROWS", "recorded lookups kept, 0 to keep them all", func(c *Config) *int64 { return &c.Retention.MaxRows }),
+	durationOption("RETENTION_INTERVAL_MIN", time.Minute, "minutes between purges", func(c *Config) *time.Duration { return &c.Retention.Interval }),
+
+	stringOption("STORAGE_PRIVACY_MODE", "full, truncate or hmac", func(c *Config) *string { return &c.Storage.PrivacyMode }),
+	stringOption("STORAGE_HMAC_KEYS", "id:secret keys hashing stored addresses, current first", func(c *Config) *string { return &c.Storage.HMACKeys }),
+
+	stringOption("LOG_LEVEL", "debug, info, warn or error", func(c *Config) *string { return &c.Log.Level }),
+	stringOption("LOG_FORMAT", "text or json", func(c *Config) *string { return &c.Log.Format }),
+	intOption("LOG_SAMPLE_INITIAL", "debug and info records with the same message logged each second before sampling, 0 to log all", func(c *Config) *int { return &c.Log.SampleInitial }),
+	intOption("LOG_SAMPLE_THEREAFTER", "one in this many records logged once sampling", func(c *Config) *int { return &c.Log.SampleThereafter }),
+
+	stringOption("TRACING_EXPORTER", "none, stdout or otlp", func(c *Config) *string { return &c.Tracing.Exporter }),
+	stringOption("TRACING_ENDPOINT", "url of the OTLP/HTTP collector", func(c *Config) *string { return &c.Tracing.Endpoint }),
+	floatOption("TRACING_SAMPLE_RATIO", "share of traces kept, between 0 and 1", func(c *Config) *float64 { return &c.Tracing.SampleRatio }),
+
+	boolOption("AUTH_ENABLED", "require an api key for every endpoint but the probes and metrics", func(c *Config) *bool { return &c.Auth.Enabled }),
+	stringOption("ADMIN_API_KEY", "api key accepted with every scope, to create the first keys", func(c *Config) *string { return &c.Auth.AdminKey }),
+	intOption("AUTH_RATE_LIMIT", "requests per minute allowed to new api keys, 0 for no limit", func(c *Config) *int { return &c.Auth.RateLimit }),
+	int64Option("AUTH_DAILY_QUOTA", "requests per day allowed to new api keys, 0 for no limit", func(c *Config) *int64 { return &c.Auth.DailyQuota }),
+}
+
+// Load builds the configuration from Default, then the YAML file named by the
+// -config flag or the CONFIG_FILE variable, then the environment read with
+// lookupEnv and finally the flags in args. Each source overrides the ones
+// before it. Every invalid value, in any source, is reported together.
+//
+// Variables missing from the environment are read from the .env file named by
+// the -env-file flag or, when there is one, the default .env file; see WithEnvFile.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	cfg, rest, err := LoadCommand(args, lookupEnv)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errors.Errorf("unexpected argument %q", rest[0])
+	}
+	return cfg, nil
+}
+
+// LoadCommand is Load for a command line where the flags are followed by a
+// command: it stops at the first argument that is not a flag, and returns it
+// with the arguments that follow, so that the configuration files and settings
+// given as flags also apply to the command.
+func LoadCommand(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	cfg := Default()
+	var problems []error
+
+	cmd := newCommandLine()
+	cmd.flags.SetOutput(io.Discard)
+	if err := cmd.flags.Parse(args); err != nil {
+		return nil, nil, errors.New(err)
+	}
+	rest := cmd.flags.Args()
+
+	lookupEnv, envFile, err := withEnvFile(cmd.envFile, lookupEnv)
+	if err != nil {
+		return nil, nil, err
+	}
+	cfg.Sources.EnvFile = envFile
+
+	path := cmd.configFile
+	if path == "" {
+		path, _ = lookupEnv(FileVariable)
+	}
+	if path != "" {
+		cfg.Sources.ConfigFile = path
+		if err := loadFile(&cfg, path); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	for _, opt := range options {
+		if value, ok := lookupEnv(opt.name); ok && value != "" {
+			if err := opt.set(&cfg, value); err != nil {
+				problems = append(problems, fmt.Errorf("%s: %w", opt.name, err))
+			}
+		}
+	}
+
+	for _, set := range cmd.set {
+		if err := set.opt.set(&cfg, set.value); err != nil {
+			problems = append(problems, fmt.Errorf("-%s: %w", flagName(set.opt.name), err))
+		}
+	}
+
+	cfg.complete()
+	if err := cfg.Validate(); err != nil {
+		problems = append(problems, err)
+	}
+	if len(problems) > 0 {
+		return nil, nil, errors.Join(problems...)
+	}
+	return &cfg, rest, nil
+}
+
+// Usage writes the flags accepted by Load to w.
+func Usage(w io.Writer) {
+	cmd := newCommandLine()
+	cmd.flags.SetOutput(w)
+	cmd.flags.PrintDefaults()
+}
+
+type flagValue struct {
+	opt   option
+	value string
+}
+
+// commandLine holds the flags accepted by Load and, once parsed, their values.
+// The values of the settings are collected in order, to be applied after the
+// file and the environment.
+type commandLine struct {
+	flags      *flag.FlagSet
+	configFile string
+	envFile    string
+	set        []flagValue
+}
+
+func newCommandLine() *commandLine {
+	cmd := &commandLine{flags: flag.NewFlagSet("brgeo", flag.ContinueOnError)}
+	cmd.flags.StringVar(&cmd.configFile, "config", "", "YAML configuration file, overrides "+FileVariable)
+	cmd.flags.StringVar(&cmd.envFile, "env-file", "", "file of environment variables, .env in the working directory or next to the executable by default")
+
+	for _, opt := range options {
+		opt := opt
+		cmd.flags.Func(flagName(opt.name), opt.usage, func(value string) error {
+			cmd.set = append(cmd.set, flagValue{opt: opt, value: value})
+			return nil
+		})
+	}
+	return cmd
+}
+
+// loadFile overlays the settings in the YAML file at path. Unknown keys are
+// reported, so a misspelt setting is not silently ignored.
+func loadFile(cfg *Config, path string) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("config file: %w", err)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && err != io.EOF {
+		return fmt.Errorf("config file %s: %w", path, err)
+	}
+	return nil
+}
+
+func flagName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+func stringOption(name, usage string, field func(*Config) *string) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		*field(c) = value
+		return nil
+	}}
+}
+
+func intOption(name, usage string, field func(*Config) *int) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func int64Option(name, usage string, field func(*Config) *int64) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		*field(c) = n
+		return nil
+	}}
+}
+
+func floatOption(name, usage string, field func(*Config) *float64) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*field(c) = f
+		return nil
+	}}
+}
+
+func boolOption(name, usage string, field func(*Config) *bool) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not true or false", value)
+		}
+		*field(c) = b
+		return nil
+	}}
+}
+
+// durationOption reads a whole number of units, as the variable names
+// tell the unit: CACHE_TIMEOUT_SEC=300 is five minutes.
+func durationOption(name string, unit time.Duration, usage string, field func(*Config) *time.Duration) option {
+	return option{name: name, usage: usage, set: func(c *Config, value string) error {
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a whole number", value)
+		}
+		*field(c) = time.Duration(n) * unit
+		return nil
+	}}
+}
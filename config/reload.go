@@ -0,0 +1,233 @@
+package config
+
+import (
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/go-errors/errors"
+)
+
+// reloadDebounce groups the burst of events an editor makes when saving a file
+// into a single reload.
+const reloadDebounce = 250 * time.Millisecond
+
+// reloadable lists the settings, by their YAML path, that take effect without a
+// restart. The others shape components built once at startup, such as the
+// listener, the database connection or the cache backend.
+var reloadable = map[string]bool{
+	"provider.service_url":    true,
+	"provider.user_agent":     true,
+	"provider.max_retries":    true,
+	"cache.timeout":           true,
+	"cache.hard_timeout":      true,
+	"cache.not_found_timeout": true,
+	"cache.failure_timeout":   true,
+	"cache.prefix_mode":       true,
+	"cache.prefix_v4_len":     true,
+	"cache.prefix_v6_len":     true,
+	"cache.snapshot_file":     true,
+	"database.cache_max_age":  true,
+	"log.level":               true,
+	"log.sample_initial":      true,
+	"log.sample_thereafter":   true,
+	"auth.admin_key":          true,
+	"auth.rate_limit":         true,
+	"auth.daily_quota":        true,
+}
+
+// ReloadResult reports the settings changed by a reload, and those that
+// changed but were left as they are until the next restart.
+type ReloadResult struct {
+	Changed []string `json:"changed"`
+	Ignored []string `json:"ignored"`
+}
+
+// Reloader loads the configuration again and applies the settings that can
+// change at runtime. A reload is triggered by SIGHUP, by a change to one of the
+// files the configuration was loaded from, or by calling Reload.
+type Reloader struct {
+	load  func() (*Config, error)
+	apply func(*Config)
+
+	mu      sync.Mutex
+	current *Config
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewReloader returns a Reloader of the current configuration. The load
+// function reads the configuration again, normally by calling Load with the
+// arguments of the process; apply hands the result to the running components.
+func NewReloader(current *Config, load func() (*Config, error), apply func(*Config)) *Reloader {
+	return &Reloader{load: load, apply: apply, current: current}
+}
+
+// Current returns the configuration in effect.
+func (r *Reloader) Current() *Config {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// Reload loads the configuration and applies the settings that changed and can
+// change at runtime, all at once. An invalid configuration, or one that is
+// invalid along with the settings that need a restart, is not applied at all.
+func (r *Reloader) Reload() (ReloadResult, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := r.load()
+	if err != nil {
+		return ReloadResult{}, err
+	}
+
+	merged, result := merge(r.current, next)
+	if len(result.Ignored) > 0 {
+		slog.Warn("Configuration changes need a restart to take effect", "settings", result.Ignored)
+	}
+	if len(result.Changed) == 0 {
+		return result, nil
+	}
+	// The settings kept until a restart may not hold with the reloaded ones
+	if err := merged.Validate(); err != nil {
+		return ReloadResult{}, err
+	}
+
+	r.current = merged
+	r.apply(merged)
+	slog.Info("Reloaded configuration", "settings", result.Changed)
+	return result, nil
+}
+
+// Watch reloads the configuration on SIGHUP and whenever the configuration file
+// or the .env file it was loaded from changes, until Stop is called.
+func (r *Reloader) Watch() error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return errors.New(err)
+	}
+
+	// Editors replace files rather than write them, so the directories are
+	// watched and the events filtered by file name
+	files := map[string]bool{}
+	sources := r.Current().Sources
+	for _, path := range []string{sources.ConfigFile, sources.EnvFile} {
+		if path == "" {
+			continue
+		}
+		abs, err := filepath.Abs(path)
+		if err != nil {
+			_ = watcher.Close()
+			return errors.New(err)
+		}
+		if !files[abs] {
+			if err := watcher.Add(filepath.Dir(abs)); err != nil {
+				_ = watcher.Close()
+				return errors.New(err)
+			}
+		}
+		files[abs] = true
+	}
+
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+	go r.watch(watcher, files, hangup)
+	slog.Info("Watching configuration for changes", "files", len(files))
+	return nil
+}
+
+// Stop stops watching for changes.
+func (r *Reloader) Stop() {
+	if r.stop == nil {
+		return
+	}
+	close(r.stop)
+	<-r.done
+}
+
+func (r *Reloader) watch(watcher *fsnotify.Watcher, files map[string]bool, hangup chan os.Signal) {
+	defer close(r.done)
+	defer signal.Stop(hangup)
+	defer func() { _ = watcher.Close() }()
+
+	debounce := time.NewTimer(reloadDebounce)
+	debounce.Stop()
+
+	reload := func(trigger string) {
+		if _, err := r.Reload(); err != nil {
+			slog.Error("Error reloading configuration, keeping the current one", "trigger", trigger, "error", err)
+		}
+	}
+
+	for {
+		select {
+		case <-r.stop:
+			debounce.Stop()
+			return
+		case <-hangup:
+			reload("signal")
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if files[event.Name] && !event.Has(fsnotify.Chmod) {
+				debounce.Reset(reloadDebounce)
+			}
+		case <-debounce.C:
+			reload("file")
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			slog.Error("Error watching configuration files", "error", err)
+		}
+	}
+}
+
+// merge returns the current configuration with the reloadable settings of next,
+// and the settings that differ between them.
+func merge(current, next *Config) (*Config, ReloadResult) {
+	merged := *current
+	result := ReloadResult{Changed: []string{}, Ignored: []string{}}
+
+	cur := reflect.ValueOf(current).Elem()
+	nxt := reflect.ValueOf(next).Elem()
+	out := reflect.ValueOf(&merged).Elem()
+	for i := 0; i < cur.NumField(); i++ {
+		section := yamlName(cur.Type().Field(i))
+		if section == "-" {
+			continue
+		}
+		for j := 0; j < cur.Field(i).NumField(); j++ {
+			from, to := cur.Field(i).Field(j), nxt.Field(i).Field(j)
+			if from.Interface() == to.Interface() {
+				continue
+			}
+			name := section + "." + yamlName(cur.Field(i).Type().Field(j))
+			if !reloadable[name] {
+				result.Ignored = append(result.Ignored, name)
+				continue
+			}
+			out.Field(i).Field(j).Set(to)
+			result.Changed = append(result.Changed, name)
+		}
+	}
+	return &merged, result
+}
+
+func yamlName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+	return name
+}
@@ -0,0 +1,128 @@
+package config
+
+import (
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReloadAppliesReloadableSettings(t *testing.T) {
+
+	current := Default()
+	current.Database.Driver = "none"
+	current.Cache.HardTimeout = 10 * time.Minute
+	current.complete()
+	next := current
+	next.Cache.Timeout = 5 * time.Minute
+	next.Provider.MaxRetries = 5
+	next.Server.Port = 8080
+
+	var applied *Config
+	r := NewReloader(&current, func() (*Config, error) {
+		cfg := next
+		return &cfg, nil
+	}, func(cfg *Config) { applied = cfg })
+
+	result, err := r.Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Changed, []string{"provider.max_retries", "cache.timeout"}) {
+		t.Errorf("unexpected changed settings %v", result.Changed)
+	}
+	if !reflect.DeepEqual(result.Ignored, []string{"server.port"}) {
+		t.Errorf("unexpected ignored settings %v", result.Ignored)
+	}
+
+	if applied == nil || applied.Cache.Timeout != 5*time.Minute || applied.Provider.MaxRetries != 5 {
+		t.Fatalf("expected the reloadable settings to be applied but got %+v", applied)
+	}
+	if applied.Server.Port != 3000 {
+		t.Errorf("expected the port to need a restart but got %d", applied.Server.Port)
+	}
+	if r.Current() != applied {
+		t.Error("expected the applied configuration to be current")
+	}
+}
+
+func TestReloadKeepsConfigurationOnError(t *testing.T) {
+
+	current := Default()
+	calls := 0
+	r := NewReloader(&current, func() (*Config, error) {
+		return Load(nil, env(map[string]string{"PORT": "none"}))
+	}, func(*Config) { calls++ })
+
+	if _, err := r.Reload(); err == nil {
+		t.Error("expected an invalid configuration to be reported")
+	}
+	if calls != 0 || r.Current() != &current {
+		t.Error("expected an invalid configuration not to be applied")
+	}
+}
+
+func TestReloadValidatesAppliedConfiguration(t *testing.T) {
+
+	// Authentication without a database relies on the admin key
+	current := Default()
+	current.Database.Driver = "none"
+	current.Auth.Enabled = true
+	current.Auth.AdminKey = "startup-admin-key"
+	current.complete()
+	if err := current.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reloaded configuration clears the admin key, and is valid on its own
+	// as it still has the default database and authentication is disabled
+	calls := 0
+	r := NewReloader(&current, func() (*Config, error) {
+		next := Default()
+		next.Database.Connection = "postgres://localhost/brgeo"
+		next.complete()
+		if err := next.Validate(); err != nil {
+			t.Fatal(err)
+		}
+		return &next, nil
+	}, func(*Config) { calls++ })
+
+	if _, err := r.Reload(); err == nil {
+		t.Error("expected clearing the admin key to be refused while authentication needs it")
+	}
+	if calls != 0 || r.Current() != &current {
+		t.Error("expected the configuration not to be applied")
+	}
+}
+
+func TestReloadOnFileChange(t *testing.T) {
+
+	path := writeFile(t, "database:\n  driver: none\ncache:\n  timeout: 1m\n")
+	load := func() (*Config, error) {
+		return Load([]string{"-config", path}, env(nil))
+	}
+	current, err := load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var timeout atomic.Int64
+	r := NewReloader(current, load, func(cfg *Config) { timeout.Store(int64(cfg.Cache.Timeout)) })
+	if err := r.Watch(); err != nil {
+		t.Fatal(err)
+	}
+	defer r.Stop()
+
+	if err := os.WriteFile(path, []byte("database:\n  driver: none\ncache:\n  timeout: 3m\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Duration(timeout.Load()) != 3*time.Minute {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the changed file to be reloaded")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"log/slog"
+	"net/netip"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// reloader reloads the configuration on POST /admin/config/reload.
+var reloader *config.Reloader
+
+// EnableReload lets the configuration be reloaded through the admin endpoint.
+// It is called before StartAndServe.
+func EnableReload(r *config.Reloader) {
+	reloader = r
+}
+
+// eraseIpAddress removes every record of the ip address, as requested by its owner,
+// and responds with the number of rows removed.
+func eraseIpAddress(c *fiber.Ctx) error {
+	ipaddress := utils.CopyString(c.Params("ipaddress"))
+	if _, err := netip.ParseAddr(ipaddress); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, "not a valid ip address"))
+	}
+
+	result, err := api.EraseIpAddress(c.UserContext(), ipaddress)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Error erasing ip address", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "erasure failed"))
+	}
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// retentionStats responds with the counters of the retention job and of erasures.
+func retentionStats(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(api.GetRetentionStats())
+}
+
+// reloadConfig loads the configuration again and responds with the settings
+// applied and those that need a restart.
+func reloadConfig(c *fiber.Ctx) error {
+	if reloader == nil {
+		return c.Status(fiber.StatusNotFound).JSON(errorBody(c, "configuration reload is not enabled"))
+	}
+
+	result, err := reloader.Reload()
+	if err != nil {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(errorBody(c, err.Error()))
+	}
+	return c.Status(fiber.StatusOK).JSON(result)
+}
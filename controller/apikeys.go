@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"log/slog"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// defaultUsageDays is the number of days of usage returned for a key by default.
+const defaultUsageDays = 30
+
+// createAPIKey creates a key from the name, scopes and limits in the body and
+// responds with the key, shown this once, and its record.
+func createAPIKey(c *fiber.Ctx) error {
+	var n api.NewAPIKey
+	if err := c.BodyParser(&n); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, "body must be a JSON object with a name and scopes"))
+	}
+	if err := n.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+
+	raw, key, err := api.CreateAPIKey(c.UserContext(), n)
+	if errors.Is(err, api.ErrNoKeyStore) {
+		return c.Status(fiber.StatusNotFound).JSON(errorBody(c, err.Error()))
+	}
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Error creating api key", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "api key creation failed"))
+	}
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"key": raw, "api_key": key})
+}
+
+// listAPIKeys responds with every key and the requests made with it today.
+func listAPIKeys(c *fiber.Ctx) error {
+	keys, err := api.ListAPIKeys(c.UserContext())
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Error listing api keys", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "api key listing failed"))
+	}
+	return c.Status(fiber.StatusOK).JSON(keys)
+}
+
+// revokeAPIKey revokes the key with the id and responds with its record.
+func revokeAPIKey(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, "not a valid api key id"))
+	}
+
+	key, err := api.RevokeAPIKey(c.UserContext(), uint(id))
+	if errors.Is(err, api.ErrUnknownAPIKey) {
+		return c.Status(fiber.StatusNotFound).JSON(errorBody(c, err.Error()))
+	}
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Error revoking api key", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "api key revocation failed"))
+	}
+	return c.Status(fiber.StatusOK).JSON(key)
+}
+
+// apiKeyUsage responds with the requests made with the key with the id, per
+// day, over the number of days of the days parameter.
+func apiKeyUsage(c *fiber.Ctx) error {
+	id, err := strconv.ParseUint(c.Params("id"), 10, 32)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, "not a valid api key id"))
+	}
+	days := defaultUsageDays
+	if value := c.Query("days"); value != "" {
+		if days, err = strconv.Atoi(value); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, "days must be a whole number"))
+		}
+	}
+
+	usage, err := api.GetAPIKeyUsage(c.UserContext(), uint(id), days)
+	switch {
+	case errors.Is(err, api.ErrUnknownAPIKey):
+		return c.Status(fiber.StatusNotFound).JSON(errorBody(c, err.Error()))
+	case errors.Is(err, api.ErrInvalidUsageDays):
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	case err != nil:
+		slog.ErrorContext(c.UserContext(), "Error reading api key usage", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "api key usage failed"))
+	}
+	return c.Status(fiber.StatusOK).JSON(usage)
+}
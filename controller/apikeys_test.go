@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestAPIKeyEndpoints(t *testing.T) {
+
+	app := newApp()
+	admin := map[string]string{apiKeyHeader: adminKey}
+
+	testCases := map[string]struct {
+		body   string
+		status int
+	}{
+		"not json":      {body: `name=crm`, status: fiber.StatusBadRequest},
+		"no scopes":     {body: `{"name": "crm"}`, status: fiber.StatusBadRequest},
+		"unknown scope": {body: `{"name": "crm", "scopes": ["root"]}`, status: fiber.StatusBadRequest},
+		"valid":         {body: `{"name": "crm", "scopes": ["batch"], "rate_limit": 0}`, status: fiber.StatusCreated},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if resp, data := call(t, app, fiber.MethodPost, "/admin/keys", tc.body, admin); resp.StatusCode != tc.status {
+				t.Errorf("expected %d but got %d %s", tc.status, resp.StatusCode, data)
+			}
+		})
+	}
+
+	key := newKey(t, app, `{"name": "dashboard", "scopes": ["batch"]}`)
+	if resp, data := call(t, app, fiber.MethodGet, "/admin/keys", "", map[string]string{apiKeyHeader: key}); resp.StatusCode != fiber.StatusForbidden {
+		t.Errorf("expected a key without the admin scope to be refused but got %d %s", resp.StatusCode, data)
+	}
+	call(t, app, fiber.MethodGet, "/api/stats/errors", "", map[string]string{apiKeyHeader: key})
+
+	resp, data := call(t, app, fiber.MethodGet, "/admin/keys", "", admin)
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected the keys to be listed but got %d %s", resp.StatusCode, data)
+	}
+	var keys []api.APIKeyInfo
+	decode(t, data, &keys)
+	var listed *api.APIKeyInfo
+	for i := range keys {
+		if keys[i].Prefix == key[:len(keys[i].Prefix)] {
+			listed = &keys[i]
+		}
+	}
+	if listed == nil || listed.Name != "dashboard" || listed.UsedToday != 1 || listed.Hash != "" {
+		t.Fatalf("expected the key to be listed with its request of today, without its hash, but got %+v", listed)
+	}
+	id := strconv.Itoa(int(listed.ID))
+
+	resp, data = call(t, app, fiber.MethodGet, "/admin/keys/"+id+"/usage?days=7", "", admin)
+	var usages []model.APIKeyUsage
+	if resp.StatusCode == fiber.StatusOK {
+		decode(t, data, &usages)
+	}
+	if len(usages) != 1 || usages[0].Requests != 1 || usages[0].Rejected != 1 {
+		t.Errorf("expected 1 request and 1 rejected today but got %d %s", resp.StatusCode, data)
+	}
+	for path, status := range map[string]int{
+		"/admin/keys/" + id + "/usage?days=0":   fiber.StatusBadRequest,
+		"/admin/keys/" + id + "/usage?days=all": fiber.StatusBadRequest,
+		"/admin/keys/999999/usage":              fiber.StatusNotFound,
+		"/admin/keys/key/usage":                 fiber.StatusBadRequest,
+	} {
+		if resp, data := call(t, app, fiber.MethodGet, path, "", admin); resp.StatusCode != status {
+			t.Errorf("%s: expected %d but got %d %s", path, status, resp.StatusCode, data)
+		}
+	}
+
+	if resp, data := call(t, app, fiber.MethodDelete, "/admin/keys/"+id, "", admin); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected the key to be revoked but got %d %s", resp.StatusCode, data)
+	}
+	if resp, data := call(t, app, fiber.MethodGet, "/api/stats/errors", "", map[string]string{apiKeyHeader: key}); resp.StatusCode != fiber.StatusUnauthorized {
+		t.Errorf("expected the revoked key to be refused but got %d %s", resp.StatusCode, data)
+	}
+	if resp, data := call(t, app, fiber.MethodDelete, "/admin/keys/999999", "", admin); resp.StatusCode != fiber.StatusNotFound {
+		t.Errorf("expected an unknown key not to be revoked but got %d %s", resp.StatusCode, data)
+	}
+}
@@ -0,0 +1,87 @@
+package controller
+
+import (
+	"log/slog"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// apiKeyHeader carries the API key of a request, which can also be given as
+// a bearer token in the Authorization header.
+const apiKeyHeader = "X-API-Key"
+
+// quotaRemainingHeader reports the requests left in the daily quota of the key.
+const quotaRemainingHeader = "X-Quota-Remaining"
+
+var authRejections = promauto.With(api.MetricsRegistry).NewCounterVec(prometheus.CounterOpts{
+	Name: "brgeo_auth_rejections_total",
+	Help: "Requests refused by the API key check, by reason: unauthenticated, forbidden, rate_limited or quota_exceeded.",
+}, []string{"reason"})
+
+// requireScope returns the middleware refusing the requests made without an
+// API key granted the scope, or beyond the rate limit or daily quota of the key.
+// It lets every request through when authentication is not enabled.
+func requireScope(scope string) fiber.Handler {
+	if !api.Settings().Auth.Enabled {
+		return func(c *fiber.Ctx) error { return c.Next() }
+	}
+
+	return func(c *fiber.Ctx) error {
+		ctx := c.UserContext()
+		access, err := api.Authorize(ctx, requestAPIKey(c), scope)
+		if access.Key.DailyQuota > 0 && access.Remaining >= 0 {
+			c.Set(quotaRemainingHeader, strconv.FormatInt(access.Remaining, 10))
+		}
+		if access.Key.Name != "" {
+			trace.SpanFromContext(ctx).SetAttributes(
+				attribute.Int("api_key.id", int(access.Key.ID)),
+				attribute.String("api_key.name", access.Key.Name),
+			)
+		}
+
+		switch {
+		case err == nil:
+			return c.Next()
+		case errors.Is(err, api.ErrUnauthenticated):
+			authRejections.WithLabelValues("unauthenticated").Inc()
+			c.Set(fiber.HeaderWWWAuthenticate, `Bearer realm="brgeo"`)
+			return c.Status(fiber.StatusUnauthorized).JSON(errorBody(c, err.Error()))
+		case errors.Is(err, api.ErrForbidden):
+			authRejections.WithLabelValues("forbidden").Inc()
+			return c.Status(fiber.StatusForbidden).JSON(errorBody(c, err.Error()+" "+scope))
+		case errors.Is(err, api.ErrRateLimited), errors.Is(err, api.ErrQuotaExceeded):
+			reason := "rate_limited"
+			if errors.Is(err, api.ErrQuotaExceeded) {
+				reason = "quota_exceeded"
+			}
+			authRejections.WithLabelValues(reason).Inc()
+			c.Set(fiber.HeaderRetryAfter, strconv.Itoa(int(math.Ceil(access.RetryAfter.Seconds()))))
+			return c.Status(fiber.StatusTooManyRequests).JSON(errorBody(c, err.Error()))
+		default:
+			slog.ErrorContext(ctx, "Error checking api key", "error", err)
+			return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "api key check failed"))
+		}
+	}
+}
+
+// requestAPIKey returns the API key given in the X-API-Key header or as a
+// bearer token, or "" when there is none.
+func requestAPIKey(c *fiber.Ctx) string {
+	if key := c.Get(apiKeyHeader); key != "" {
+		return key
+	}
+	scheme, token, found := strings.Cut(c.Get(fiber.HeaderAuthorization), " ")
+	if found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
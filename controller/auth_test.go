@@ -0,0 +1,89 @@
+package controller
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// newKey creates a key through the admin endpoint and returns it.
+func newKey(t *testing.T, app *fiber.App, body string) string {
+	t.Helper()
+	resp, data := call(t, app, fiber.MethodPost, "/admin/keys", body, map[string]string{fiber.HeaderAuthorization: "Bearer " + adminKey})
+	if resp.StatusCode != fiber.StatusCreated {
+		t.Fatalf("expected the key to be created but got %d %s", resp.StatusCode, data)
+	}
+	var created struct {
+		Key string `json:"key"`
+	}
+	decode(t, data, &created)
+	return created.Key
+}
+
+func TestRequireScope(t *testing.T) {
+
+	app := newApp()
+	key := newKey(t, app, `{"name": "reports", "scopes": ["batch"], "rate_limit": 3, "daily_quota": 100}`)
+
+	testCases := []struct {
+		name      string
+		path      string
+		headers   map[string]string
+		status    int
+		remaining string
+	}{
+		{name: "no key", path: "/api/stats/errors", status: fiber.StatusUnauthorized},
+		{name: "unknown key", path: "/api/stats/errors", headers: map[string]string{apiKeyHeader: "brgeo_unknown"}, status: fiber.StatusUnauthorized},
+		{name: "api key header", path: "/api/stats/errors", headers: map[string]string{apiKeyHeader: key}, status: fiber.StatusOK, remaining: "99"},
+		{name: "bearer token", path: "/api/stats/errors", headers: map[string]string{fiber.HeaderAuthorization: "bearer " + key}, status: fiber.StatusOK, remaining: "98"},
+		{name: "other scheme", path: "/api/stats/errors", headers: map[string]string{fiber.HeaderAuthorization: "Basic " + key}, status: fiber.StatusUnauthorized},
+		{name: "wrong scope", path: "/cache/stats", headers: map[string]string{apiKeyHeader: key}, status: fiber.StatusForbidden},
+		{name: "admin key", path: "/cache/stats", headers: map[string]string{apiKeyHeader: adminKey}, status: fiber.StatusOK},
+	}
+
+	// The cases run in order, each request using up the limits of the key
+	for _, tc := range testCases {
+		resp, data := call(t, app, fiber.MethodGet, tc.path, "", tc.headers)
+		if resp.StatusCode != tc.status {
+			t.Errorf("%s: expected %d but got %d %s", tc.name, tc.status, resp.StatusCode, data)
+		}
+		if got := resp.Header.Get(quotaRemainingHeader); got != tc.remaining {
+			t.Errorf("%s: expected %q requests remaining but got %q", tc.name, tc.remaining, got)
+		}
+		if tc.status == fiber.StatusUnauthorized && resp.Header.Get(fiber.HeaderWWWAuthenticate) == "" {
+			t.Errorf("%s: expected the authentication scheme to be given", tc.name)
+		}
+	}
+
+	// The refused scope did not use a request of the rate limit, the next one does
+	if resp, data := call(t, app, fiber.MethodGet, "/api/stats/errors", "", map[string]string{apiKeyHeader: key}); resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected the third request to be allowed but got %d %s", resp.StatusCode, data)
+	}
+	resp, data := call(t, app, fiber.MethodGet, "/api/stats/errors", "", map[string]string{apiKeyHeader: key})
+	if resp.StatusCode != fiber.StatusTooManyRequests {
+		t.Fatalf("expected the rate limit to be exceeded but got %d %s", resp.StatusCode, data)
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get(fiber.HeaderRetryAfter)); err != nil || seconds < 1 || seconds > 20 {
+		t.Errorf("expected to retry within 20 seconds but got %q", resp.Header.Get(fiber.HeaderRetryAfter))
+	}
+}
+
+func TestRequireScopeDailyQuota(t *testing.T) {
+
+	app := newApp()
+	key := newKey(t, app, `{"name": "trial", "scopes": ["batch"], "rate_limit": 0, "daily_quota": 1}`)
+	headers := map[string]string{apiKeyHeader: key}
+
+	resp, data := call(t, app, fiber.MethodGet, "/api/stats/errors", "", headers)
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(quotaRemainingHeader) != "0" {
+		t.Fatalf("expected the last request of the quota to be allowed but got %d %s", resp.StatusCode, data)
+	}
+	resp, data = call(t, app, fiber.MethodGet, "/api/stats/errors", "", headers)
+	if resp.StatusCode != fiber.StatusTooManyRequests || resp.Header.Get(quotaRemainingHeader) != "0" {
+		t.Fatalf("expected the quota to be exceeded but got %d %s", resp.StatusCode, data)
+	}
+	if seconds, err := strconv.Atoi(resp.Header.Get(fiber.HeaderRetryAfter)); err != nil || seconds < 1 || seconds > 24*60*60 {
+		t.Errorf("expected to retry by midnight but got %q", resp.Header.Get(fiber.HeaderRetryAfter))
+	}
+}
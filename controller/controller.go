@@ -1,57 +1,315 @@
 package controller
 
 import (
+	"context"
 	"log/slog"
-	"os"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
 	"github.com/jinzhu/copier"
+	"github.com/jvanrhyn/brgeo/config"
 	"github.com/jvanrhyn/brgeo/internal/api"
 	"github.com/jvanrhyn/brgeo/model"
 	slogfiber "github.com/samber/slog-fiber"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func StartAndServe() {
+// background tracks the work started by requests that outlives them, such as
+// the refresh of stale cache entries, so that shutdown can wait for it.
+var background sync.WaitGroup
+
+// work is the parent context of the requests and of the background work they
+// start. It is cancelled once the shutdown timeout has passed, so that the
+// upstream lookups still in flight stop instead of waiting out their retries.
+var work = context.Background()
+
+// StartAndServe serves the API on the configured port until ctx is done, then
+// shuts the server down gracefully: it stops accepting connections and waits up
+// to the ShutdownTimeout for the requests in flight and the background cache
+// refreshes they started, then cancels their upstream lookups. It returns the
+// error when the server cannot listen.
+func StartAndServe(ctx context.Context, cfg config.ServerConfig) error {
 
 	logger := slog.Default()
-	port := os.Getenv("PORT")
+	port := strconv.Itoa(cfg.Port)
+
+	slog.Info("Starting server on port", "port", port)
+	app := fiber.New(fiber.Config{DisableStartupMessage: true, ErrorHandler: handleError})
 
-	go slog.Info("Starting server on port", "port", port)
-	app := fiber.New()
+	app.Use(instrument)
 
+	// Probes and metrics are registered ahead of the request logger, so they are not logged
+	probes(app)
+
+	var stopWork context.CancelFunc
+	work, stopWork = context.WithCancel(context.Background())
+	defer stopWork()
+	app.Use(func(c *fiber.Ctx) error {
+		c.SetUserContext(work)
+		return c.Next()
+	})
+	app.Use(correlate)
+	app.Use(traceRequest)
 	app.Use(slogfiber.New(logger))
 
-	group := app.Group("/api")
-	cacheGroup := app.Group("/cache")
+	if !api.Settings().Auth.Enabled {
+		slog.Warn("API keys are not required, set AUTH_ENABLED to require them")
+	}
+	routes(app)
 
-	group.Get("/lookup/:ipaddress", getGeoInfo)
-	cacheGroup.Post("/clear", clearCache)
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- app.Listen(":" + port)
+	}()
 
-	err := app.Listen(":" + port)
-	if err != nil {
-		go slog.Error("Error starting server", "error", err)
+	select {
+	case err := <-listenErr:
+		return errors.New(err)
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down server", "timeout", cfg.ShutdownTimeout)
+	drain, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	context.AfterFunc(drain, stopWork)
+
+	if err := app.ShutdownWithContext(drain); err != nil {
+		slog.Error("Requests still in flight after the shutdown timeout", "error", err)
 	}
+
+	refreshed := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(refreshed)
+	}()
+	select {
+	case <-refreshed:
+	case <-drain.Done():
+		slog.Warn("Background cache refreshes still running after the shutdown timeout")
+	}
+
+	slog.Info("Server stopped")
+	return nil
+}
+
+// probes registers the metrics and the health endpoints. The details of the
+// dependencies on /status, errors included, need the admin scope.
+func probes(app *fiber.App) {
+	app.Get("/metrics", metrics)
+	app.Get("/healthz", healthz)
+	app.Get("/readyz", readyz)
+	app.Get("/status", requireScope(api.ScopeAdmin), status)
 }
 
+// routes registers the endpoints of the API, each behind the API key check of
+// its scope.
+func routes(app *fiber.App) {
+	lookup := requireScope(api.ScopeLookup)
+	batch := requireScope(api.ScopeBatch)
+
+	group := app.Group("/api")
+	cacheGroup := app.Group("/cache", requireScope(api.ScopeAdmin))
+	adminGroup := app.Group("/admin", requireScope(api.ScopeAdmin))
+
+	group.Get("/lookup/:ipaddress", lookup, getGeoInfo)
+	group.Get("/history", batch, getHistory)
+	group.Get("/history/export", batch, exportHistory)
+	group.Get("/stats/top/:dimension", batch, topStats)
+	group.Get("/stats/volume", batch, volumeStats)
+	group.Get("/stats/cache", batch, cacheHitStats)
+	group.Get("/stats/errors", batch, errorStats)
+	cacheGroup.Post("/clear", clearCache)
+	cacheGroup.Get("/stats", cacheStats)
+	cacheGroup.Get("/item/:key", cacheItem)
+	cacheGroup.Get("/export", exportCache)
+	cacheGroup.Post("/import", importCache)
+	cacheGroup.Post("/snapshot", saveSnapshot)
+	adminGroup.Delete("/lookups/:ipaddress", eraseIpAddress)
+	adminGroup.Get("/retention", retentionStats)
+	adminGroup.Post("/config/reload", reloadConfig)
+	adminGroup.Post("/keys", createAPIKey)
+	adminGroup.Get("/keys", listAPIKeys)
+	adminGroup.Delete("/keys/:id", revokeAPIKey)
+	adminGroup.Get("/keys/:id/usage", apiKeyUsage)
+}
+
+// cacheStatusHeader reports whether a lookup was served fresh from the cache (HIT),
+// served from the cache past its soft TTL while being refreshed (STALE),
+// answered from a cached failed or empty lookup (NEGATIVE),
+// or fetched from the upstream service (MISS).
+const cacheStatusHeader = "X-Cache-Status"
+
+// inferredHeader carries the network block a lookup was answered from,
+// when it was served from the cache entry of a neighbouring address.
+const inferredHeader = "X-Geo-Inferred-From"
+
+// tierHeader reports the tier that answered a lookup: the in-memory cache (memory),
+// the geolocation stored by an earlier lookup (database) or the upstream service (provider).
+const tierHeader = "X-Cache-Tier"
+
+// Cache statuses recorded with each lookup. Lookups made outside of a request
+// are recorded as a refresh of a stale entry or as part of the cache warm-up.
+const (
+	statusHit      = "hit"
+	statusStale    = "stale"
+	statusNegative = "negative"
+	statusInferred = "inferred"
+	statusDatabase = "database"
+	statusMiss     = "miss"
+	statusRefresh  = "refresh"
+	statusWarmUp   = "warmup"
+)
+
+// refreshing tracks the ip addresses with a background refresh in flight,
+// so that a burst of stale hits results in a single upstream lookup.
+var refreshing sync.Map
+
 func getGeoInfo(c *fiber.Ctx) error {
-	ipaddress := c.Params("ipaddress")
+	start := time.Now()
+	ctx := c.UserContext()
+
+	// Fiber reuses the request buffers, copy the value before it is
+	// used as a cache key or handed to a background refresh
+	ipaddress := utils.CopyString(c.Params("ipaddress"))
 
 	// Try and find the element in the Cache
-	var cg, err = api.GetCacheById(ipaddress)
+	_, span := tracer.Start(ctx, "cache.lookup")
+	entry, err := api.GetCacheEntry(ctx, ipaddress)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	span.End()
 	if err == nil {
-		go slog.Info("Retrieved item from cache for ip", "ipaddress", ipaddress)
-		err = c.Status(fiber.StatusOK).JSON(cg)
-		if err != nil {
-			stack := err.(*errors.Error).ErrorStack()
-			go slog.Error("error while retrieving item from cache", "error", err, "stacktrace", stack)
-			return err
+		c.Set(tierHeader, string(api.TierMemory))
+		api.CountTier(api.TierMemory)
+		switch {
+		case entry.Negative():
+			slog.InfoContext(ctx, "Retrieved negative item from cache for ip", "ipaddress", ipaddress, "kind", entry.Kind)
+			c.Set(cacheStatusHeader, "NEGATIVE")
+			recordCached(ctx, ipaddress, statusNegative, start, entry.Err())
+			return lookupError(c, entry.Err())
+		case entry.Stale():
+			slog.InfoContext(ctx, "Serving stale item from cache for ip", "ipaddress", ipaddress)
+			c.Set(cacheStatusHeader, "STALE")
+			recordCached(ctx, ipaddress, statusStale, start, nil)
+			refreshInBackground(ctx, ipaddress)
+		default:
+			slog.InfoContext(ctx, "Retrieved item from cache for ip", "ipaddress", ipaddress)
+			c.Set(cacheStatusHeader, "HIT")
+			recordCached(ctx, ipaddress, statusHit, start, nil)
+		}
+		return c.Status(fiber.StatusOK).JSON(entry.Data)
+	}
+
+	// Then try a lookup cached in memory for the same network block
+	if api.PrefixCacheEnabled() {
+		_, span := tracer.Start(ctx, "cache.prefix_lookup")
+		entry, prefix, err := api.GetPrefixCacheEntry(ctx, ipaddress)
+		span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+		span.End()
+		if err == nil {
+			slog.InfoContext(ctx, "Retrieved item from cache for network block", "ipaddress", ipaddress, "prefix", prefix)
+			c.Set(inferredHeader, prefix.String())
+			c.Set(tierHeader, string(api.TierMemory))
+			api.CountTier(api.TierMemory)
+			if entry.Stale() {
+				c.Set(cacheStatusHeader, "STALE")
+				refreshInBackground(ctx, ipaddress)
+			} else {
+				c.Set(cacheStatusHeader, "HIT")
+			}
+			recordCached(ctx, ipaddress, statusInferred, start, nil)
+			return c.Status(fiber.StatusOK).JSON(entry.Data)
 		}
 	}
 
-	geo, retry := api.GetGeoInfo(ipaddress)
-	go slog.Info("Retrieval information", "ipaddress", ipaddress, "retries", retry)
+	// Fall back to the geolocation stored by an earlier lookup
+	if response, err := fromDatabase(ctx, ipaddress); err == nil {
+		slog.InfoContext(ctx, "Retrieved item from database for ip", "ipaddress", ipaddress)
+		c.Set(cacheStatusHeader, "HIT")
+		c.Set(tierHeader, string(api.TierDatabase))
+		api.CountTier(api.TierDatabase)
+		recordCached(ctx, ipaddress, statusDatabase, start, nil)
+		return c.Status(fiber.StatusOK).JSON(response)
+	} else if !errors.Is(err, api.ErrNotFound) {
+		slog.ErrorContext(ctx, "Error reading stored geolocation", "ipaddress", ipaddress, "error", err)
+	}
+
+	c.Set(cacheStatusHeader, "MISS")
+	c.Set(tierHeader, string(api.TierProvider))
+	api.CountTier(api.TierProvider)
+	response, err := lookup(ctx, ipaddress, statusMiss)
+	if err != nil {
+		return lookupError(c, err)
+	}
+
+	return c.Status(fiber.StatusOK).JSON(response)
+}
+
+// fromDatabase answers a lookup from the geolocation stored for the ip address,
+// when it is recent enough, and caches it in memory for the next lookups.
+func fromDatabase(ctx context.Context, ipaddress string) (*model.LookupResponse, error) {
+	_, span := tracer.Start(ctx, "db.lookup", trace.WithSpanKind(trace.SpanKindClient))
+	geo, err := api.GetStoredGeoLocation(ipaddress)
+	span.SetAttributes(attribute.Bool("cache.hit", err == nil))
+	span.End()
+	if err != nil {
+		return nil, err
+	}
+
+	response := model.LookupResponse{}
+	if err := copier.Copy(&response, geo); err != nil {
+		return nil, err
+	}
+
+	if err := api.AddCacheItem(ctx, ipaddress, &response); err != nil {
+		slog.ErrorContext(ctx, "Error adding item to cache", "error", err)
+	}
+	return &response, nil
+}
+
+// lookupError maps a lookup error to its HTTP response: 404 when the upstream
+// service has no data for the address and 502 when the upstream lookup failed.
+func lookupError(c *fiber.Ctx, err error) error {
+	switch {
+	case errors.Is(err, api.ErrNotFound):
+		return c.Status(fiber.StatusNotFound).JSON(errorBody(c, err.Error()))
+	case errors.Is(err, api.ErrUpstream):
+		return c.Status(fiber.StatusBadGateway).JSON(errorBody(c, err.Error()))
+	}
+	return err
+}
+
+// lookup retrieves the geolocation information for the ip address from
+// the upstream service, queues the request for recording and stores the result in the cache.
+// The cacheStatus is recorded with the request to tell why the lookup was made.
+//
+// Failed and empty lookups are cached as negative entries, except that a
+// failure never replaces a positive entry that is still within its hard TTL.
+func lookup(ctx context.Context, ipaddress string, cacheStatus string) (*model.LookupResponse, error) {
+	start := time.Now()
+	geo, retry, err := api.GetGeoInfo(ctx, ipaddress)
+	slog.InfoContext(ctx, "Retrieval information", "ipaddress", ipaddress, "retries", retry)
+
+	req := model.LookupRequest{
+		IpAddress:    ipaddress,
+		LookupTime:   start,
+		LookupStatus: err == nil,
+		Provider:     api.Provider,
+		LatencyMs:    time.Since(start).Milliseconds(),
+		Retries:      retry,
+		CacheStatus:  cacheStatus,
+		ErrorCode:    api.ErrorCode(err),
+	}
+
+	if err != nil {
+		cacheNegative(ctx, ipaddress, err)
+		api.RecordAsync(ctx, &req)
+		return nil, err
+	}
 
 	response := model.LookupResponse{}
 
@@ -59,32 +317,92 @@ func getGeoInfo(c *fiber.Ctx) error {
 	// where structs have the same fields
 	err = copier.Copy(&response, &geo)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
+	req.GeoLocation = api.NewGeoLocation(geo)
+	api.RecordAsync(ctx, &req)
+
+	// Store the item in the cache
+	err = api.AddCacheItem(ctx, ipaddress, &response)
+	if err != nil {
+		attrs := []any{"error", err}
+		var stackErr *errors.Error
+		if errors.As(err, &stackErr) {
+			attrs = append(attrs, "stacktrace", stackErr.ErrorStack())
+		}
+		slog.ErrorContext(ctx, "Error adding item to cache", attrs...)
+	} else {
+		slog.InfoContext(ctx, "Added item to cache for ip", "ipaddress", ipaddress)
+	}
+
+	if api.PrefixCacheEnabled() {
+		err = api.AddPrefixCacheItem(ctx, ipaddress, &response)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error adding item to cache for network block", "ipaddress", ipaddress, "error", err)
+		}
+	}
+
+	return &response, nil
+}
+
+// recordCached records a lookup answered from the cache.
+func recordCached(ctx context.Context, ipaddress string, cacheStatus string, start time.Time, lookupErr error) {
 	req := model.LookupRequest{
 		IpAddress:    ipaddress,
-		LookupTime:   time.Now(),
-		LookupStatus: true,
+		LookupTime:   start,
+		LookupStatus: lookupErr == nil,
+		LatencyMs:    time.Since(start).Milliseconds(),
+		CacheStatus:  cacheStatus,
+		ErrorCode:    api.ErrorCode(lookupErr),
 	}
+	api.RecordAsync(ctx, &req)
+}
 
-	err = api.Record(&req)
-	if err != nil {
-		stack := err.(*errors.Error).ErrorStack()
-		go slog.Error("error while recording lookup", "error", err, "stacktrace", stack)
-		return err
+// cacheNegative stores the outcome of a failed lookup as a negative cache entry.
+func cacheNegative(ctx context.Context, ipaddress string, lookupErr error) {
+	kind := api.EntryFailed
+	if errors.Is(lookupErr, api.ErrNotFound) {
+		kind = api.EntryNotFound
+	} else if entry, err := api.GetCacheEntry(ctx, ipaddress); err == nil && !entry.Negative() {
+		// Keep serving the stale data rather than an error
+		return
 	}
 
-	// Store the item in the cache
-	err = api.AddCacheItem(ipaddress, &response)
+	err := api.AddNegativeCacheItem(ctx, ipaddress, kind)
 	if err != nil {
-		stack := err.(*errors.Error).ErrorStack()
-		go slog.Error("Error adding item to cache", "error", err, "stacktrace", stack)
+		slog.ErrorContext(ctx, "Error adding negative item to cache", "error", err)
 	} else {
-		go slog.Info("Added item to cache for ip", "ipaddress", ipaddress)
+		slog.InfoContext(ctx, "Added negative item to cache for ip", "ipaddress", ipaddress, "kind", kind)
 	}
+}
 
-	return c.Status(fiber.StatusOK).JSON(response)
+// refreshInBackground refreshes a stale cache entry without blocking the caller.
+// Only one refresh per ip address runs at a time; the stale entry keeps being
+// served until the refresh completes or the hard TTL expires.
+//
+// As the refresh outlives the request, it is traced on its own, linked to the
+// span of the request in ctx, and logged with the id of the request.
+func refreshInBackground(ctx context.Context, ipaddress string) {
+	if _, busy := refreshing.LoadOrStore(ipaddress, struct{}{}); busy {
+		return
+	}
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		defer refreshing.Delete(ipaddress)
+
+		ctx, span := tracer.Start(api.WithRequestID(work, api.RequestID(ctx)), "cache.refresh",
+			trace.WithLinks(trace.LinkFromContext(ctx)),
+			trace.WithAttributes(attribute.String("ipaddress", ipaddress)))
+		defer span.End()
+
+		slog.InfoContext(ctx, "Refreshing stale cache item", "ipaddress", ipaddress)
+		if _, err := lookup(ctx, ipaddress, statusRefresh); err != nil {
+			slog.ErrorContext(ctx, "Background refresh failed", "ipaddress", ipaddress, "error", err)
+		}
+	}()
 }
 
 // clearCache clears the cache and logs an info message.
@@ -103,7 +421,23 @@ func getGeoInfo(c *fiber.Ctx) error {
 //	}
 //	c.SendStatus(fiber.StatusOK)
 func clearCache(c *fiber.Ctx) error {
-	go slog.Info("Clearing cache")
+	slog.InfoContext(c.UserContext(), "Clearing cache")
 	api.Cache.Flush()
 	return c.SendStatus(fiber.StatusOK)
 }
+
+// cacheStats returns the number of cached entries by kind, so that positive
+// entries can be told apart from cached failed and empty lookups.
+func cacheStats(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(api.GetCacheStats())
+}
+
+// cacheItem returns the raw cache entry for a key, including its kind and
+// the moment it turns stale. It responds with 404 when the key is not cached.
+func cacheItem(c *fiber.Ctx) error {
+	entry, err := api.GetCacheEntry(c.UserContext(), c.Params("key"))
+	if err != nil {
+		return c.Status(fiber.StatusNotFound).JSON(errorBody(c, err.Error()))
+	}
+	return c.Status(fiber.StatusOK).JSON(entry)
+}
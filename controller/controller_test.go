@@ -0,0 +1,280 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/internal/api"
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+// adminKey is the admin API key of the configuration of the tests.
+const adminKey = "controller-test-admin-key"
+
+func TestMain(m *testing.M) {
+	// Run against an in-memory database, so no Postgres instance is needed
+	_ = os.Setenv("DB_DRIVER", api.DriverSQLite)
+	_ = os.Setenv("CONNECTION", ":memory:")
+	cfg, err := config.Load(nil, os.LookupEnv)
+	if err != nil {
+		slog.Error("Error loading configuration", "error", err)
+		os.Exit(1)
+	}
+	cfg.Auth.Enabled = true
+	cfg.Auth.AdminKey = adminKey
+	api.Configure(cfg)
+
+	if err := api.InitDatabase(cfg.Database); err != nil {
+		slog.Error("Error initializing database", "error", err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+// useSettings applies the changes to the configuration for the duration of the test.
+func useSettings(t *testing.T, change func(c *config.Config)) {
+	t.Helper()
+	previous := api.Settings()
+	cfg := *previous
+	change(&cfg)
+	api.Configure(&cfg)
+	t.Cleanup(func() { api.Configure(previous) })
+}
+
+// newApp returns the API and its probes, without the listener and the
+// middleware that only instrument the requests.
+func newApp() *fiber.App {
+	app := fiber.New(fiber.Config{ErrorHandler: handleError})
+	probes(app)
+	app.Use(correlate)
+	routes(app)
+	return app
+}
+
+// call makes the request to the app with the headers, and returns the
+// response with its body.
+func call(t *testing.T, app *fiber.App, method, path, body string, headers map[string]string) (*http.Response, []byte) {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if body != "" {
+		req.Header.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	}
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, data
+}
+
+// decode unmarshals the body of a response into v.
+func decode(t *testing.T, data []byte, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal(data, v); err != nil {
+		t.Fatalf("expected a JSON body but got %q: %v", data, err)
+	}
+}
+
+// stubProvider answers the lookups in place of the upstream service, with the
+// status and body given, and counts them. When release is set, each lookup
+// waits for it to be closed before it is answered.
+type stubProvider struct {
+	status  int
+	body    string
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (p *stubProvider) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	p.calls.Add(1)
+	if p.release != nil {
+		<-p.release
+	}
+	w.WriteHeader(p.status)
+	_, _ = w.Write([]byte(p.body))
+}
+
+// useProvider makes the lookups against the provider, without retries, for the
+// duration of the test. A failed lookup counts against the health of the
+// provider, shared by the tests, which is reported down after 3 in a row.
+func useProvider(t *testing.T, p *stubProvider) {
+	t.Helper()
+	server := httptest.NewServer(p)
+	t.Cleanup(server.Close)
+	useSettings(t, func(c *config.Config) {
+		c.Provider.ServiceURL = server.URL
+		c.Provider.MaxRetries = 1
+	})
+}
+
+// found is the body of a lookup of the upstream service that found the city.
+func found(city string) string {
+	return `{"status": "success", "data": {"geo": {"country_code": "ZA", "country_name": "South Africa", "city": "` + city + `"}}}`
+}
+
+// cacheStale caches the data for the ip address as past its soft TTL.
+func cacheStale(ipaddress string, data *model.LookupResponse) {
+	api.Cache.Set(ipaddress, &api.CacheEntry{Kind: api.EntryFound, Data: data, StaleAt: time.Now().Add(-time.Minute)}, time.Hour)
+}
+
+// cacheEntry returns the entry cached for the ip address.
+func cacheEntry(t *testing.T, app *fiber.App, ipaddress string) api.CacheEntry {
+	t.Helper()
+	resp, data := call(t, app, fiber.MethodGet, "/cache/item/"+ipaddress, "", map[string]string{apiKeyHeader: adminKey})
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected %s to be cached but got %d %s", ipaddress, resp.StatusCode, data)
+	}
+	var entry api.CacheEntry
+	decode(t, data, &entry)
+	return entry
+}
+
+func TestLookupCachesFailuresAsNegative(t *testing.T) {
+
+	useSettings(t, func(c *config.Config) {
+		c.Cache.NotFoundTimeout = time.Hour
+		c.Cache.FailureTimeout = 5 * time.Minute
+	})
+	app := newApp()
+
+	testCases := map[string]struct {
+		ipaddress string
+		provider  *stubProvider
+		status    int
+		kind      api.EntryKind
+		ttl       time.Duration
+	}{
+		"not found": {ipaddress: "198.51.100.40", provider: &stubProvider{status: http.StatusOK, body: `{"status": "error", "description": "Invalid host"}`},
+			status: fiber.StatusNotFound, kind: api.EntryNotFound, ttl: time.Hour},
+		"upstream error": {ipaddress: "198.51.100.41", provider: &stubProvider{status: http.StatusInternalServerError},
+			status: fiber.StatusBadGateway, kind: api.EntryFailed, ttl: 5 * time.Minute},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			useProvider(t, tc.provider)
+			api.Cache.Delete(tc.ipaddress)
+			headers := map[string]string{apiKeyHeader: adminKey}
+
+			resp, data := call(t, app, fiber.MethodGet, "/api/lookup/"+tc.ipaddress, "", headers)
+			if resp.StatusCode != tc.status || resp.Header.Get(cacheStatusHeader) != "MISS" {
+				t.Fatalf("expected the lookup to miss with %d but got %d %s %s", tc.status, resp.StatusCode, resp.Header.Get(cacheStatusHeader), data)
+			}
+			resp, data = call(t, app, fiber.MethodGet, "/api/lookup/"+tc.ipaddress, "", headers)
+			if resp.StatusCode != tc.status || resp.Header.Get(cacheStatusHeader) != "NEGATIVE" {
+				t.Errorf("expected the failure to be answered from the cache with %d but got %d %s %s", tc.status, resp.StatusCode, resp.Header.Get(cacheStatusHeader), data)
+			}
+			if calls := tc.provider.calls.Load(); calls != 1 {
+				t.Errorf("expected a single lookup of the provider but got %d", calls)
+			}
+
+			entry := cacheEntry(t, app, tc.ipaddress)
+			if ttl := time.Until(entry.StaleAt); entry.Kind != tc.kind || ttl > tc.ttl || ttl < tc.ttl-time.Minute {
+				t.Errorf("expected a %s entry for %s but got %s for %s", tc.kind, tc.ttl, entry.Kind, ttl)
+			}
+		})
+	}
+}
+
+func TestLookupKeepsStaleEntryWhenRefreshFails(t *testing.T) {
+
+	provider := &stubProvider{status: http.StatusInternalServerError}
+	useProvider(t, provider)
+	app := newApp()
+	cacheStale("198.51.100.50", &model.LookupResponse{City: "Stale"})
+
+	resp, data := call(t, app, fiber.MethodGet, "/api/lookup/198.51.100.50", "", map[string]string{apiKeyHeader: adminKey})
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(cacheStatusHeader) != "STALE" {
+		t.Fatalf("expected the stale entry to be served but got %d %s %s", resp.StatusCode, resp.Header.Get(cacheStatusHeader), data)
+	}
+	background.Wait()
+
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("expected the entry to be refreshed once but got %d lookups", calls)
+	}
+	if entry := cacheEntry(t, app, "198.51.100.50"); entry.Kind != api.EntryFound || entry.Data == nil || entry.Data.City != "Stale" {
+		t.Errorf("expected the failed refresh to keep the stale entry but got %+v", entry)
+	}
+}
+
+func TestLookupServesStaleEntryOnceRefreshed(t *testing.T) {
+
+	provider := &stubProvider{status: http.StatusOK, body: found("Fresh"), release: make(chan struct{})}
+	useProvider(t, provider)
+	app := newApp()
+	cacheStale("198.51.100.60", &model.LookupResponse{City: "Stale"})
+
+	// The stale entry keeps being served while its refresh is in flight
+	for i := 0; i < 3; i++ {
+		resp, data := call(t, app, fiber.MethodGet, "/api/lookup/198.51.100.60", "", map[string]string{apiKeyHeader: adminKey})
+		var response model.LookupResponse
+		decode(t, data, &response)
+		if resp.StatusCode != fiber.StatusOK || resp.Header.Get(cacheStatusHeader) != "STALE" || response.City != "Stale" {
+			t.Fatalf("expected the stale entry to be served but got %d %s %s", resp.StatusCode, resp.Header.Get(cacheStatusHeader), data)
+		}
+	}
+	close(provider.release)
+	background.Wait()
+
+	if calls := provider.calls.Load(); calls != 1 {
+		t.Errorf("expected a single refresh for the stale hits but got %d lookups", calls)
+	}
+	resp, data := call(t, app, fiber.MethodGet, "/api/lookup/198.51.100.60", "", map[string]string{apiKeyHeader: adminKey})
+	var response model.LookupResponse
+	decode(t, data, &response)
+	if resp.Header.Get(cacheStatusHeader) != "HIT" || response.City != "Fresh" {
+		t.Errorf("expected the refreshed entry to be served but got %s %s", resp.Header.Get(cacheStatusHeader), data)
+	}
+}
+
+func TestLookupPrefersPrefixCacheOverDatabase(t *testing.T) {
+
+	useSettings(t, func(c *config.Config) {
+		c.Cache.PrefixMode = true
+	})
+	app := newApp()
+	ctx := context.Background()
+
+	// Both the network block in memory and the geolocation stored for the address could answer
+	stored := &model.LookupRequest{IpAddress: "203.0.113.20", LookupTime: time.Now(), LookupStatus: true,
+		GeoLocation: &model.GeoLocation{City: "Stored"}}
+	if err := api.Record(stored); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.AddPrefixCacheItem(ctx, "203.0.113.9", &model.LookupResponse{City: "Block"}); err != nil {
+		t.Fatal(err)
+	}
+
+	resp, data := call(t, app, fiber.MethodGet, "/api/lookup/203.0.113.20", "", map[string]string{apiKeyHeader: adminKey})
+	if resp.StatusCode != fiber.StatusOK {
+		t.Fatalf("expected the lookup to be answered but got %d %s", resp.StatusCode, data)
+	}
+	if tier, block := resp.Header.Get(tierHeader), resp.Header.Get(inferredHeader); tier != string(api.TierMemory) || block != "203.0.113.0/24" {
+		t.Errorf("expected the network block in memory to answer but got the %s tier and block %q", tier, block)
+	}
+	var response model.LookupResponse
+	decode(t, data, &response)
+	if response.City != "Block" {
+		t.Errorf("expected the data of the network block but got %+v", response)
+	}
+}
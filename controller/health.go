@@ -0,0 +1,42 @@
+package controller
+
+import (
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// startedAt is when the process started, reported by /status.
+var startedAt = time.Now()
+
+// healthz responds as long as the process is able to serve requests.
+func healthz(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"status": "alive"})
+}
+
+// readyz responds with 200 when the dependencies needed to answer lookups are
+// healthy and with 503 when one of them is down, so the instance is taken out
+// of rotation until it recovers. The errors of the dependencies, which can
+// name hosts and users, are left to /status.
+func readyz(c *fiber.Ctx) error {
+	report := api.CheckHealth(c.UserContext())
+	for i := range report.Dependencies {
+		report.Dependencies[i].LastError = ""
+	}
+	if !report.Ready {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(report)
+	}
+	return c.Status(fiber.StatusOK).JSON(report)
+}
+
+// status responds with the state, latency and last error of every dependency.
+func status(c *fiber.Ctx) error {
+	report := api.CheckHealth(c.UserContext())
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{
+		"ready":          report.Ready,
+		"started_at":     startedAt,
+		"uptime_seconds": int64(time.Since(startedAt).Seconds()),
+		"dependencies":   report.Dependencies,
+	})
+}
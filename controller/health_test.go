@@ -0,0 +1,44 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+func TestHealthEndpoints(t *testing.T) {
+
+	app := newApp()
+
+	testCases := map[string]struct {
+		path    string
+		headers map[string]string
+		noCache bool
+		status  int
+	}{
+		"liveness":             {path: "/healthz", status: fiber.StatusOK},
+		"readiness":            {path: "/readyz", status: fiber.StatusOK},
+		"readiness failing":    {path: "/readyz", noCache: true, status: fiber.StatusServiceUnavailable},
+		"status without a key": {path: "/status", status: fiber.StatusUnauthorized},
+		"status":               {path: "/status", headers: map[string]string{apiKeyHeader: adminKey}, status: fiber.StatusOK},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if tc.noCache {
+				cache := api.Cache
+				api.Cache = nil
+				defer func() { api.Cache = cache }()
+			}
+			resp, data := call(t, app, fiber.MethodGet, tc.path, "", tc.headers)
+			if resp.StatusCode != tc.status {
+				t.Errorf("expected %d but got %d %s", tc.status, resp.StatusCode, data)
+			}
+			if tc.path == "/readyz" && strings.Contains(string(data), `"last_error"`) {
+				t.Errorf("expected the errors of the dependencies to be left out but got %s", data)
+			}
+		})
+	}
+}
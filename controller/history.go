@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"bufio"
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// getHistory responds with a page of recorded lookups, filtered by the
+// query string as described by api.ParseHistoryFilter.
+func getHistory(c *fiber.Ctx) error {
+	filter, err := api.ParseHistoryFilter(func(key string) string {
+		return c.Query(key)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+
+	page, err := api.QueryHistory(filter)
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Error querying lookup history", "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "history query failed"))
+	}
+	return c.Status(fiber.StatusOK).JSON(page)
+}
+
+// exportHistory streams the recorded lookups matching the query string as a
+// csv, ndjson or parquet file, chosen by the format parameter (default csv).
+func exportHistory(c *fiber.Ctx) error {
+	format, err := api.ParseExportFormat(c.Query("format", string(api.ExportCSV)))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+
+	// The filter is used after the handler returns, when Fiber
+	// has reused the request buffers, so its values are copied
+	filter, err := api.ParseHistoryFilter(func(key string) string {
+		return utils.CopyString(c.Query(key))
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+
+	c.Set(fiber.HeaderContentType, format.ContentType())
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="history.`+string(format)+`"`)
+	ctx := c.UserContext()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		count, err := api.ExportHistory(w, format, filter)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error exporting lookup history", "format", format, "error", err)
+		}
+		if err := w.Flush(); err != nil {
+			slog.ErrorContext(ctx, "Error exporting lookup history", "format", format, "error", err)
+		}
+		slog.InfoContext(ctx, "Exported lookup history", "format", format, "lookups", count)
+	})
+	return nil
+}
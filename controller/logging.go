@@ -0,0 +1,49 @@
+package controller
+
+import (
+	"regexp"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/utils"
+	"github.com/google/uuid"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// validRequestID limits the ids accepted from callers to short tokens that are
+// safe to log and to send upstream.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:/+=-]{1,128}$`)
+
+// correlate gives each request an id, carried by its user context, that the
+// log lines written while handling it include as their request_id. The id sent
+// by the caller in the X-Request-ID header is kept when it is valid, otherwise
+// one is generated; either way it is returned in the X-Request-ID header.
+func correlate(c *fiber.Ctx) error {
+	id := c.Get(api.RequestIDHeader)
+	if validRequestID.MatchString(id) {
+		// Fiber reuses the request buffers, the id outlives the request in
+		// background refreshes and recorded log lines
+		id = utils.CopyString(id)
+	} else {
+		id = uuid.NewString()
+	}
+
+	c.Set(api.RequestIDHeader, id)
+	c.SetUserContext(api.WithRequestID(c.UserContext(), id))
+	return c.Next()
+}
+
+// errorBody returns the body of an error response, with the id of the request
+// so that a failure reported by a client can be found in the logs.
+func errorBody(c *fiber.Ctx, message string) fiber.Map {
+	body := fiber.Map{"error": message}
+	if id := api.RequestID(c.UserContext()); id != "" {
+		body["request_id"] = id
+	}
+	return body
+}
+
+// handleError responds to the errors returned by the handlers, including the
+// routes that are not found, with a JSON error body.
+func handleError(c *fiber.Ctx, err error) error {
+	return c.Status(responseStatus(c, err)).JSON(errorBody(c, err.Error()))
+}
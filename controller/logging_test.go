@@ -0,0 +1,85 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+// logBuffer collects the log lines written while handling requests.
+type logBuffer struct {
+	mu  sync.Mutex
+	out bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.out.Write(p)
+}
+
+func (b *logBuffer) lines(t *testing.T) []map[string]any {
+	t.Helper()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var lines []map[string]any
+	for _, raw := range strings.Split(strings.TrimSpace(b.out.String()), "\n") {
+		if raw == "" {
+			continue
+		}
+		var line map[string]any
+		if err := json.Unmarshal([]byte(raw), &line); err != nil {
+			t.Fatalf("expected a JSON log line but got %q", raw)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// captureLogs writes the logs to the returned buffer, through api.LogHandler,
+// for the duration of the test.
+func captureLogs(t *testing.T) *logBuffer {
+	t.Helper()
+	logs := &logBuffer{}
+	previous := slog.Default()
+	slog.SetDefault(slog.New(api.LogHandler(slog.NewJSONHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return logs
+}
+
+func TestLookupLogsCarryRequestID(t *testing.T) {
+
+	app := newApp()
+	if err := api.AddCacheItem(context.Background(), "198.51.100.7", &model.LookupResponse{City: "Durban"}); err != nil {
+		t.Fatal(err)
+	}
+	logs := captureLogs(t)
+
+	resp, data := call(t, app, fiber.MethodGet, "/api/lookup/198.51.100.7", "", map[string]string{
+		apiKeyHeader:        adminKey,
+		api.RequestIDHeader: "lookup-logs-1",
+	})
+	if resp.StatusCode != fiber.StatusOK || resp.Header.Get(cacheStatusHeader) != "HIT" {
+		t.Fatalf("expected a cache hit but got %d %s", resp.StatusCode, data)
+	}
+
+	lines := logs.lines(t)
+	messages := map[string]bool{}
+	for _, line := range lines {
+		messages[line["msg"].(string)] = true
+		if line["request_id"] != "lookup-logs-1" {
+			t.Errorf("expected the request id in every log line but got %v", line)
+		}
+	}
+	if !messages["Retrieving item from cache"] || !messages["Retrieved item from cache for ip"] {
+		t.Errorf("expected the cache lookup to be logged but got %v", lines)
+	}
+}
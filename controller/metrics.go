@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/gofiber/fiber/v2/middleware/adaptor"
+	"github.com/jvanrhyn/brgeo/internal/api"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	httpRequests = promauto.With(api.MetricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "brgeo_http_requests_total",
+		Help: "HTTP requests served, by route, method and status.",
+	}, []string{"route", "method", "status"})
+
+	httpDuration = promauto.With(api.MetricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "brgeo_http_request_duration_seconds",
+		Help:    "Duration of the HTTP requests served, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+
+	cacheResults = promauto.With(api.MetricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "brgeo_cache_results_total",
+		Help: "Lookups served, by cache status: hit, stale, negative or miss.",
+	}, []string{"status"})
+)
+
+// metrics is the handler serving the metrics in the Prometheus text format.
+var metrics = adaptor.HTTPHandler(promhttp.HandlerFor(api.MetricsRegistry, promhttp.HandlerOpts{}))
+
+// instrument counts the requests and measures their duration by route, method and
+// status, and counts the lookups by the cache status they were served with.
+func instrument(c *fiber.Ctx) error {
+	start := time.Now()
+	err := c.Next()
+
+	status := responseStatus(c, err)
+	labels := prometheus.Labels{
+		"route":  c.Route().Path,
+		"method": c.Method(),
+		"status": strconv.Itoa(status),
+	}
+	httpRequests.With(labels).Inc()
+	httpDuration.With(labels).Observe(time.Since(start).Seconds())
+
+	if cacheStatus := c.GetRespHeader(cacheStatusHeader); cacheStatus != "" {
+		cacheResults.WithLabelValues(strings.ToLower(cacheStatus)).Inc()
+	}
+	return err
+}
+
+// responseStatus returns the status of the response to a request handled with
+// err, as the error handler of the app will send it.
+func responseStatus(c *fiber.Ctx, err error) int {
+	if err == nil {
+		return c.Response().StatusCode()
+	}
+	var fiberErr *fiber.Error
+	if errors.As(err, &fiberErr) {
+		return fiberErr.Code
+	}
+	return fiber.StatusInternalServerError
+}
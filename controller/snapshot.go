@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// warmUpInterval spaces the upstream lookups made while warming the cache,
+// keeping them within the rate limit of 3 calls per second of the service.
+const warmUpInterval = 400 * time.Millisecond
+
+// WarmCache preloads the cache before the server starts accepting requests.
+//
+// When the SnapshotFile of the cache names an existing snapshot, it is imported first.
+// When WarmupTop is set, the most frequently looked up addresses recorded in the
+// database that are not cached yet are then looked up in the background, until
+// ctx is done.
+func WarmCache(ctx context.Context, cfg config.CacheConfig) {
+	if path := cfg.SnapshotFile; path != "" {
+		if _, err := os.Stat(path); err == nil {
+			if _, err := api.LoadCacheSnapshot(path); err != nil {
+				slog.Error("Error loading cache snapshot", "path", path, "error", err)
+			}
+		}
+	}
+
+	top := cfg.WarmupTop
+	if top <= 0 {
+		return
+	}
+
+	addresses, err := api.TopLookedUpAddresses(top)
+	if err != nil {
+		slog.Error("Error reading most frequent lookups", "error", err)
+		return
+	}
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+
+		warmed := 0
+	warmUp:
+		for _, ipaddress := range addresses {
+			if _, err := api.GetCacheEntry(ctx, ipaddress); err == nil {
+				continue
+			}
+			if _, err := lookup(ctx, ipaddress, statusWarmUp); err == nil {
+				warmed++
+			}
+			select {
+			case <-ctx.Done():
+				break warmUp
+			case <-time.After(warmUpInterval):
+			}
+		}
+		slog.Info("Warmed cache from most frequent lookups", "candidates", len(addresses), "warmed", warmed)
+	}()
+}
+
+// exportCache streams the cache as JSON lines, one entry with its expiry per line.
+func exportCache(c *fiber.Ctx) error {
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Set(fiber.HeaderContentDisposition, `attachment; filename="cache.jsonl"`)
+	ctx := c.UserContext()
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		count, err := api.ExportCache(w)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error exporting cache", "error", err)
+		}
+		if err := w.Flush(); err != nil {
+			slog.ErrorContext(ctx, "Error exporting cache", "error", err)
+		}
+		slog.InfoContext(ctx, "Exported cache", "entries", count)
+	})
+	return nil
+}
+
+// importCache loads the JSON lines in the request body into the cache and
+// responds with the number of entries imported, skipped and invalid.
+func importCache(c *fiber.Ctx) error {
+	result, err := api.ImportCache(c.UserContext(), bytes.NewReader(c.Body()))
+	if err != nil {
+		body := errorBody(c, err.Error())
+		body["imported"] = result.Imported
+		body["skipped"] = result.Skipped
+		body["invalid"] = result.Invalid
+		return c.Status(fiber.StatusBadRequest).JSON(body)
+	}
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// saveSnapshot writes the cache to the configured snapshot file, so that the
+// next start can be warmed from it.
+func saveSnapshot(c *fiber.Ctx) error {
+	path := api.Settings().Cache.SnapshotFile
+	if path == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, "no cache snapshot file is configured"))
+	}
+
+	count, err := api.SaveCacheSnapshot(path)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, err.Error()))
+	}
+	return c.Status(fiber.StatusOK).JSON(fiber.Map{"saved": count, "path": path})
+}
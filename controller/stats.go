@@ -0,0 +1,68 @@
+package controller
+
+import (
+	"log/slog"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+)
+
+// statsFilter parses the window of a statistics request from its query string.
+func statsFilter(c *fiber.Ctx) (api.StatsFilter, error) {
+	return api.ParseStatsFilter(func(key string) string {
+		return c.Query(key)
+	})
+}
+
+// statsResponse responds with the result of a statistics query.
+func statsResponse(c *fiber.Ctx, result interface{}, err error) error {
+	if err != nil {
+		slog.ErrorContext(c.UserContext(), "Error computing lookup statistics", "path", c.Path(), "error", err)
+		return c.Status(fiber.StatusInternalServerError).JSON(errorBody(c, "statistics query failed"))
+	}
+	return c.Status(fiber.StatusOK).JSON(result)
+}
+
+// topStats responds with the most looked up countries, cities or isps.
+func topStats(c *fiber.Ctx) error {
+	dimension := c.Params("dimension")
+	if !api.IsTopDimension(dimension) {
+		return c.Status(fiber.StatusNotFound).JSON(errorBody(c, "dimension must be countries, cities or isps"))
+	}
+	filter, err := statsFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+	result, err := api.TopLookups(dimension, filter)
+	return statsResponse(c, result, err)
+}
+
+// volumeStats responds with the number of lookups per hour or day.
+func volumeStats(c *fiber.Ctx) error {
+	filter, err := statsFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+	result, err := api.LookupVolume(filter)
+	return statsResponse(c, result, err)
+}
+
+// cacheHitStats responds with the cache hit ratio per hour or day.
+func cacheHitStats(c *fiber.Ctx) error {
+	filter, err := statsFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+	result, err := api.CacheHitRatio(filter)
+	return statsResponse(c, result, err)
+}
+
+// errorStats responds with the error rate of each upstream provider.
+func errorStats(c *fiber.Ctx) error {
+	filter, err := statsFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(errorBody(c, err.Error()))
+	}
+	result, err := api.ProviderErrorRates(filter)
+	return statsResponse(c, result, err)
+}
@@ -0,0 +1,53 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/jvanrhyn/brgeo/internal/api"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer starts the spans of the requests and of the cache lookups.
+var tracer = otel.Tracer("github.com/jvanrhyn/brgeo/controller")
+
+// traceRequest starts the span of a request, continuing the trace of the caller
+// when the request carries a W3C traceparent header. The span is handed to the
+// handlers with the user context of the request and named after the route once
+// it is known.
+func traceRequest(c *fiber.Ctx) error {
+	ctx := otel.GetTextMapPropagator().Extract(c.UserContext(), propagation.HeaderCarrier(http.Header(c.GetReqHeaders())))
+	ctx, span := tracer.Start(ctx, c.Method(), trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("http.request.method", c.Method()),
+		attribute.String("url.path", c.Path()),
+		attribute.String("request_id", api.RequestID(ctx)),
+	))
+	defer span.End()
+	c.SetUserContext(ctx)
+
+	err := c.Next()
+
+	status := responseStatus(c, err)
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.SetName(c.Method() + " " + c.Route().Path)
+	span.SetAttributes(
+		attribute.String("http.route", c.Route().Path),
+		attribute.Int("http.response.status_code", status),
+	)
+	if cacheStatus := c.GetRespHeader(cacheStatusHeader); cacheStatus != "" {
+		span.SetAttributes(attribute.String("cache.status", cacheStatus))
+	}
+	if tier := c.GetRespHeader(tierHeader); tier != "" {
+		span.SetAttributes(attribute.String("cache.tier", tier))
+	}
+	if status >= fiber.StatusInternalServerError {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	return err
+}
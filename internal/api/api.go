@@ -1,85 +1,175 @@
+// Package api implements the geolocation lookups of brgeo, their cache and the
+// history of lookups recorded in the database.
 package api
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
-	"os"
-	"strconv"
 	"time"
 
+	"github.com/go-errors/errors"
 	"github.com/jvanrhyn/brgeo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+var (
+	// ErrNotFound is returned when the upstream service has no
+	// geolocation data for the ip address.
+	ErrNotFound = errors.Errorf("no geolocation data found")
+
+	// ErrUpstream is returned when the upstream service could not
+	// be reached or answered with an error after all retries.
+	ErrUpstream = errors.Errorf("upstream lookup failed")
+)
+
+// Provider names the upstream service lookups are made against, as recorded with each lookup.
+const Provider = "keycdn"
+
+// ErrorCode returns the short code recorded for a failed lookup.
+func ErrorCode(err error) string {
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, ErrNotFound):
+		return "not_found"
+	case errors.Is(err, ErrUpstream):
+		return "upstream_error"
+	}
+	return "internal_error"
+}
+
 // GetGeoInfo accepts an IP Address to perform a lookup
 // of the geolocation information of the IP Address
 // form KeyCDNs' Geo service.
 // This service is rate limited to a maximum of 3 calls per second.
-func GetGeoInfo(ipaddress string) (model.GeoData, int) {
+//
+// It returns ErrNotFound when the service has no data for the address,
+// and ErrUpstream when the service could not be queried. The outcome is
+// tracked for the health of the provider, see CheckHealth.
+//
+// The lookup is traced as a span of ctx, with a span for each attempt
+// and for each backoff before a retry. It stops, without waiting for the
+// retries left, once ctx is done.
+func GetGeoInfo(ctx context.Context, ipaddress string) (model.GeoData, int, error) {
+	ctx, span := tracer.Start(ctx, "provider.lookup", trace.WithAttributes(
+		attribute.String("provider", Provider),
+		attribute.String("ipaddress", ipaddress),
+	))
 
+	start := time.Now()
+	geo, retry, err := fetchGeoInfo(ctx, ipaddress)
+	providerHealth.record(time.Since(start), providerError(err))
+	observeProviderCall(time.Since(start), retry, err)
+
+	span.SetAttributes(attribute.Int("provider.retries", retry))
+	if err != nil {
+		span.SetAttributes(attribute.String("error.code", ErrorCode(err)))
+	}
+	endSpan(span, providerError(err))
+	return geo, retry, err
+}
+
+// fetchGeoInfo makes the lookup of GetGeoInfo, retrying with a backoff.
+func fetchGeoInfo(ctx context.Context, ipaddress string) (model.GeoData, int, error) {
+
+	provider := Settings().Provider
 	client := &http.Client{}
-	path := os.Getenv("SERVICE_URL") + "?host=" + ipaddress
-	req, err := http.NewRequest("GET", path, nil)
+	path := provider.ServiceURL + "?host=" + ipaddress
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, path, nil)
 	if err != nil {
-		panic(err)
+		return model.GeoData{}, 0, errors.New(fmt.Errorf("%w: %v", ErrUpstream, err))
 	}
 
 	// Setting the User-Agent header
-	req.Header.Set("User-Agent", os.Getenv("USER_AGENT"))
+	req.Header.Set("User-Agent", provider.UserAgent)
+
+	// Tie the attempts to the request they are made for in the logs of both sides
+	if id := RequestID(ctx); id != "" {
+		req.Header.Set(RequestIDHeader, id)
+	}
 
 	// Define a re-usable response object needed to
 	// the retry pattern implemented
 	var resp *http.Response
 
 	// Setup for a backoff retry pattern
-	maxRetries, _ := strconv.Atoi(os.Getenv("MAX_RETRIES"))
-	if maxRetries < 3 {
-		maxRetries = 3
-	}
+	maxRetries := provider.MaxRetries
 
-	slog.Info("Max retries", "retries", maxRetries)
+	slog.InfoContext(ctx, "Max retries", "retries", maxRetries)
 
 	baseInterval := 500 * time.Millisecond
 	retryFactor := 2.0
 	retry := 0
 
 	for i := 0; i < maxRetries; i++ {
-		slog.Info("Attempts Counter", "attempt", i)
+		slog.InfoContext(ctx, "Attempts Counter", "attempt", i)
+		_, attempt := tracer.Start(ctx, "provider.attempt", trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.Int("provider.attempt", i+1)))
 		resp, err = client.Do(req)
+		if err == nil {
+			attempt.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+		}
 		if err == nil && resp.StatusCode == http.StatusOK {
-			err := resp.Body.Close()
-			if err != nil {
-				return model.GeoData{}, 0
-			}
+			attempt.End()
 			break
 		}
+		if err == nil {
+			err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+			_ = resp.Body.Close()
+		}
+		endSpan(attempt, err)
 
 		// If this wasn't the last attempt, sleep for a while before retrying
 		if i < maxRetries-1 {
 			sleepDuration := time.Duration(float64(baseInterval) * float64(i+1) * retryFactor)
-			retry = i
-			slog.Info("Sleeping on error", "duration", sleepDuration, "error", err)
-			time.Sleep(sleepDuration)
+			retry = i + 1
+			slog.InfoContext(ctx, "Sleeping on error", "duration", sleepDuration, "error", err)
+			providerBackoff.WithLabelValues(Provider).Observe(sleepDuration.Seconds())
+			_, backoff := tracer.Start(ctx, "provider.backoff",
+				trace.WithAttributes(attribute.Int64("provider.backoff_ms", sleepDuration.Milliseconds())))
+			timer := time.NewTimer(sleepDuration)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				// The request was cancelled or the server is shutting down
+				timer.Stop()
+				endSpan(backoff, ctx.Err())
+				return model.GeoData{}, retry, errors.New(fmt.Errorf("%w: %v", ErrUpstream, ctx.Err()))
+			}
+			backoff.End()
 			continue
 		} else {
-			// If this was the last attempt, handle the error (e.g., by panicking)
-			panic(err)
+			// If this was the last attempt, give up and report the failure
+			slog.ErrorContext(ctx, "Lookup failed after retries", "ipaddress", ipaddress, "error", err)
+			return model.GeoData{}, retry, errors.New(fmt.Errorf("%w: %v", ErrUpstream, err))
 		}
 	}
 
-	if resp != nil {
-		body, err := io.ReadAll(resp.Body)
-		if err != nil {
-			slog.Error(err.Error())
-		}
-		var geoResponse model.Response
-		err = json.Unmarshal(body, &geoResponse)
-		if err != nil {
-			slog.Error(err.Error())
+	defer func() {
+		if err := resp.Body.Close(); err != nil {
+			slog.ErrorContext(ctx, "Error closing provider response", "error", err)
 		}
+	}()
 
-		return geoResponse.Data.Geo, retry
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return model.GeoData{}, retry, errors.New(fmt.Errorf("%w: %v", ErrUpstream, err))
+	}
+	var geoResponse model.Response
+	err = json.Unmarshal(body, &geoResponse)
+	if err != nil {
+		return model.GeoData{}, retry, errors.New(fmt.Errorf("%w: %v", ErrUpstream, err))
 	}
-	return model.GeoData{}, 0
+
+	geo := geoResponse.Data.Geo
+	if geoResponse.Status != "success" || (geo.CountryCode == "" && geo.CountryName == "") {
+		return model.GeoData{}, retry, ErrNotFound
+	}
+
+	return geo, retry, nil
 }
@@ -1,10 +1,17 @@
 package api
 
 import (
+	"context"
+	"github.com/go-errors/errors"
 	"github.com/joho/godotenv"
+	"github.com/jvanrhyn/brgeo/config"
 	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
@@ -13,15 +20,42 @@ func TestMain(m *testing.M) {
 		slog.Error("Error loading .env file")
 	}
 
+	// Run against an in-memory database, so no Postgres instance is needed
+	_ = os.Setenv("DB_DRIVER", DriverSQLite)
+	_ = os.Setenv("CONNECTION", ":memory:")
+	cfg, err := config.Load(nil, os.LookupEnv)
+	if err != nil {
+		slog.Error("Error loading configuration", "error", err)
+		os.Exit(1)
+	}
+	Configure(cfg)
+
+	err = InitDatabase(cfg.Database)
+	if err != nil {
+		slog.Error("Error initializing database", "error", err)
+		os.Exit(1)
+	}
+
+	os.Exit(m.Run())
+}
+
+// useSettings applies the changes to the configuration for the duration of the test.
+func useSettings(t *testing.T, change func(c *config.Config)) {
+	t.Helper()
+	previous := Settings()
+	cfg := *previous
+	change(&cfg)
+	Configure(&cfg)
+	t.Cleanup(func() { Configure(previous) })
 }
 
 func TestCanGetLocation(t *testing.T) {
 
 	t.Parallel()
 
-	_ = os.Setenv("USER_AGENT", "keycdn-tools:https://www.b.co.za")
-	_ = os.Setenv("SERVICE_URL", "https://tools.keycdn.com/geo.json")
-	_ = os.Setenv("MAX_RETRIES", "3")
+	if _, err := net.LookupHost("tools.keycdn.com"); err != nil {
+		t.Skip("KeyCDN is not reachable:", err)
+	}
 
 	testCases := map[string]struct {
 		value string
@@ -38,7 +72,10 @@ func TestCanGetLocation(t *testing.T) {
 
 		t.Run(n, func(t *testing.T) {
 			t.Parallel()
-			got, retry := GetGeoInfo(tc.value)
+			got, retry, err := GetGeoInfo(context.Background(), tc.value)
+			if err != nil {
+				t.Fatalf("lookup failed: %v", err)
+			}
 			slog.Info("Found ", "Country", got.CountryCode, "retries", retry)
 			if got.CountryCode == "" {
 				t.Error("expected city name to be populated")
@@ -47,3 +84,61 @@ func TestCanGetLocation(t *testing.T) {
 		})
 	}
 }
+
+func TestLookupWithoutDataIsNotFound(t *testing.T) {
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"status":"error","description":"Invalid host"}`))
+	}))
+	defer server.Close()
+
+	useSettings(t, func(c *config.Config) { c.Provider.ServiceURL = server.URL })
+
+	_, _, err := GetGeoInfo(context.Background(), "0.0.0.0")
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound but got %v", err)
+	}
+}
+
+func TestLookupCarriesRequestID(t *testing.T) {
+
+	var received string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r.Header.Get(RequestIDHeader)
+		_, _ = w.Write([]byte(`{"status":"error","description":"Invalid host"}`))
+	}))
+	defer server.Close()
+
+	useSettings(t, func(c *config.Config) { c.Provider.ServiceURL = server.URL })
+
+	_, _, _ = GetGeoInfo(WithRequestID(context.Background(), "req-42"), "0.0.0.0")
+	if received != "req-42" {
+		t.Errorf("expected the request id to be sent upstream but got %q", received)
+	}
+}
+
+func TestLookupStopsWhenCancelled(t *testing.T) {
+
+	resetProviderHealth(t)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	// The backoffs between the 5 attempts add up to 10 seconds
+	useSettings(t, func(c *config.Config) {
+		c.Provider.ServiceURL = server.URL
+		c.Provider.MaxRetries = 5
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := GetGeoInfo(ctx, "41.160.113.136")
+	if !errors.Is(err, ErrUpstream) {
+		t.Errorf("expected ErrUpstream but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the lookup to stop once cancelled but it took %s", elapsed)
+	}
+}
@@ -0,0 +1,653 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Scopes granted to API keys. A key is accepted by the endpoints of its
+// scopes: lookup for the lookups, batch for the history, its export and the
+// statistics, and admin for the cache and the administration endpoints.
+const (
+	ScopeLookup = "lookup"
+	ScopeBatch  = "batch"
+	ScopeAdmin  = "admin"
+)
+
+// scopes lists every scope, in the order they are shown.
+var scopes = []string{ScopeLookup, ScopeBatch, ScopeAdmin}
+
+const (
+	// apiKeyPrefix starts every key, so that a leaked key is easy to recognize.
+	apiKeyPrefix = "brgeo_"
+	// keyCacheTTL bounds how long a key read from the database is trusted,
+	// so that a key revoked on another instance stops working there too.
+	keyCacheTTL = time.Minute
+	// unknownKeyTTL is how long a key not found in the database is refused
+	// without reading it again, so that requests with made up keys do not
+	// each cost a query. A created key is never unknown: its hash is new.
+	unknownKeyTTL = 30 * time.Second
+	// maxUnknownKeys bounds the unknown keys remembered.
+	maxUnknownKeys = 10000
+	// usageFlushInterval is the interval between the writes of the usage counters.
+	usageFlushInterval = 10 * time.Second
+	// maxUsageDays bounds the days of usage returned for a key.
+	maxUsageDays = 366
+)
+
+var (
+	// ErrUnauthenticated is returned for a request without a key, or with an
+	// unknown or revoked one.
+	ErrUnauthenticated = errors.Errorf("missing or invalid api key")
+	// ErrForbidden is returned for a key not granted the scope of the endpoint.
+	ErrForbidden = errors.Errorf("api key not granted the scope")
+	// ErrRateLimited is returned for a key making more requests a minute than its rate limit.
+	ErrRateLimited = errors.Errorf("api key rate limit exceeded")
+	// ErrQuotaExceeded is returned for a key that used up its daily quota.
+	ErrQuotaExceeded = errors.Errorf("api key daily quota exceeded")
+	// ErrUnknownAPIKey is returned when the key to revoke does not exist.
+	ErrUnknownAPIKey = errors.Errorf("no such api key")
+	// ErrInvalidUsageDays is returned for usage asked over too few or too many days.
+	ErrInvalidUsageDays = errors.Errorf("days must be between 1 and %d", maxUsageDays)
+	// ErrNoKeyStore is returned when keys are created without a database to store them.
+	ErrNoKeyStore = errors.Errorf("api keys are stored in the database, which is disabled")
+)
+
+// adminKey is the key the admin API key of the configuration authenticates as.
+var adminKey = model.APIKey{Name: "admin", Scopes: strings.Join(scopes, ",")}
+
+// NewAPIKey describes a key to create. Limits left out are the defaults of the
+// configuration; a zero limit does not limit.
+type NewAPIKey struct {
+	Name       string   `json:"name"`
+	Scopes     []string `json:"scopes"`
+	RateLimit  *int     `json:"rate_limit"`
+	DailyQuota *int64   `json:"daily_quota"`
+}
+
+// Validate reports the first invalid field of the description.
+func (n NewAPIKey) Validate() error {
+	if strings.TrimSpace(n.Name) == "" || len(n.Name) > 100 {
+		return errors.Errorf("name must be set and at most 100 characters long")
+	}
+	if len(n.Scopes) == 0 {
+		return errors.Errorf("scopes must list at least one of %v", scopes)
+	}
+	for _, scope := range n.Scopes {
+		if !isScope(scope) {
+			return errors.Errorf("scope %q must be one of %v", scope, scopes)
+		}
+	}
+	if n.RateLimit != nil && *n.RateLimit < 0 {
+		return errors.Errorf("rate limit %d must not be negative", *n.RateLimit)
+	}
+	if n.DailyQuota != nil && *n.DailyQuota < 0 {
+		return errors.Errorf("daily quota %d must not be negative", *n.DailyQuota)
+	}
+	return nil
+}
+
+// APIKeyInfo is a stored key with its scopes as a list and the requests made
+// with it today, counted against its daily quota.
+type APIKeyInfo struct {
+	model.APIKey
+	// Scopes shadows the comma separated scopes of the stored key.
+	Scopes    []string `json:"scopes"`
+	UsedToday int64    `json:"used_today"`
+}
+
+// Access is the outcome of the authorization of a request.
+type Access struct {
+	// Key is the key the request was made with.
+	Key model.APIKey
+	// Remaining is the number of requests left in the daily quota, or -1
+	// for a key without quota.
+	Remaining int64
+	// RetryAfter is how long to wait before the next request, when the
+	// request was rate limited or the quota is used up.
+	RetryAfter time.Duration
+}
+
+// keyState is a key read from the database, with its rate limit bucket and
+// the requests made with it that are not written yet.
+type keyState struct {
+	mu       sync.Mutex
+	key      model.APIKey
+	loadedAt time.Time
+
+	// tokens is the number of requests the key can make right away, refilled
+	// at the rate limit.
+	tokens   float64
+	refilled time.Time
+
+	// used counts the requests of the day, in UTC, toward the daily quota.
+	day      time.Time
+	used     int64
+	lastUsed time.Time
+	pending  map[time.Time]*model.APIKeyUsage
+	// inflight holds the counters being written by flushKeyUsage, until the
+	// write is committed.
+	inflight map[time.Time]*model.APIKeyUsage
+}
+
+// apiKeys holds the keys authenticated since the start, by the hash of the
+// key, and the time the unknown keys were last looked up.
+var apiKeys = struct {
+	mu      sync.Mutex
+	byHash  map[string]*keyState
+	unknown map[string]time.Time
+}{byHash: map[string]*keyState{}, unknown: map[string]time.Time{}}
+
+// usageFlush keeps the usage counters from being written twice at a time.
+var usageFlush sync.Mutex
+
+// CreateAPIKey stores a new key and returns it with its record. The key is
+// not stored, only its hash: it cannot be shown again.
+func CreateAPIKey(ctx context.Context, n NewAPIKey) (string, APIKeyInfo, error) {
+	if err := n.Validate(); err != nil {
+		return "", APIKeyInfo{}, err
+	}
+	if db == nil {
+		return "", APIKeyInfo{}, ErrNoKeyStore
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", APIKeyInfo{}, errors.New(err)
+	}
+	raw := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+
+	defaults := Settings().Auth
+	key := model.APIKey{
+		Name:       strings.TrimSpace(n.Name),
+		Prefix:     raw[:len(apiKeyPrefix)+6],
+		Hash:       hashAPIKey(raw),
+		Scopes:     strings.Join(sortScopes(n.Scopes), ","),
+		RateLimit:  defaults.RateLimit,
+		DailyQuota: defaults.DailyQuota,
+		CreatedAt:  time.Now(),
+	}
+	if n.RateLimit != nil {
+		key.RateLimit = *n.RateLimit
+	}
+	if n.DailyQuota != nil {
+		key.DailyQuota = *n.DailyQuota
+	}
+	if err := db.WithContext(ctx).Create(&key).Error; err != nil {
+		return "", APIKeyInfo{}, errors.New(err)
+	}
+
+	slog.InfoContext(ctx, "Created api key", "id", key.ID, "name", key.Name, "prefix", key.Prefix, "scopes", key.Scopes)
+	return raw, newAPIKeyInfo(key, 0), nil
+}
+
+// ListAPIKeys returns every key, revoked ones included, with its usage of the day.
+func ListAPIKeys(ctx context.Context) ([]APIKeyInfo, error) {
+	infos := []APIKeyInfo{}
+	if db == nil {
+		return infos, nil
+	}
+	if err := flushKeyUsage(); err != nil {
+		return nil, err
+	}
+
+	var keys []model.APIKey
+	if err := db.WithContext(ctx).Order("id").Find(&keys).Error; err != nil {
+		return nil, errors.New(err)
+	}
+	var usages []model.APIKeyUsage
+	if err := db.WithContext(ctx).Where("day = ?", usageDay(time.Now())).Find(&usages).Error; err != nil {
+		return nil, errors.New(err)
+	}
+	usedToday := make(map[uint]int64, len(usages))
+	for _, u := range usages {
+		usedToday[u.APIKeyID] = u.Requests
+	}
+
+	for _, key := range keys {
+		infos = append(infos, newAPIKeyInfo(key, usedToday[key.ID]))
+	}
+	return infos, nil
+}
+
+// RevokeAPIKey revokes the key with the id, which is refused from then on,
+// and returns it. Revoking a revoked key leaves it as it is.
+func RevokeAPIKey(ctx context.Context, id uint) (APIKeyInfo, error) {
+	if db == nil {
+		return APIKeyInfo{}, ErrUnknownAPIKey
+	}
+
+	var key model.APIKey
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Take(&key, id).Error; err != nil {
+			return err
+		}
+		if key.RevokedAt != nil {
+			return nil
+		}
+		now := time.Now()
+		key.RevokedAt = &now
+		return tx.Model(&key).Update("revoked_at", now).Error
+	})
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return APIKeyInfo{}, ErrUnknownAPIKey
+	}
+	if err != nil {
+		return APIKeyInfo{}, errors.New(err)
+	}
+
+	apiKeys.mu.Lock()
+	defer apiKeys.mu.Unlock()
+	if state := apiKeys.byHash[key.Hash]; state != nil {
+		state.mu.Lock()
+		state.key.RevokedAt = key.RevokedAt
+		state.mu.Unlock()
+	}
+
+	slog.InfoContext(ctx, "Revoked api key", "id", key.ID, "name", key.Name, "prefix", key.Prefix)
+	return newAPIKeyInfo(key, 0), nil
+}
+
+// GetAPIKeyUsage returns the usage of the key with the id over the last days,
+// oldest first. Days without requests are left out.
+func GetAPIKeyUsage(ctx context.Context, id uint, days int) ([]model.APIKeyUsage, error) {
+	usages := []model.APIKeyUsage{}
+	if db == nil {
+		return usages, nil
+	}
+	if days <= 0 || days > maxUsageDays {
+		return nil, ErrInvalidUsageDays
+	}
+	if err := flushKeyUsage(); err != nil {
+		return nil, err
+	}
+
+	var key model.APIKey
+	if err := db.WithContext(ctx).Take(&key, id).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrUnknownAPIKey
+	} else if err != nil {
+		return nil, errors.New(err)
+	}
+
+	since := usageDay(time.Now()).AddDate(0, 0, 1-days)
+	err := db.WithContext(ctx).
+		Where("api_key_id = ? AND day >= ?", id, since).
+		Order("day").
+		Find(&usages).Error
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	return usages, nil
+}
+
+// Authorize checks that the key given with a request is valid, is granted the
+// scope and is within its rate limit and daily quota, and counts the request.
+//
+// The admin key of the configuration is granted every scope, without limits.
+// The others are read from the database and kept for keyCacheTTL. The limits
+// are enforced by each instance, the daily quota against the requests written
+// by all of them.
+func Authorize(ctx context.Context, raw, scope string) (Access, error) {
+	if raw == "" {
+		return Access{}, ErrUnauthenticated
+	}
+	if admin := Settings().Auth.AdminKey; admin != "" && subtle.ConstantTimeCompare([]byte(raw), []byte(admin)) == 1 {
+		return Access{Key: adminKey, Remaining: -1}, nil
+	}
+
+	state, err := loadAPIKey(ctx, hashAPIKey(raw))
+	if err != nil {
+		return Access{}, err
+	}
+	return state.authorize(scope, time.Now())
+}
+
+// loadAPIKey returns the state of the key with the hash, read from the
+// database when it was not read within keyCacheTTL.
+func loadAPIKey(ctx context.Context, hash string) (*keyState, error) {
+	now := time.Now()
+	apiKeys.mu.Lock()
+	state := apiKeys.byHash[hash]
+	lookedUp, unknown := apiKeys.unknown[hash]
+	apiKeys.mu.Unlock()
+	if state != nil && now.Sub(state.loaded()) < keyCacheTTL {
+		return state, nil
+	}
+	if db == nil || (unknown && now.Sub(lookedUp) < unknownKeyTTL) {
+		return nil, ErrUnauthenticated
+	}
+
+	var key model.APIKey
+	err := db.WithContext(ctx).Where("hash = ?", hash).Take(&key).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		rememberUnknownKey(hash, now)
+		return nil, ErrUnauthenticated
+	}
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	// The requests written by every instance count toward the quota of the day
+	day := usageDay(now)
+	var stored model.APIKeyUsage
+	err = db.WithContext(ctx).Where("api_key_id = ? AND day = ?", key.ID, day).Limit(1).Find(&stored).Error
+	if err != nil {
+		return nil, errors.New(err)
+	}
+
+	apiKeys.mu.Lock()
+	if state = apiKeys.byHash[hash]; state == nil {
+		state = &keyState{}
+		apiKeys.byHash[hash] = state
+	}
+	apiKeys.mu.Unlock()
+
+	state.mu.Lock()
+	defer state.mu.Unlock()
+	used := stored.Requests
+	for _, usage := range []map[time.Time]*model.APIKeyUsage{state.pending, state.inflight} {
+		if usage[day] != nil {
+			used += usage[day].Requests
+		}
+	}
+	// A write committed after the usage was read is no longer in flight, and
+	// is not in the usage read either: the count of the day never goes back.
+	if state.day.Equal(day) {
+		used = max(used, state.used)
+	}
+	state.key = key
+	state.loadedAt = now
+	state.day = day
+	state.used = used
+	return state, nil
+}
+
+// rememberUnknownKey records that no key has the hash, forgetting the unknown
+// keys looked up before unknownKeyTTL, or all of them, when there are too many.
+func rememberUnknownKey(hash string, now time.Time) {
+	apiKeys.mu.Lock()
+	defer apiKeys.mu.Unlock()
+	if len(apiKeys.unknown) >= maxUnknownKeys {
+		for h, lookedUp := range apiKeys.unknown {
+			if now.Sub(lookedUp) >= unknownKeyTTL {
+				delete(apiKeys.unknown, h)
+			}
+		}
+		if len(apiKeys.unknown) >= maxUnknownKeys {
+			clear(apiKeys.unknown)
+		}
+	}
+	apiKeys.unknown[hash] = now
+}
+
+func (s *keyState) loaded() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.loadedAt
+}
+
+// authorize applies the scope, the rate limit and the daily quota of the key
+// to a request made at now, and counts it.
+func (s *keyState) authorize(scope string, now time.Time) (Access, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	access := Access{Key: s.key, Remaining: -1}
+	if s.key.RevokedAt != nil {
+		return Access{}, ErrUnauthenticated
+	}
+
+	if day := usageDay(now); !day.Equal(s.day) {
+		s.day = day
+		s.used = 0
+	}
+	usage := s.pendingUsage()
+
+	if !hasScope(s.key.Scopes, scope) {
+		usage.Rejected++
+		return access, ErrForbidden
+	}
+
+	if limit := float64(s.key.RateLimit); limit > 0 {
+		if s.refilled.IsZero() {
+			s.tokens = limit
+		} else {
+			s.tokens = min(limit, s.tokens+now.Sub(s.refilled).Minutes()*limit)
+		}
+		s.refilled = now
+		if s.tokens < 1 {
+			usage.Rejected++
+			access.RetryAfter = time.Duration((1 - s.tokens) / limit * float64(time.Minute))
+			return access, ErrRateLimited
+		}
+	}
+
+	if quota := s.key.DailyQuota; quota > 0 {
+		if s.used >= quota {
+			usage.Rejected++
+			access.Remaining = 0
+			access.RetryAfter = s.day.AddDate(0, 0, 1).Sub(now)
+			return access, ErrQuotaExceeded
+		}
+		access.Remaining = quota - s.used - 1
+	}
+
+	if s.key.RateLimit > 0 {
+		s.tokens--
+	}
+	s.used++
+	s.lastUsed = now
+	usage.Requests++
+	return access, nil
+}
+
+// pendingUsage returns the counters of the day not written yet.
+func (s *keyState) pendingUsage() *model.APIKeyUsage {
+	if s.pending == nil {
+		s.pending = map[time.Time]*model.APIKeyUsage{}
+	}
+	usage := s.pending[s.day]
+	if usage == nil {
+		usage = &model.APIKeyUsage{APIKeyID: s.key.ID, Day: s.day}
+		s.pending[s.day] = usage
+	}
+	return usage
+}
+
+// flushKeyUsage adds the counters not written yet to the usage stored for
+// each key and day, and sets the time the keys were last used. The counters
+// are in flight until the write is committed, and are kept for the next flush
+// when they cannot be written.
+func flushKeyUsage() error {
+	usageFlush.Lock()
+	defer usageFlush.Unlock()
+
+	apiKeys.mu.Lock()
+	states := make([]*keyState, 0, len(apiKeys.byHash))
+	for _, state := range apiKeys.byHash {
+		states = append(states, state)
+	}
+	apiKeys.mu.Unlock()
+
+	var usages []model.APIKeyUsage
+	var owners []*keyState
+	lastUsed := map[uint]time.Time{}
+	for _, state := range states {
+		state.mu.Lock()
+		if len(state.pending) > 0 {
+			for _, usage := range state.pending {
+				usages = append(usages, *usage)
+			}
+			owners = append(owners, state)
+			if !state.lastUsed.IsZero() {
+				lastUsed[state.key.ID] = state.lastUsed
+			}
+			state.inflight, state.pending = state.pending, nil
+		}
+		state.mu.Unlock()
+	}
+	if len(usages) == 0 || db == nil {
+		for _, state := range owners {
+			state.mu.Lock()
+			state.inflight = nil
+			state.mu.Unlock()
+		}
+		return nil
+	}
+
+	err := db.Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns: []clause.Column{{Name: "api_key_id"}, {Name: "day"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{
+				"requests": gorm.Expr("api_key_usages.requests + excluded.requests"),
+				"rejected": gorm.Expr("api_key_usages.rejected + excluded.rejected"),
+			}),
+		}).Create(&usages).Error
+		if err != nil {
+			return err
+		}
+		for id, at := range lastUsed {
+			if err := tx.Model(&model.APIKey{}).Where("id = ?", id).Update("last_used_at", at).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	for _, state := range owners {
+		state.mu.Lock()
+		if err != nil {
+			for day, usage := range state.inflight {
+				if kept := state.pending[day]; kept != nil {
+					kept.Requests += usage.Requests
+					kept.Rejected += usage.Rejected
+				} else {
+					if state.pending == nil {
+						state.pending = map[time.Time]*model.APIKeyUsage{}
+					}
+					state.pending[day] = usage
+				}
+			}
+		}
+		state.inflight = nil
+		state.mu.Unlock()
+	}
+	if err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// usageWriter writes the usage of the keys every usageFlushInterval.
+type usageWriter struct {
+	stop chan struct{}
+	done chan struct{}
+}
+
+// keyUsage is the writer started by StartKeyUsage.
+var keyUsage atomic.Pointer[usageWriter]
+
+// StartKeyUsage starts writing the usage counters of the API keys to the
+// database in the background. Nothing is started when the database is disabled.
+func StartKeyUsage() {
+	if db == nil {
+		return
+	}
+
+	w := &usageWriter{stop: make(chan struct{}), done: make(chan struct{})}
+	if previous := keyUsage.Swap(w); previous != nil {
+		previous.close()
+	}
+	go func() {
+		defer close(w.done)
+		ticker := time.NewTicker(usageFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-w.stop:
+				return
+			case <-ticker.C:
+				if err := flushKeyUsage(); err != nil {
+					slog.Error("Error writing api key usage", "error", err)
+				}
+			}
+		}
+	}()
+}
+
+// StopKeyUsage stops the background writer and writes the usage counters
+// not written yet.
+func StopKeyUsage() error {
+	if w := keyUsage.Swap(nil); w != nil {
+		w.close()
+	}
+	return flushKeyUsage()
+}
+
+func (w *usageWriter) close() {
+	close(w.stop)
+	<-w.done
+}
+
+// hashAPIKey returns the hash a key is stored as. The keys are random and
+// long, a fast hash is enough to keep them from being read from the database.
+func hashAPIKey(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// usageDay returns the day, in UTC, that the usage at t is counted in.
+func usageDay(t time.Time) time.Time {
+	return t.UTC().Truncate(24 * time.Hour)
+}
+
+func isScope(scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// hasScope tells whether the comma separated scopes grant the scope.
+func hasScope(granted, scope string) bool {
+	for _, s := range strings.Split(granted, ",") {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// sortScopes returns the scopes without duplicates, in the order of scopes.
+func sortScopes(granted []string) []string {
+	var sorted []string
+	for _, scope := range scopes {
+		for _, g := range granted {
+			if g == scope {
+				sorted = append(sorted, scope)
+				break
+			}
+		}
+	}
+	return sorted
+}
+
+func newAPIKeyInfo(key model.APIKey, usedToday int64) APIKeyInfo {
+	return APIKeyInfo{APIKey: key, Scopes: strings.Split(key.Scopes, ","), UsedToday: usedToday}
+}
@@ -0,0 +1,249 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/model"
+	"gorm.io/gorm"
+)
+
+// resetAPIKeys removes the stored keys and their usage, and forgets the keys
+// authenticated by earlier tests.
+func resetAPIKeys(t *testing.T) {
+	t.Helper()
+	for _, table := range []interface{}{&model.APIKeyUsage{}, &model.APIKey{}} {
+		if err := db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(table).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	apiKeys.mu.Lock()
+	apiKeys.byHash = map[string]*keyState{}
+	apiKeys.unknown = map[string]time.Time{}
+	apiKeys.mu.Unlock()
+}
+
+func createAPIKey(t *testing.T, n NewAPIKey) (string, APIKeyInfo) {
+	t.Helper()
+	raw, info, err := CreateAPIKey(context.Background(), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return raw, info
+}
+
+func TestNewAPIKeyValidate(t *testing.T) {
+
+	negative := -1
+	testCases := map[string]struct {
+		key   NewAPIKey
+		valid bool
+	}{
+		"valid":          {key: NewAPIKey{Name: "crm", Scopes: []string{ScopeLookup}}, valid: true},
+		"no name":        {key: NewAPIKey{Name: " ", Scopes: []string{ScopeLookup}}},
+		"no scopes":      {key: NewAPIKey{Name: "crm"}},
+		"unknown scope":  {key: NewAPIKey{Name: "crm", Scopes: []string{"root"}}},
+		"negative limit": {key: NewAPIKey{Name: "crm", Scopes: []string{ScopeLookup}, RateLimit: &negative}},
+	}
+
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if err := tc.key.Validate(); (err == nil) != tc.valid {
+				t.Errorf("expected valid to be %t but got %v", tc.valid, err)
+			}
+		})
+	}
+}
+
+func TestAuthorizeAPIKey(t *testing.T) {
+
+	resetAPIKeys(t)
+	ctx := context.Background()
+	raw, info := createAPIKey(t, NewAPIKey{Name: "crm", Scopes: []string{ScopeLookup, ScopeLookup}})
+
+	if info.Hash == raw || info.Prefix != raw[:len(info.Prefix)] || len(info.Scopes) != 1 {
+		t.Errorf("expected the hash, the prefix and the scopes of the key to be stored but got %+v", info)
+	}
+	if info.RateLimit != Settings().Auth.RateLimit || info.DailyQuota != Settings().Auth.DailyQuota {
+		t.Errorf("expected the default limits but got %d and %d", info.RateLimit, info.DailyQuota)
+	}
+
+	if access, err := Authorize(ctx, raw, ScopeLookup); err != nil || access.Key.ID != info.ID {
+		t.Errorf("expected the key to be granted the lookup scope but got %v", err)
+	}
+	if _, err := Authorize(ctx, raw, ScopeAdmin); !errors.Is(err, ErrForbidden) {
+		t.Errorf("expected the key to be refused the admin scope but got %v", err)
+	}
+	for _, key := range []string{"", "brgeo_unknown"} {
+		if _, err := Authorize(ctx, key, ScopeLookup); !errors.Is(err, ErrUnauthenticated) {
+			t.Errorf("expected %q to be unauthenticated but got %v", key, err)
+		}
+	}
+
+	if _, err := RevokeAPIKey(ctx, info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authorize(ctx, raw, ScopeLookup); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expected the revoked key to be refused but got %v", err)
+	}
+	if _, err := RevokeAPIKey(ctx, info.ID+1); !errors.Is(err, ErrUnknownAPIKey) {
+		t.Errorf("expected an unknown key not to be revoked but got %v", err)
+	}
+}
+
+func TestAuthorizeAdminKey(t *testing.T) {
+
+	useSettings(t, func(c *config.Config) {
+		c.Auth.AdminKey = "bootstrap-admin-key"
+	})
+
+	for _, scope := range []string{ScopeLookup, ScopeBatch, ScopeAdmin} {
+		if access, err := Authorize(context.Background(), "bootstrap-admin-key", scope); err != nil || access.Remaining != -1 {
+			t.Errorf("expected the admin key to be granted %s without quota but got %v", scope, err)
+		}
+	}
+}
+
+func TestAPIKeyRateLimit(t *testing.T) {
+
+	state := &keyState{key: model.APIKey{ID: 1, Scopes: ScopeLookup, RateLimit: 2}}
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for i := 0; i < 2; i++ {
+		if _, err := state.authorize(ScopeLookup, now); err != nil {
+			t.Fatalf("expected request %d to be allowed but got %v", i+1, err)
+		}
+	}
+	access, err := state.authorize(ScopeLookup, now)
+	if !errors.Is(err, ErrRateLimited) || access.RetryAfter != 30*time.Second {
+		t.Errorf("expected the third request to wait 30s but got %v after %s", err, access.RetryAfter)
+	}
+	if _, err := state.authorize(ScopeLookup, now.Add(30*time.Second)); err != nil {
+		t.Errorf("expected a request to be allowed once refilled but got %v", err)
+	}
+	if usage := state.pending[usageDay(now)]; usage.Requests != 3 || usage.Rejected != 1 {
+		t.Errorf("expected 3 requests and 1 rejected to be counted but got %+v", usage)
+	}
+}
+
+func TestAPIKeyDailyQuota(t *testing.T) {
+
+	state := &keyState{key: model.APIKey{ID: 1, Scopes: ScopeLookup, DailyQuota: 2}}
+	now := time.Date(2024, 3, 1, 18, 0, 0, 0, time.UTC)
+
+	if access, _ := state.authorize(ScopeLookup, now); access.Remaining != 1 {
+		t.Errorf("expected 1 request to remain but got %d", access.Remaining)
+	}
+	if _, err := state.authorize(ScopeLookup, now); err != nil {
+		t.Fatal(err)
+	}
+	access, err := state.authorize(ScopeLookup, now)
+	if !errors.Is(err, ErrQuotaExceeded) || access.RetryAfter != 6*time.Hour {
+		t.Errorf("expected the quota to be used up until midnight but got %v after %s", err, access.RetryAfter)
+	}
+	if _, err := state.authorize(ScopeLookup, now.Add(6*time.Hour)); err != nil {
+		t.Errorf("expected the quota to start over the next day but got %v", err)
+	}
+}
+
+func TestAPIKeyUsageIsWritten(t *testing.T) {
+
+	resetAPIKeys(t)
+	ctx := context.Background()
+	raw, info := createAPIKey(t, NewAPIKey{Name: "reports", Scopes: []string{ScopeBatch}})
+
+	for i := 0; i < 3; i++ {
+		if _, err := Authorize(ctx, raw, ScopeBatch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := Authorize(ctx, raw, ScopeLookup); !errors.Is(err, ErrForbidden) {
+		t.Fatal(err)
+	}
+
+	usages, err := GetAPIKeyUsage(ctx, info.ID, 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usages) != 1 || usages[0].Requests != 3 || usages[0].Rejected != 1 {
+		t.Errorf("expected 3 requests and 1 rejected today but got %+v", usages)
+	}
+
+	// Counts written again are added to the stored ones
+	if _, err := Authorize(ctx, raw, ScopeBatch); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ListAPIKeys(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].UsedToday != 4 || keys[0].LastUsedAt == nil {
+		t.Errorf("expected the key to be used 4 times today but got %+v", keys)
+	}
+}
+
+func TestUnknownAPIKeyIsRemembered(t *testing.T) {
+
+	resetAPIKeys(t)
+	ctx := context.Background()
+	raw := "brgeo_not_created_yet"
+
+	if _, err := Authorize(ctx, raw, ScopeLookup); !errors.Is(err, ErrUnauthenticated) {
+		t.Fatalf("expected the unknown key to be unauthenticated but got %v", err)
+	}
+
+	// A key stored behind the back of the cache is not read until the unknown key is forgotten
+	key := model.APIKey{Name: "late", Prefix: raw[:12], Hash: hashAPIKey(raw), Scopes: ScopeLookup, CreatedAt: time.Now()}
+	if err := db.Create(&key).Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Authorize(ctx, raw, ScopeLookup); !errors.Is(err, ErrUnauthenticated) {
+		t.Errorf("expected the unknown key not to be read again but got %v", err)
+	}
+
+	apiKeys.mu.Lock()
+	apiKeys.unknown[key.Hash] = time.Now().Add(-unknownKeyTTL)
+	apiKeys.mu.Unlock()
+	if _, err := Authorize(ctx, raw, ScopeLookup); err != nil {
+		t.Errorf("expected the key to be read once the unknown key expired but got %v", err)
+	}
+}
+
+func TestAPIKeyUsageInFlightIsCounted(t *testing.T) {
+
+	resetAPIKeys(t)
+	ctx := context.Background()
+	raw, info := createAPIKey(t, NewAPIKey{Name: "crm", Scopes: []string{ScopeLookup}})
+
+	for i := 0; i < 3; i++ {
+		if _, err := Authorize(ctx, raw, ScopeLookup); err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := loadAPIKey(ctx, info.Hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The counters are being written when the key is read again, with the
+	// count of the day forgotten so that it is only made of what was read
+	state.mu.Lock()
+	state.inflight, state.pending = state.pending, nil
+	state.loadedAt, state.day, state.used = time.Time{}, time.Time{}, 0
+	state.mu.Unlock()
+	if state, err = loadAPIKey(ctx, info.Hash); err != nil || state.used != 3 {
+		t.Fatalf("expected the requests in flight to be counted but got %d, %v", state.used, err)
+	}
+
+	// The write is committed after the stored usage was read
+	state.mu.Lock()
+	state.inflight = nil
+	state.loadedAt = time.Time{}
+	state.mu.Unlock()
+	if state, err = loadAPIKey(ctx, info.Hash); err != nil || state.used != 3 {
+		t.Errorf("expected the requests of the day not to go back but got %d, %v", state.used, err)
+	}
+}
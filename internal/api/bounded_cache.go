@@ -0,0 +1,268 @@
+package api
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// EvictionPolicy selects the entry a BoundedCache evicts when it is full.
+type EvictionPolicy string
+
+const (
+	// EvictLRU evicts the least recently used entry.
+	EvictLRU EvictionPolicy = "lru"
+	// EvictLFU evicts the least frequently used entry,
+	// the least recently used one among equals.
+	EvictLFU EvictionPolicy = "lfu"
+)
+
+// BoundedCacheOptions configures the limits of a BoundedCache.
+// A zero MaxEntries or MaxBytes leaves that dimension unbounded.
+type BoundedCacheOptions struct {
+	MaxEntries int
+	MaxBytes   int64
+	Policy     EvictionPolicy
+}
+
+// BoundedCacheStats holds the size and eviction counters of a BoundedCache.
+type BoundedCacheStats struct {
+	Entries     int    `json:"entries"`
+	Bytes       int64  `json:"bytes"`
+	Evictions   uint64 `json:"evictions"`
+	Expirations uint64 `json:"expirations"`
+}
+
+// BoundedCache is a CacheStore with a maximum number of entries and an
+// approximate maximum size in bytes. When either limit is exceeded,
+// entries are evicted according to the configured EvictionPolicy.
+//
+// Expired entries are removed lazily when they are read or listed.
+type BoundedCache struct {
+	mu      sync.Mutex
+	opts    BoundedCacheOptions
+	items   map[string]*boundedItem
+	order   boundedHeap
+	tick    uint64
+	bytes   int64
+	evicted uint64
+	expired uint64
+}
+
+type boundedItem struct {
+	key        string
+	object     interface{}
+	expiration int64
+	size       int64
+	hits       uint64
+	tick       uint64
+	index      int
+}
+
+// NewBoundedCache creates an empty BoundedCache with the given limits.
+func NewBoundedCache(opts BoundedCacheOptions) *BoundedCache {
+	if opts.Policy != EvictLFU {
+		opts.Policy = EvictLRU
+	}
+	return &BoundedCache{
+		opts:  opts,
+		items: map[string]*boundedItem{},
+		order: boundedHeap{policy: opts.Policy},
+	}
+}
+
+// Get returns the item for the key and whether it was found.
+func (b *BoundedCache) Get(k string) (interface{}, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	item, found := b.items[k]
+	if !found {
+		return nil, false
+	}
+	if item.expired(time.Now().UnixNano()) {
+		b.remove(item)
+		b.expired++
+		return nil, false
+	}
+
+	b.touch(item)
+	return item.object, true
+}
+
+// Set adds or replaces the item for the key, evicting other entries when the
+// cache goes over its limits. A duration of zero or less never expires.
+func (b *BoundedCache) Set(k string, x interface{}, d time.Duration) {
+	var expiration int64
+	if d > 0 {
+		expiration = time.Now().Add(d).UnixNano()
+	}
+	size := estimateSize(k, x)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if item, found := b.items[k]; found {
+		b.bytes += size - item.size
+		item.object, item.expiration, item.size = x, expiration, size
+		b.touch(item)
+	} else {
+		item = &boundedItem{key: k, object: x, expiration: expiration, size: size}
+		b.tick++
+		item.tick = b.tick
+		b.items[k] = item
+		b.bytes += size
+		heap.Push(&b.order, item)
+	}
+
+	b.evict(k)
+}
+
+// Delete removes the item for the key, if present.
+func (b *BoundedCache) Delete(k string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if item, found := b.items[k]; found {
+		b.remove(item)
+	}
+}
+
+// Flush removes all items from the cache. The eviction counters are kept.
+func (b *BoundedCache) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.items = map[string]*boundedItem{}
+	b.order.items = nil
+	b.bytes = 0
+}
+
+// ItemCount returns the number of items in the cache,
+// which may include items that have expired but not yet been removed.
+func (b *BoundedCache) ItemCount() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.items)
+}
+
+// Items returns a copy of all unexpired items in the cache.
+func (b *BoundedCache) Items() map[string]cache.Item {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now().UnixNano()
+	items := make(map[string]cache.Item, len(b.items))
+	for k, item := range b.items {
+		if item.expired(now) {
+			b.remove(item)
+			b.expired++
+			continue
+		}
+		items[k] = cache.Item{Object: item.object, Expiration: item.expiration}
+	}
+	return items
+}
+
+// Stats returns the current size and the eviction counters of the cache.
+func (b *BoundedCache) Stats() BoundedCacheStats {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return BoundedCacheStats{
+		Entries:     len(b.items),
+		Bytes:       b.bytes,
+		Evictions:   b.evicted,
+		Expirations: b.expired,
+	}
+}
+
+// evict removes entries until the cache is within its limits.
+// The entry for keep, which was just written, is never evicted; under LFU it
+// would otherwise be the first candidate as it has not been read yet.
+func (b *BoundedCache) evict(keep string) {
+	for b.over() && len(b.items) > 1 {
+		victim := b.order.items[0]
+		if victim.key == keep {
+			// The next candidate is the smaller of the children of the root
+			victim = b.order.items[1]
+			if len(b.order.items) > 2 && b.order.Less(2, 1) {
+				victim = b.order.items[2]
+			}
+		}
+		b.remove(victim)
+		b.evicted++
+	}
+}
+
+func (b *BoundedCache) over() bool {
+	return (b.opts.MaxEntries > 0 && len(b.items) > b.opts.MaxEntries) ||
+		(b.opts.MaxBytes > 0 && b.bytes > b.opts.MaxBytes)
+}
+
+func (b *BoundedCache) touch(item *boundedItem) {
+	b.tick++
+	item.tick = b.tick
+	item.hits++
+	heap.Fix(&b.order, item.index)
+}
+
+func (b *BoundedCache) remove(item *boundedItem) {
+	heap.Remove(&b.order, item.index)
+	delete(b.items, item.key)
+	b.bytes -= item.size
+}
+
+func (i *boundedItem) expired(now int64) bool {
+	return i.expiration > 0 && now > i.expiration
+}
+
+// boundedHeap orders the items so that the next one to evict is at the root.
+type boundedHeap struct {
+	policy EvictionPolicy
+	items  []*boundedItem
+}
+
+func (h boundedHeap) Len() int { return len(h.items) }
+
+func (h boundedHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	if h.policy == EvictLFU && a.hits != b.hits {
+		return a.hits < b.hits
+	}
+	return a.tick < b.tick
+}
+
+func (h boundedHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *boundedHeap) Push(x interface{}) {
+	item := x.(*boundedItem)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *boundedHeap) Pop() interface{} {
+	old := h.items
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.items = old[:len(old)-1]
+	return item
+}
+
+// estimateSize approximates the memory held by a cache item in bytes.
+// It only needs to be accurate enough to keep the cache near its limit.
+func estimateSize(k string, x interface{}) int64 {
+	const overhead = 96
+	size := int64(overhead + len(k))
+	if entry, ok := x.(*CacheEntry); ok && entry.Data != nil {
+		size += int64(48 + len(entry.Data.City) + len(entry.Data.RegionName) + len(entry.Data.CountryName))
+	}
+	return size
+}
@@ -0,0 +1,108 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestBoundedCacheEvictsLeastRecentlyUsed(t *testing.T) {
+
+	b := NewBoundedCache(BoundedCacheOptions{MaxEntries: 2, Policy: EvictLRU})
+
+	b.Set("1", "one", time.Minute)
+	b.Set("2", "two", time.Minute)
+	b.Get("1")
+	b.Set("3", "three", time.Minute)
+
+	if _, found := b.Get("2"); found {
+		t.Error("2 should have been evicted")
+	}
+	if _, found := b.Get("1"); !found {
+		t.Error("1 should still be cached")
+	}
+	if b.ItemCount() != 2 {
+		t.Errorf("Cache item count should be 2 but was %d", b.ItemCount())
+	}
+	if b.Stats().Evictions != 1 {
+		t.Errorf("Evictions should be 1 but was %d", b.Stats().Evictions)
+	}
+}
+
+func TestBoundedCacheEvictsLeastFrequentlyUsed(t *testing.T) {
+
+	b := NewBoundedCache(BoundedCacheOptions{MaxEntries: 2, Policy: EvictLFU})
+
+	b.Set("1", "one", time.Minute)
+	b.Set("2", "two", time.Minute)
+	b.Get("1")
+	b.Get("1")
+	b.Get("2")
+	b.Set("3", "three", time.Minute)
+
+	if _, found := b.Get("2"); found {
+		t.Error("2 should have been evicted")
+	}
+	if _, found := b.Get("3"); !found {
+		t.Error("the entry just written should not be evicted")
+	}
+}
+
+func TestBoundedCacheMaxBytes(t *testing.T) {
+
+	entry := &CacheEntry{Kind: EntryFound, Data: &model.LookupResponse{City: "Cape Town"}}
+	size := estimateSize("1", entry)
+	b := NewBoundedCache(BoundedCacheOptions{MaxBytes: 3 * size})
+
+	for _, k := range []string{"1", "2", "3", "4", "5"} {
+		b.Set(k, entry, time.Minute)
+	}
+
+	stats := b.Stats()
+	if stats.Entries != 3 || stats.Bytes > 3*size {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+	if stats.Evictions != 2 {
+		t.Errorf("Evictions should be 2 but was %d", stats.Evictions)
+	}
+}
+
+func TestBoundedCacheExpiry(t *testing.T) {
+
+	b := NewBoundedCache(BoundedCacheOptions{MaxEntries: 10})
+
+	b.Set("1", "one", time.Nanosecond)
+	b.Set("2", "two", time.Minute)
+	time.Sleep(time.Millisecond)
+
+	if _, found := b.Get("1"); found {
+		t.Error("1 should have expired")
+	}
+	if len(b.Items()) != 1 {
+		t.Errorf("Items should hold 1 entry but held %d", len(b.Items()))
+	}
+	if b.Stats().Expirations != 1 {
+		t.Errorf("Expirations should be 1 but was %d", b.Stats().Expirations)
+	}
+}
+
+func TestBoundedCacheAsCacheStore(t *testing.T) {
+
+	previous := Cache
+	Cache = NewBoundedCache(BoundedCacheOptions{MaxEntries: 2})
+	defer func() { Cache = previous }()
+
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "2", &model.LookupResponse{})
+	_ = AddNegativeCacheItem(context.Background(), "3", EntryNotFound)
+
+	stats := GetCacheStats()
+	if stats.Bounded == nil || stats.Bounded.Evictions != 1 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+	if _, err := GetCacheById(context.Background(), "1"); err == nil {
+		t.Error("1 should have been evicted")
+	}
+}
@@ -1,20 +1,39 @@
 package api
 
 import (
+	"context"
 	"log/slog"
-	"os"
-	"strconv"
 	"time"
 
 	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
 	"github.com/jvanrhyn/brgeo/model"
 	"github.com/patrickmn/go-cache"
 )
 
-var (
-	Cache        = cache.New(5*time.Minute, 5*time.Minute)
-	cacheTimeout int
-	err          error
+// CacheStore is the storage behind the lookup cache. It is satisfied by
+// *cache.Cache from go-cache and by the size limited *BoundedCache.
+type CacheStore interface {
+	Get(k string) (interface{}, bool)
+	Set(k string, x interface{}, d time.Duration)
+	Delete(k string)
+	Flush()
+	ItemCount() int
+	Items() map[string]cache.Item
+}
+
+var Cache CacheStore = cache.New(5*time.Minute, 5*time.Minute)
+
+// EntryKind distinguishes positive cache entries from negative ones.
+type EntryKind string
+
+const (
+	// EntryFound holds geolocation data returned by the upstream service.
+	EntryFound EntryKind = "found"
+	// EntryNotFound records that the upstream service had no data for the key.
+	EntryNotFound EntryKind = "not_found"
+	// EntryFailed records that the upstream lookup for the key failed.
+	EntryFailed EntryKind = "failed"
 )
 
 // CacheItem struct holds the string key and
@@ -24,43 +43,169 @@ type CacheItem []struct {
 	Data *model.LookupResponse `json:"data"`
 }
 
-// GetCacheById retrieves an item from the cache for the given key
-func GetCacheById(id string) (*model.LookupResponse, error) {
-	slog.Info("Retrieving item from cache", "id", id)
+// CacheEntry is the value stored in the cache for a lookup.
+//
+// An entry is fresh until StaleAt (the soft TTL, the cache Timeout) and is
+// removed from the cache once the hard TTL (the cache HardTimeout) expires.
+// In between, the entry may still be served while it is refreshed.
+//
+// Negative entries (EntryNotFound, EntryFailed) carry no data and use their
+// own, shorter timeouts. They are never served stale.
+type CacheEntry struct {
+	Kind    EntryKind             `json:"kind"`
+	Data    *model.LookupResponse `json:"data,omitempty"`
+	StaleAt time.Time             `json:"stale_at"`
+}
+
+// Negative reports whether the entry records a failed or empty lookup.
+func (e *CacheEntry) Negative() bool {
+	return e.Kind != EntryFound
+}
+
+// Err returns the lookup error a negative entry stands for, or nil.
+func (e *CacheEntry) Err() error {
+	switch e.Kind {
+	case EntryNotFound:
+		return ErrNotFound
+	case EntryFailed:
+		return ErrUpstream
+	}
+	return nil
+}
+
+// Stale reports whether the soft TTL of the entry has passed.
+func (e *CacheEntry) Stale() bool {
+	return time.Now().After(e.StaleAt)
+}
+
+// GetCacheById retrieves an item from the cache for the given key.
+// A negative entry is returned as its lookup error.
+func GetCacheById(ctx context.Context, id string) (*model.LookupResponse, error) {
+	entry, err := GetCacheEntry(ctx, id)
+	if err != nil {
+		return &model.LookupResponse{}, err
+	}
+	if entry.Negative() {
+		return &model.LookupResponse{}, entry.Err()
+	}
+	return entry.Data, nil
+}
+
+// GetCacheEntry retrieves the entry from the cache for the given key,
+// including entries that are past their soft TTL.
+func GetCacheEntry(ctx context.Context, id string) (*CacheEntry, error) {
+	slog.InfoContext(ctx, "Retrieving item from cache", "id", id)
 
 	if Cache == nil {
-		slog.Warn("Cache does not exist")
-		return &model.LookupResponse{}, errors.New("not found")
+		slog.WarnContext(ctx, "Cache does not exist")
+		return nil, errors.New("not found")
 	}
 
 	item, found := Cache.Get(id)
 	if found {
-		return item.(*model.LookupResponse), nil
+		return item.(*CacheEntry), nil
 	}
-	return &model.LookupResponse{}, errors.New("not found")
+	return nil, errors.New("not found")
 }
 
 // AddCacheItem sets an item in the cache for the given key
-func AddCacheItem(id string, data *model.LookupResponse) error {
-
-	if cacheTimeout == 0 {
-		getTimeoutSeconds()
+func AddCacheItem(ctx context.Context, id string, data *model.LookupResponse) error {
+	cfg := Settings().Cache
+	soft, hard := cfg.Timeout, cfg.HardTimeout
+	if hard == 0 {
+		hard = 2 * soft
 	}
+	slog.InfoContext(ctx, "Cache durations set", "duration", soft, "hard", hard)
+
+	Cache.Set(id, &CacheEntry{Kind: EntryFound, Data: data, StaleAt: time.Now().Add(soft)}, hard)
+	return nil
+}
 
-	duration := time.Duration(cacheTimeout) * time.Second
-	slog.Info("Cache durations set", "duration", duration)
+// AddNegativeCacheItem records a failed or empty lookup for the given key,
+// using the NotFoundTimeout or FailureTimeout of the cache configuration.
+func AddNegativeCacheItem(ctx context.Context, id string, kind EntryKind) error {
+	cfg := Settings().Cache
 
-	Cache.Set(id, data, duration)
+	var duration time.Duration
+	switch kind {
+	case EntryNotFound:
+		duration = cfg.NotFoundTimeout
+	case EntryFailed:
+		duration = cfg.FailureTimeout
+	default:
+		return errors.Errorf("%q is not a negative cache entry", kind)
+	}
+	slog.InfoContext(ctx, "Negative cache durations set", "kind", kind, "duration", duration)
+
+	Cache.Set(id, &CacheEntry{Kind: kind, StaleAt: time.Now().Add(duration)}, duration)
 	return nil
 }
 
-// init function is called before the main function
-func getTimeoutSeconds() {
-	ct := os.Getenv("CACHE_TIMEOUT_SEC")
-	slog.Info("Initializing cache", "timeout", ct)
-	cacheTimeout, err = strconv.Atoi(ct)
-	if err != nil {
-		slog.Info("Could not retrieve CACHE_TIMEOUT_SEC", "error", err)
-		cacheTimeout = 60
+// InitCache replaces the default go-cache store with the configured backend.
+// The "bounded" backend is limited by MaxEntries and MaxBytes and evicts by
+// EvictionPolicy ("lru" or "lfu"); "memory" keeps the unbounded go-cache store.
+//
+// This function is called once at the start of the application, before the cache is used.
+func InitCache(cfg config.CacheConfig) {
+	if cfg.Backend != "bounded" {
+		slog.Info("Using unbounded memory cache", "backend", cfg.Backend)
+		return
+	}
+
+	maxEntries, maxBytes := cfg.MaxEntries, cfg.MaxBytes
+	policy := EvictionPolicy(cfg.EvictionPolicy)
+
+	slog.Info("Using bounded memory cache", "max_entries", maxEntries, "max_bytes", maxBytes, "policy", policy)
+	Cache = NewBoundedCache(BoundedCacheOptions{
+		MaxEntries: maxEntries,
+		MaxBytes:   maxBytes,
+		Policy:     policy,
+	})
+}
+
+// CacheStats holds the number of cached entries by kind and,
+// for the bounded backend, its size and eviction counters.
+type CacheStats struct {
+	Found    int                `json:"found"`
+	NotFound int                `json:"not_found"`
+	Failed   int                `json:"failed"`
+	Stale    int                `json:"stale"`
+	Prefixes int                `json:"prefixes"`
+	Bounded  *BoundedCacheStats `json:"bounded,omitempty"`
+	Tiers    TierStats          `json:"tiers"`
+}
+
+// GetCacheStats counts the unexpired entries in the cache by kind.
+// Entries cached per network block are counted separately as prefixes.
+// It also reports the lookups answered from each tier.
+func GetCacheStats() CacheStats {
+	var stats CacheStats
+	for key, item := range Cache.Items() {
+		entry, ok := item.Object.(*CacheEntry)
+		if !ok {
+			continue
+		}
+		if isPrefixKey(key) {
+			stats.Prefixes++
+			continue
+		}
+		switch entry.Kind {
+		case EntryFound:
+			stats.Found++
+			if entry.Stale() {
+				stats.Stale++
+			}
+		case EntryNotFound:
+			stats.NotFound++
+		case EntryFailed:
+			stats.Failed++
+		}
+	}
+
+	if bounded, ok := Cache.(*BoundedCache); ok {
+		b := bounded.Stats()
+		stats.Bounded = &b
 	}
+	stats.Tiers = GetTierStats()
+	return stats
 }
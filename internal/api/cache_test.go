@@ -1,17 +1,18 @@
 package api
 
 import (
+	"context"
+	"github.com/go-errors/errors"
 	"github.com/jvanrhyn/brgeo/model"
-	"os"
 	"testing"
+	"time"
 )
 
 func TestAddCacheItem(t *testing.T) {
 
-	os.Setenv("CACHE_TIMEOUT_SEC", "60")
 	Cache.Flush()
 
-	_ = AddCacheItem("1", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{})
 
 	if Cache.ItemCount() != 1 {
 		t.Error("Cache item count should be 1")
@@ -20,11 +21,10 @@ func TestAddCacheItem(t *testing.T) {
 
 func TestAddMultipleCacheItem(t *testing.T) {
 
-	os.Setenv("CACHE_TIMEOUT_SEC", "60")
 	Cache.Flush()
-	_ = AddCacheItem("1", &model.LookupResponse{})
-	_ = AddCacheItem("2", &model.LookupResponse{})
-	_ = AddCacheItem("3", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "2", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "3", &model.LookupResponse{})
 
 	if Cache.ItemCount() != 3 {
 		t.Error("Cache item count should be 3")
@@ -33,14 +33,67 @@ func TestAddMultipleCacheItem(t *testing.T) {
 
 func TestAddMultipleWithDuplicateCacheItem(t *testing.T) {
 
-	os.Setenv("CACHE_TIMEOUT_SEC", "60")
 	Cache.Flush()
 
-	_ = AddCacheItem("1", &model.LookupResponse{})
-	_ = AddCacheItem("1", &model.LookupResponse{})
-	_ = AddCacheItem("3", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{})
+	_ = AddCacheItem(context.Background(), "3", &model.LookupResponse{})
 
 	if Cache.ItemCount() != 2 {
 		t.Errorf("Cache item count should be 2 but was %d", Cache.ItemCount())
 	}
 }
+
+func TestStaleCacheItemIsStillServed(t *testing.T) {
+
+	Cache.Flush()
+
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{City: "Cape Town"})
+
+	entry, err := GetCacheEntry(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("expected cache entry, got error %v", err)
+	}
+	if entry.Stale() {
+		t.Error("Cache entry should be fresh")
+	}
+
+	// Move the entry past its soft TTL
+	entry.StaleAt = time.Now().Add(-time.Second)
+
+	got, err := GetCacheById(context.Background(), "1")
+	if err != nil {
+		t.Fatalf("expected stale entry to be served, got error %v", err)
+	}
+	if got.City != "Cape Town" {
+		t.Errorf("City should be Cape Town but was %q", got.City)
+	}
+	if !entry.Stale() {
+		t.Error("Cache entry should be stale")
+	}
+}
+
+func TestNegativeCacheItem(t *testing.T) {
+
+	Cache.Flush()
+
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{})
+	_ = AddNegativeCacheItem(context.Background(), "2", EntryNotFound)
+	_ = AddNegativeCacheItem(context.Background(), "3", EntryFailed)
+
+	if _, err := GetCacheById(context.Background(), "2"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("expected ErrNotFound but got %v", err)
+	}
+	if _, err := GetCacheById(context.Background(), "3"); !errors.Is(err, ErrUpstream) {
+		t.Errorf("expected ErrUpstream but got %v", err)
+	}
+
+	stats := GetCacheStats()
+	if stats.Found != 1 || stats.NotFound != 1 || stats.Failed != 1 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+
+	if err := AddNegativeCacheItem(context.Background(), "4", EntryFound); err == nil {
+		t.Error("a positive entry kind should be rejected")
+	}
+}
@@ -0,0 +1,26 @@
+package api
+
+import (
+	"sync/atomic"
+
+	"github.com/jvanrhyn/brgeo/config"
+)
+
+var settings atomic.Pointer[config.Config]
+
+// Configure sets the configuration read by the lookups, the cache and the
+// database. It is called once at the start of the application, before the
+// Init and Start functions of the package.
+func Configure(cfg *config.Config) {
+	settings.Store(cfg)
+}
+
+// Settings returns the configuration set with Configure, or the defaults
+// when it was never called.
+func Settings() *config.Config {
+	if cfg := settings.Load(); cfg != nil {
+		return cfg
+	}
+	cfg := config.Default()
+	return &cfg
+}
@@ -1,46 +1,155 @@
 package api
 
 import (
-	"fmt"
+	"context"
 	"log/slog"
-	"os"
+	"net/netip"
+	"strconv"
+	"time"
 
+	"github.com/glebarez/sqlite"
 	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
 	"github.com/jvanrhyn/brgeo/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
-var db *gorm.DB
+var (
+	db       *gorm.DB
+	dbDriver string
+)
+
+// Database drivers selectable with the Driver of the database configuration.
+const (
+	DriverPostgres = "postgres"
+	DriverSQLite   = "sqlite"
+	DriverNone     = "none"
+)
 
-// InitDatabase initializes the database connection and migrates the LookupRequest model.
+// InitDatabase opens the database with OpenDatabase and brings its schema up to date.
 //
-// It retrieves the DSN from the environment variable "CONNECTION" and logs the connection details.
+// It refuses to start against a schema migrated by a newer build of the application.
+// Pending migrations are applied unless AutoMigrate is false, in which case they are left
+// to the migrate command.
 //
-// It then opens a connection to the database using GORM and configures it. If an error occurs during this process, it panics.
+// This function is called once at the start of the application to set up the database.
+func InitDatabase(cfg config.DatabaseConfig) error {
+	if err := OpenDatabase(cfg); err != nil {
+		return err
+	}
+	if db == nil {
+		return nil
+	}
+
+	if err := CheckSchemaVersion(); err != nil {
+		return err
+	}
+
+	if !cfg.AutoMigrate {
+		current, _ := SchemaVersion()
+		latest, _ := LatestSchemaVersion(dbDriver)
+		if current < latest {
+			slog.Warn("Database schema is out of date, run the migrate command", "version", current, "latest", latest)
+		}
+		return nil
+	}
+
+	_, err := MigrateUp(0)
+	return err
+}
+
+// OpenDatabase initializes the database connection without touching its schema.
 //
-// After the connection is established, it attempts to auto-migrate the LookupRequest model. If an error occurs during this process, it logs the error and continues.
+// The Driver of the configuration is "postgres" (the default), "sqlite", for which the
+// Connection is a file name or ":memory:", or "none", which disables recording lookups
+// altogether.
 //
-// This function is called once at the start of the application to set up the database.
-func InitDatabase() {
-	dsn := os.Getenv("CONNECTION")
-	slog.Info("Initializing database", "connection", dsn)
+// It logs the connection details without the password, then opens a connection to the database using GORM and
+// configures it. If an error occurs during this process, it is returned.
+func OpenDatabase(cfg config.DatabaseConfig) error {
+	driver := cfg.Driver
+	if driver == "" {
+		driver = DriverPostgres
+	}
+
+	dsn := cfg.Connection
+	slog.Info("Initializing database", "driver", driver, "connection", RedactDSN(dsn))
+
+	var dialector gorm.Dialector
+	switch driver {
+	case DriverPostgres:
+		dialector = postgres.Open(dsn)
+	case DriverSQLite:
+		dialector = sqlite.Open(dsn)
+	case DriverNone:
+		slog.Warn("Database disabled, lookups will not be recorded")
+		db, dbDriver = nil, driver
+		return nil
+	default:
+		return errors.Errorf("unknown database driver %q, expected %s, %s or %s", driver, DriverPostgres, DriverSQLite, DriverNone)
+	}
 
-	db, err = gorm.Open(postgres.Open(dsn), &gorm.Config{})
+	conn, err := gorm.Open(dialector, &gorm.Config{})
 	if err != nil {
-		panic(err)
+		return errors.New(err)
+	}
+
+	if driver == DriverSQLite {
+		// SQLite allows a single writer, and every connection to
+		// ":memory:" would otherwise open its own empty database
+		sqlDB, err := conn.DB()
+		if err != nil {
+			return errors.New(err)
+		}
+		sqlDB.SetMaxOpenConns(1)
 	}
 
-	err = db.AutoMigrate(&model.LookupRequest{})
+	db, dbDriver = conn, driver
+	return nil
+}
+
+// CloseDatabase closes the connection pool of the database opened by OpenDatabase.
+// It is called once at shutdown, after the recorder is stopped.
+func CloseDatabase() error {
+	if db == nil {
+		return nil
+	}
+	sqlDB, err := db.DB()
 	if err != nil {
-		fmt.Println(err)
+		return errors.New(err)
+	}
+	if err := sqlDB.Close(); err != nil {
+		return errors.New(err)
 	}
+	slog.Info("Closed database connections")
+	return nil
+}
+
+// DatabaseDriver returns the driver of the database opened by OpenDatabase.
+func DatabaseDriver() string {
+	return dbDriver
+}
+
+// DatabaseEnabled reports whether lookups are recorded, that is whether
+// a database was opened by InitDatabase.
+func DatabaseEnabled() bool {
+	return db != nil
 }
 
 // Record records a new lookup request in the database.
+// It does nothing when the database is disabled.
+//
+// When the lookup request carries a GeoLocation, it replaces the geolocation
+// stored for the ip address and the request is linked to it. Otherwise the
+// request is linked to the geolocation already stored for the ip address, if any.
 //
 // Parameters:
 //   - lookupRequest: A pointer to a model.LookupRequest object containing the details of the lookup request.
+//   - links: The links to the span of the request that made the lookup, if it was traced.
 //
 // Returns:
 //   - nil if the lookup request is successfully recorded, otherwise an error.
@@ -54,12 +163,190 @@ func InitDatabase() {
 //	    log.Fatal(err)
 //	}
 //	```
-func Record(lookupRequest *model.LookupRequest) error {
-	tx := db.Create(lookupRequest)
-	if tx.Error != nil {
-		stack := err.(*errors.Error).ErrorStack()
-		slog.Error("error while recording lookup", "error", err, "stacktrace", stack)
+func Record(lookupRequest *model.LookupRequest, links ...trace.Link) error {
+	if db == nil {
+		return nil
+	}
+
+	ctx, span := startWriteSpan("lookup", 1, links)
+	start := time.Now()
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		return recordLookup(tx, lookupRequest)
+	})
+	observeDBWrite("lookup", start, err)
+	endSpan(span, err)
+	if err != nil {
+		err := errors.New(err)
+		slog.Error("error while recording lookup", "error", err, "stacktrace", err.ErrorStack())
+		return err
+	}
+	return nil
+}
+
+// RecordBatch records several lookup requests in a single transaction,
+// inserting the lookups themselves in one statement. The links are those to
+// the spans of the requests that made the lookups. It does nothing when the
+// database is disabled.
+func RecordBatch(lookupRequests []*model.LookupRequest, links ...trace.Link) error {
+	if db == nil || len(lookupRequests) == 0 {
+		return nil
+	}
+
+	ctx, span := startWriteSpan("batch", len(lookupRequests), links)
+	start := time.Now()
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		for _, lookupRequest := range lookupRequests {
+			if err := prepareLookup(tx, lookupRequest); err != nil {
+				return err
+			}
+		}
+		if err := tx.Omit(clause.Associations).Create(lookupRequests).Error; err != nil {
+			return err
+		}
+		return updateRollups(tx, lookupRequests)
+	})
+	observeDBWrite("batch", start, err)
+	endSpan(span, err)
+	if err != nil {
+		return errors.New(err)
+	}
+	return nil
+}
+
+// startWriteSpan starts the span of a transaction recording lookups. As lookups
+// are recorded in the background, the span starts a trace of its own, linked to
+// the spans of the requests that made the lookups.
+func startWriteSpan(operation string, count int, links []trace.Link) (context.Context, trace.Span) {
+	valid := make([]trace.Link, 0, len(links))
+	for _, link := range links {
+		if link.SpanContext.IsValid() {
+			valid = append(valid, link)
+		}
+	}
+	return tracer.Start(context.Background(), "db.insert "+operation,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithLinks(valid...),
+		trace.WithAttributes(
+			attribute.String("db.system", db.Dialector.Name()),
+			attribute.String("db.operation", "insert"),
+			attribute.Int("db.lookups", count),
+		))
+}
+
+// recordLookup stores the lookup request and its geolocation using tx.
+func recordLookup(tx *gorm.DB, lookupRequest *model.LookupRequest) error {
+	if err := prepareLookup(tx, lookupRequest); err != nil {
 		return err
 	}
+	if err := tx.Omit(clause.Associations).Create(lookupRequest).Error; err != nil {
+		return err
+	}
+	return updateRollups(tx, []*model.LookupRequest{lookupRequest})
+}
+
+// prepareLookup replaces the ip address of the lookup request by the form the
+// StoragePrivacy stores it in, fills in the columns derived from it, stores its
+// geolocation, if any, and links the request to the geolocation stored for its
+// ip address, loading it into the request. As the request is changed in place,
+// a failed write is attempted again with the request as it was given.
+func prepareLookup(tx *gorm.DB, lookupRequest *model.LookupRequest) error {
+	// Times are stored in UTC, so that SQLite, which compares them as text,
+	// orders and filters them whatever the time zone of the host
+	lookupRequest.LookupTime = lookupRequest.LookupTime.UTC()
+
+	privacy := StoragePrivacy()
+	lookupRequest.IpBytes = privacy.StoredBytes(lookupRequest.IpAddress)
+	lookupRequest.IpAddress = privacy.StoredAddress(lookupRequest.IpAddress)
+
+	if geo := lookupRequest.GeoLocation; geo != nil {
+		geo.IpAddress = lookupRequest.IpAddress
+		result := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "ip_address"}},
+			UpdateAll: true,
+		}).Create(geo)
+		if result.Error != nil {
+			return result.Error
+		}
+		lookupRequest.GeoLocationID = &geo.ID
+	} else {
+		var geos []model.GeoLocation
+		result := tx.Where("ip_address = ?", lookupRequest.IpAddress).
+			Limit(1).
+			Find(&geos)
+		if result.Error != nil {
+			return result.Error
+		}
+		if len(geos) > 0 {
+			lookupRequest.GeoLocationID = &geos[0].ID
+			lookupRequest.GeoLocation = &geos[0]
+		}
+	}
 	return nil
 }
+
+// ipBytes returns the 16 byte form of the ip address, with IPv4 addresses
+// mapped into IPv6, or nil when it is not a valid address. Comparing these
+// bytes orders addresses numerically, so a network block is a range of them.
+func ipBytes(ipaddress string) []byte {
+	addr, err := netip.ParseAddr(ipaddress)
+	if err != nil {
+		return nil
+	}
+	b := addr.As16()
+	return b[:]
+}
+
+// NewGeoLocation normalizes the geolocation data returned by the upstream
+// service for storage. Coordinates that are not numeric are left empty.
+func NewGeoLocation(geo model.GeoData) *model.GeoLocation {
+	return &model.GeoLocation{
+		IpAddress:     geo.IP,
+		RDNS:          geo.RDNS,
+		ISP:           geo.ISP,
+		CountryName:   geo.CountryName,
+		CountryCode:   geo.CountryCode,
+		RegionName:    geo.RegionName,
+		RegionCode:    geo.RegionCode,
+		City:          geo.City,
+		PostalCode:    geo.PostalCode,
+		ContinentName: geo.ContinentName,
+		ContinentCode: geo.ContinentCode,
+		Latitude:      toFloat(geo.Latitude),
+		Longitude:     toFloat(geo.Longitude),
+		Timezone:      geo.Timezone,
+	}
+}
+
+func toFloat(v interface{}) *float64 {
+	switch n := v.(type) {
+	case float64:
+		return &n
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		if err == nil {
+			return &f
+		}
+	}
+	return nil
+}
+
+// TopLookedUpAddresses returns up to limit ip addresses, ordered by
+// the number of times they were looked up, most frequent first.
+// None are returned when the addresses are not stored in full.
+func TopLookedUpAddresses(limit int) ([]string, error) {
+	var addresses []string
+	if db == nil || StoragePrivacy().Mode != PrivacyFull {
+		return addresses, nil
+	}
+
+	tx := db.Model(&model.LookupRequest{}).
+		Select("ip_address").
+		Group("ip_address").
+		Order("count(*) desc").
+		Limit(limit).
+		Pluck("ip_address", &addresses)
+	if tx.Error != nil {
+		return nil, errors.New(tx.Error)
+	}
+	return addresses, nil
+}
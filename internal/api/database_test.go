@@ -0,0 +1,112 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+	"gorm.io/gorm"
+)
+
+func TestNewGeoLocation(t *testing.T) {
+
+	geo := NewGeoLocation(model.GeoData{
+		IP:          "169.1.245.236",
+		CountryCode: "ZA",
+		City:        "Johannesburg",
+		Latitude:    -26.2,
+		Longitude:   "28.04",
+		MetroCode:   nil,
+	})
+
+	if geo.IpAddress != "169.1.245.236" || geo.CountryCode != "ZA" || geo.City != "Johannesburg" {
+		t.Errorf("unexpected geolocation %+v", geo)
+	}
+	if geo.Latitude == nil || *geo.Latitude != -26.2 {
+		t.Errorf("expected latitude -26.2 but got %v", geo.Latitude)
+	}
+	if geo.Longitude == nil || *geo.Longitude != 28.04 {
+		t.Errorf("expected longitude 28.04 but got %v", geo.Longitude)
+	}
+
+	if NewGeoLocation(model.GeoData{Latitude: "n/a"}).Latitude != nil {
+		t.Error("a non numeric latitude should be left empty")
+	}
+}
+
+// resetDatabase removes all recorded lookups and their rollups from the test database.
+func resetDatabase(t *testing.T) {
+	t.Helper()
+	for _, table := range []interface{}{&model.LookupRequest{}, &model.GeoLocation{}, &model.LookupRollup{}} {
+		if err := db.Session(&gorm.Session{AllowGlobalUpdate: true}).Delete(table).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRecordLinksLookupsToGeoLocation(t *testing.T) {
+
+	resetDatabase(t)
+
+	first := &model.LookupRequest{
+		IpAddress:    "41.160.113.136",
+		LookupTime:   time.Now(),
+		LookupStatus: true,
+		Provider:     Provider,
+		CacheStatus:  "miss",
+		GeoLocation:  &model.GeoLocation{CountryCode: "ZA", City: "Cape Town"},
+	}
+	if err := Record(first); err != nil {
+		t.Fatal(err)
+	}
+
+	// A later lookup replaces the geolocation stored for the address
+	second := &model.LookupRequest{
+		IpAddress:    "41.160.113.136",
+		LookupTime:   time.Now(),
+		LookupStatus: true,
+		Provider:     Provider,
+		CacheStatus:  "refresh",
+		GeoLocation:  &model.GeoLocation{CountryCode: "ZA", City: "Stellenbosch"},
+	}
+	if err := Record(second); err != nil {
+		t.Fatal(err)
+	}
+
+	// A cached lookup is linked to the stored geolocation
+	hit := &model.LookupRequest{IpAddress: "41.160.113.136", LookupTime: time.Now(), LookupStatus: true, CacheStatus: "hit"}
+	if err := Record(hit); err != nil {
+		t.Fatal(err)
+	}
+
+	if first.GeoLocationID == nil || hit.GeoLocationID == nil || *first.GeoLocationID != *hit.GeoLocationID {
+		t.Fatalf("lookups should share a geolocation, got %v and %v", first.GeoLocationID, hit.GeoLocationID)
+	}
+
+	var geo model.GeoLocation
+	if err := db.First(&geo, *hit.GeoLocationID).Error; err != nil {
+		t.Fatal(err)
+	}
+	if geo.City != "Stellenbosch" {
+		t.Errorf("expected the latest geolocation but got %q", geo.City)
+	}
+}
+
+func TestTopLookedUpAddresses(t *testing.T) {
+
+	resetDatabase(t)
+
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.2", "10.0.0.2", "10.0.0.3", "10.0.0.3"} {
+		if err := Record(&model.LookupRequest{IpAddress: ip, LookupTime: time.Now(), CacheStatus: "miss"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	top, err := TopLookedUpAddresses(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(top) != 2 || top[0] != "10.0.0.2" || top[1] != "10.0.0.3" {
+		t.Errorf("unexpected top addresses %v", top)
+	}
+}
@@ -0,0 +1,246 @@
+package api
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/model"
+	"github.com/parquet-go/parquet-go"
+)
+
+// ExportFormat is a file format the lookup history can be exported in.
+type ExportFormat string
+
+const (
+	ExportCSV     ExportFormat = "csv"
+	ExportNDJSON  ExportFormat = "ndjson"
+	ExportParquet ExportFormat = "parquet"
+)
+
+// exportRowGroupSize is the number of lookups buffered in memory before they
+// are written out as a Parquet row group.
+const exportRowGroupSize = 10000
+
+// ExportRow is a recorded lookup flattened with its geolocation,
+// as written by ExportHistory.
+type ExportRow struct {
+	ID            uint64    `json:"id" parquet:"id"`
+	IpAddress     string    `json:"ip_address" parquet:"ip_address"`
+	LookupTime    time.Time `json:"lookup_time" parquet:"lookup_time,timestamp(millisecond)"`
+	LookupStatus  bool      `json:"lookup_status" parquet:"lookup_status"`
+	Provider      string    `json:"provider" parquet:"provider"`
+	LatencyMs     int64     `json:"latency_ms" parquet:"latency_ms"`
+	Retries       int64     `json:"retries" parquet:"retries"`
+	CacheStatus   string    `json:"cache_status" parquet:"cache_status"`
+	ErrorCode     string    `json:"error_code" parquet:"error_code"`
+	CountryCode   string    `json:"country_code" parquet:"country_code"`
+	CountryName   string    `json:"country_name" parquet:"country_name"`
+	RegionName    string    `json:"region_name" parquet:"region_name"`
+	City          string    `json:"city" parquet:"city"`
+	PostalCode    string    `json:"postal_code" parquet:"postal_code"`
+	ISP           string    `json:"isp" parquet:"isp"`
+	Latitude      *float64  `json:"latitude" parquet:"latitude,optional"`
+	Longitude     *float64  `json:"longitude" parquet:"longitude,optional"`
+	Timezone      string    `json:"timezone" parquet:"timezone"`
+	ContinentCode string    `json:"continent_code" parquet:"continent_code"`
+}
+
+// exportColumns are the CSV columns, in the order of the fields of ExportRow.
+var exportColumns = []string{
+	"id", "ip_address", "lookup_time", "lookup_status", "provider", "latency_ms", "retries",
+	"cache_status", "error_code", "country_code", "country_name", "region_name", "city",
+	"postal_code", "isp", "latitude", "longitude", "timezone", "continent_code",
+}
+
+// exportWriter writes the exported rows in a file format.
+type exportWriter interface {
+	Write(rows []ExportRow) error
+	Close() error
+}
+
+// ParseExportFormat validates the name of an export format.
+func ParseExportFormat(name string) (ExportFormat, error) {
+	switch format := ExportFormat(name); format {
+	case ExportCSV, ExportNDJSON, ExportParquet:
+		return format, nil
+	}
+	return "", errors.Errorf("format %q must be csv, ndjson or parquet", name)
+}
+
+// ContentType returns the media type of the export format.
+func (f ExportFormat) ContentType() string {
+	switch f {
+	case ExportCSV:
+		return "text/csv"
+	case ExportParquet:
+		return "application/vnd.apache.parquet"
+	}
+	return "application/x-ndjson"
+}
+
+// ExportHistory writes the recorded lookups matching the filter to w in the
+// format and returns the number written. Lookups are read and written a page
+// at a time, so the export never holds the whole history in memory. The limit
+// and cursor of the filter are ignored.
+func ExportHistory(w io.Writer, format ExportFormat, filter HistoryFilter) (int, error) {
+	var out exportWriter
+	switch format {
+	case ExportCSV:
+		out = newCSVExport(w)
+	case ExportNDJSON:
+		out = &ndjsonExport{encoder: json.NewEncoder(w)}
+	case ExportParquet:
+		out = &parquetExport{writer: parquet.NewGenericWriter[ExportRow](w, parquet.MaxRowsPerRowGroup(exportRowGroupSize))}
+	default:
+		return 0, errors.Errorf("unknown export format %q", format)
+	}
+
+	filter.Limit = maxHistoryLimit
+	filter.Cursor = ""
+
+	count := 0
+	rows := make([]ExportRow, 0, maxHistoryLimit)
+	for {
+		page, err := QueryHistory(filter)
+		if err != nil {
+			return count, err
+		}
+
+		rows = rows[:0]
+		for i := range page.Items {
+			rows = append(rows, newExportRow(&page.Items[i]))
+		}
+		if err := out.Write(rows); err != nil {
+			return count, errors.New(err)
+		}
+		count += len(rows)
+
+		if page.NextCursor == "" {
+			break
+		}
+		// A page must move the cursor forward, or the export would never end
+		if page.NextCursor == filter.Cursor {
+			return count, errors.Errorf("history page after cursor %q did not move past it", filter.Cursor)
+		}
+		filter.Cursor = page.NextCursor
+	}
+
+	if err := out.Close(); err != nil {
+		return count, errors.New(err)
+	}
+	return count, nil
+}
+
+func newExportRow(req *model.LookupRequest) ExportRow {
+	row := ExportRow{
+		ID:           uint64(req.ID),
+		IpAddress:    req.IpAddress,
+		LookupTime:   req.LookupTime.UTC(),
+		LookupStatus: req.LookupStatus,
+		Provider:     req.Provider,
+		LatencyMs:    req.LatencyMs,
+		Retries:      int64(req.Retries),
+		CacheStatus:  req.CacheStatus,
+		ErrorCode:    req.ErrorCode,
+	}
+	if geo := req.GeoLocation; geo != nil {
+		row.CountryCode = geo.CountryCode
+		row.CountryName = geo.CountryName
+		row.RegionName = geo.RegionName
+		row.City = geo.City
+		row.PostalCode = geo.PostalCode
+		row.ISP = geo.ISP
+		row.Latitude = geo.Latitude
+		row.Longitude = geo.Longitude
+		row.Timezone = geo.Timezone
+		row.ContinentCode = geo.ContinentCode
+	}
+	return row
+}
+
+type csvExport struct {
+	writer *csv.Writer
+}
+
+func newCSVExport(w io.Writer) *csvExport {
+	e := &csvExport{writer: csv.NewWriter(w)}
+	_ = e.writer.Write(exportColumns)
+	return e
+}
+
+func (e *csvExport) Write(rows []ExportRow) error {
+	for _, row := range rows {
+		record := []string{
+			strconv.FormatUint(row.ID, 10),
+			row.IpAddress,
+			row.LookupTime.Format(time.RFC3339Nano),
+			strconv.FormatBool(row.LookupStatus),
+			row.Provider,
+			strconv.FormatInt(row.LatencyMs, 10),
+			strconv.FormatInt(row.Retries, 10),
+			row.CacheStatus,
+			row.ErrorCode,
+			row.CountryCode,
+			row.CountryName,
+			row.RegionName,
+			row.City,
+			row.PostalCode,
+			row.ISP,
+			formatOptionalFloat(row.Latitude),
+			formatOptionalFloat(row.Longitude),
+			row.Timezone,
+			row.ContinentCode,
+		}
+		if err := e.writer.Write(record); err != nil {
+			return err
+		}
+	}
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+func (e *csvExport) Close() error {
+	e.writer.Flush()
+	return e.writer.Error()
+}
+
+type ndjsonExport struct {
+	encoder *json.Encoder
+}
+
+func (e *ndjsonExport) Write(rows []ExportRow) error {
+	for i := range rows {
+		if err := e.encoder.Encode(&rows[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *ndjsonExport) Close() error {
+	return nil
+}
+
+type parquetExport struct {
+	writer *parquet.GenericWriter[ExportRow]
+}
+
+func (e *parquetExport) Write(rows []ExportRow) error {
+	_, err := e.writer.Write(rows)
+	return err
+}
+
+func (e *parquetExport) Close() error {
+	return e.writer.Close()
+}
+
+func formatOptionalFloat(f *float64) string {
+	if f == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*f, 'f', -1, 64)
+}
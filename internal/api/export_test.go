@@ -0,0 +1,95 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+	"github.com/parquet-go/parquet-go"
+)
+
+// recordMany records n lookups a second apart, every one of them a success in ZA.
+func recordMany(t *testing.T, n int, start time.Time) {
+	t.Helper()
+	batch := make([]*model.LookupRequest, 0, n)
+	for i := 0; i < n; i++ {
+		batch = append(batch, &model.LookupRequest{
+			IpAddress:    "10.0.0.1",
+			LookupTime:   start.Add(time.Duration(i) * time.Second),
+			LookupStatus: true,
+			Provider:     Provider,
+			CacheStatus:  "hit",
+		})
+	}
+	batch[0].GeoLocation = &model.GeoLocation{CountryCode: "ZA", City: "Cape Town"}
+	if err := RecordBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExportHistory(t *testing.T) {
+
+	resetDatabase(t)
+
+	start := time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)
+	recordMany(t, 1200, start)
+	filter := HistoryFilter{From: start, To: start.Add(time.Hour), Ascending: true}
+
+	var out bytes.Buffer
+	count, err := ExportHistory(&out, ExportCSV, filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	records, err := csv.NewReader(&out).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 1200 || len(records) != 1201 {
+		t.Fatalf("expected 1200 lookups over several pages but got %d and %d csv records", count, len(records))
+	}
+	if records[0][0] != "id" || records[1][2] != "2024-05-01T00:00:00Z" || records[1][12] != "Cape Town" {
+		t.Errorf("unexpected csv records %v %v", records[0], records[1])
+	}
+
+	out.Reset()
+	if _, err := ExportHistory(&out, ExportNDJSON, HistoryFilter{From: start, To: start.Add(10 * time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	lines := 0
+	for scanner := bufio.NewScanner(&out); scanner.Scan(); {
+		lines++
+	}
+	if lines != 10 {
+		t.Errorf("expected 10 lookups in the time range but got %d", lines)
+	}
+
+	out.Reset()
+	if _, err := ExportHistory(&out, ExportParquet, filter); err != nil {
+		t.Fatal(err)
+	}
+	reader := parquet.NewGenericReader[ExportRow](bytes.NewReader(out.Bytes()))
+	defer func() { _ = reader.Close() }()
+	if reader.NumRows() != 1200 {
+		t.Fatalf("expected 1200 parquet rows but got %d", reader.NumRows())
+	}
+	rows := make([]ExportRow, 1)
+	if _, err := reader.Read(rows); err != nil {
+		t.Fatal(err)
+	}
+	if rows[0].CountryCode != "ZA" || !rows[0].LookupTime.Equal(start) {
+		t.Errorf("unexpected parquet row %+v", rows[0])
+	}
+}
+
+func TestParseExportFormat(t *testing.T) {
+
+	if format, err := ParseExportFormat("parquet"); err != nil || format != ExportParquet {
+		t.Errorf("expected parquet but got %q (%v)", format, err)
+	}
+	if _, err := ParseExportFormat("xlsx"); err == nil {
+		t.Error("expected an unknown format to be rejected")
+	}
+}
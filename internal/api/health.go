@@ -0,0 +1,189 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// Dependency states reported by CheckHealth.
+const (
+	StateUp       = "up"
+	StateDown     = "down"
+	StateDisabled = "disabled"
+	// StateDegraded is the state of the provider still failing once it was
+	// down for providerDownFor, which does not keep the service from being ready.
+	StateDegraded = "degraded"
+	// StateUnknown is the state of the provider before the first lookup.
+	StateUnknown = "unknown"
+)
+
+// providerFailureThreshold is the number of consecutive failed lookups after
+// which the provider is reported down. A single failure is not enough, as
+// lookups are retried and the service is rate limited.
+const providerFailureThreshold = 3
+
+// providerDownFor is how long the provider is reported down after its last
+// failed lookup. An instance that is not ready gets no lookups to find out the
+// provider recovered, and the cache and the database can still answer some.
+const providerDownFor = 30 * time.Second
+
+// databaseCheckTimeout bounds the ping of the database made by CheckHealth.
+const databaseCheckTimeout = 2 * time.Second
+
+var (
+	databaseHealth = &dependencyHealth{}
+	providerHealth = &dependencyHealth{}
+	cacheHealth    = &dependencyHealth{}
+)
+
+// DependencyStatus is the state of a dependency, with the latency of its last
+// check or use and its last error.
+type DependencyStatus struct {
+	Name        string     `json:"name"`
+	State       string     `json:"state"`
+	LatencyMs   int64      `json:"latency_ms"`
+	CheckedAt   *time.Time `json:"checked_at,omitempty"`
+	LastError   string     `json:"last_error,omitempty"`
+	LastErrorAt *time.Time `json:"last_error_at,omitempty"`
+}
+
+// Healthy reports whether the dependency does not keep the service from answering lookups.
+func (s DependencyStatus) Healthy() bool {
+	return s.State != StateDown
+}
+
+// HealthReport is the state of every dependency. The service is ready when
+// none of them is down.
+type HealthReport struct {
+	Ready        bool               `json:"ready"`
+	Dependencies []DependencyStatus `json:"dependencies"`
+}
+
+// CheckHealth checks the dependencies of the service: the database is pinged,
+// the cache backend is queried and the provider is judged by the outcome of the
+// latest lookups, so that probes do not use up its rate limit.
+func CheckHealth(ctx context.Context) HealthReport {
+	report := HealthReport{
+		Dependencies: []DependencyStatus{checkDatabase(ctx), checkCache(), providerStatus()},
+	}
+
+	report.Ready = true
+	for _, dep := range report.Dependencies {
+		report.Ready = report.Ready && dep.Healthy()
+	}
+	return report
+}
+
+func checkDatabase(ctx context.Context) DependencyStatus {
+	if db == nil {
+		return DependencyStatus{Name: "database", State: StateDisabled}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, databaseCheckTimeout)
+	defer cancel()
+
+	start := time.Now()
+	sqlDB, err := db.DB()
+	if err == nil {
+		err = sqlDB.PingContext(ctx)
+	}
+	databaseHealth.record(time.Since(start), err)
+
+	status := databaseHealth.status("database")
+	if err != nil {
+		status.State = StateDown
+	}
+	return status
+}
+
+func checkCache() DependencyStatus {
+	start := time.Now()
+	var err error
+	if Cache == nil {
+		err = errors.New("no cache backend")
+	} else {
+		Cache.ItemCount()
+	}
+	cacheHealth.record(time.Since(start), err)
+
+	status := cacheHealth.status("cache")
+	if err != nil {
+		status.State = StateDown
+	}
+	return status
+}
+
+func providerStatus() DependencyStatus {
+	status := providerHealth.status(Provider)
+	if status.CheckedAt == nil {
+		status.State = StateUnknown
+	} else if failures, lastErrorAt := providerHealth.failing(); failures >= providerFailureThreshold {
+		status.State = StateDown
+		if time.Since(lastErrorAt) >= providerDownFor {
+			status.State = StateDegraded
+		}
+	}
+	return status
+}
+
+// providerError returns the error of a lookup that counts against the health
+// of the provider. An address without data is a successful lookup.
+func providerError(err error) error {
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// dependencyHealth keeps the outcome of the latest checks or uses of a dependency.
+type dependencyHealth struct {
+	mu          sync.Mutex
+	checkedAt   time.Time
+	latency     time.Duration
+	failures    int
+	lastError   string
+	lastErrorAt time.Time
+}
+
+func (h *dependencyHealth) record(latency time.Duration, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checkedAt = time.Now()
+	h.latency = latency
+	if err == nil {
+		h.failures = 0
+		return
+	}
+	h.failures++
+	h.lastError = err.Error()
+	h.lastErrorAt = h.checkedAt
+}
+
+// failing returns the number of consecutive failures and the time of the last one.
+func (h *dependencyHealth) failing() (int, time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.failures, h.lastErrorAt
+}
+
+// status returns the dependency as up, with its latest check and error.
+func (h *dependencyHealth) status(name string) DependencyStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	status := DependencyStatus{Name: name, State: StateUp, LatencyMs: h.latency.Milliseconds()}
+	if !h.checkedAt.IsZero() {
+		checkedAt := h.checkedAt
+		status.CheckedAt = &checkedAt
+	}
+	if h.lastError != "" {
+		lastErrorAt := h.lastErrorAt
+		status.LastError = h.lastError
+		status.LastErrorAt = &lastErrorAt
+	}
+	return status
+}
@@ -0,0 +1,100 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+)
+
+// resetProviderHealth forgets the lookups made by earlier tests.
+func resetProviderHealth(t *testing.T) {
+	t.Helper()
+	providerHealth = &dependencyHealth{}
+	t.Cleanup(func() { providerHealth = &dependencyHealth{} })
+}
+
+func dependency(t *testing.T, report HealthReport, name string) DependencyStatus {
+	t.Helper()
+	for _, dep := range report.Dependencies {
+		if dep.Name == name {
+			return dep
+		}
+	}
+	t.Fatalf("dependency %s missing from %+v", name, report)
+	return DependencyStatus{}
+}
+
+func TestCheckHealth(t *testing.T) {
+
+	resetProviderHealth(t)
+
+	report := CheckHealth(context.Background())
+	if !report.Ready {
+		t.Errorf("expected the service to be ready but got %+v", report)
+	}
+	if dep := dependency(t, report, "database"); dep.State != StateUp || dep.CheckedAt == nil {
+		t.Errorf("unexpected database status %+v", dep)
+	}
+	if dep := dependency(t, report, "cache"); dep.State != StateUp {
+		t.Errorf("unexpected cache status %+v", dep)
+	}
+	if dep := dependency(t, report, Provider); dep.State != StateUnknown {
+		t.Errorf("expected the provider to be unknown before a lookup but got %+v", dep)
+	}
+}
+
+func TestProviderHealth(t *testing.T) {
+
+	resetProviderHealth(t)
+
+	providerHealth.record(time.Millisecond, providerError(ErrNotFound))
+	if dep := providerStatus(); dep.State != StateUp || dep.LastError != "" {
+		t.Errorf("expected an address without data not to count as a failure but got %+v", dep)
+	}
+
+	for i := 0; i < providerFailureThreshold; i++ {
+		providerHealth.record(time.Second, providerError(ErrUpstream))
+	}
+	dep := providerStatus()
+	if dep.State != StateDown || dep.LastError == "" || dep.LastErrorAt == nil || dep.LatencyMs != 1000 {
+		t.Errorf("expected the provider to be down after repeated failures but got %+v", dep)
+	}
+	if CheckHealth(context.Background()).Ready {
+		t.Error("expected the service not to be ready without a healthy provider")
+	}
+
+	// Without lookups to find out the provider recovered, the service is ready again after a while
+	providerHealth.mu.Lock()
+	providerHealth.lastErrorAt = time.Now().Add(-providerDownFor)
+	providerHealth.mu.Unlock()
+	if dep := providerStatus(); dep.State != StateDegraded {
+		t.Errorf("expected the provider to be degraded once down for a while but got %+v", dep)
+	}
+	if !CheckHealth(context.Background()).Ready {
+		t.Error("expected the service to be ready again with a degraded provider")
+	}
+
+	providerHealth.record(time.Millisecond, nil)
+	if dep := providerStatus(); dep.State != StateUp || dep.LastError == "" {
+		t.Errorf("expected the provider to recover and keep its last error but got %+v", dep)
+	}
+}
+
+func TestProviderHealthTracksLookups(t *testing.T) {
+
+	resetProviderHealth(t)
+	useSettings(t, func(c *config.Config) {
+		c.Provider.ServiceURL = "http://127.0.0.1:1"
+		c.Provider.MaxRetries = 1
+	})
+
+	if _, _, err := GetGeoInfo(context.Background(), "41.160.113.136"); !errors.Is(err, ErrUpstream) {
+		t.Fatalf("expected the lookup to fail but got %v", err)
+	}
+	if dep := providerStatus(); dep.LastError == "" {
+		t.Errorf("expected the failed lookup to be tracked but got %+v", dep)
+	}
+}
@@ -0,0 +1,247 @@
+package api
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/model"
+	"gorm.io/gorm"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 500
+)
+
+// HistoryFilter selects recorded lookups. Empty fields do not filter.
+type HistoryFilter struct {
+	IpAddress string
+	CIDR      netip.Prefix
+	Country   string
+	From      time.Time
+	To        time.Time
+	Status    *bool
+	Provider  string
+
+	// Ascending sorts the oldest lookups first, the default is newest first.
+	Ascending bool
+	Limit     int
+	Cursor    string
+}
+
+// HistoryPage is a page of recorded lookups. NextCursor is empty on the last page.
+type HistoryPage struct {
+	Items      []model.LookupRequest `json:"items"`
+	NextCursor string                `json:"next_cursor,omitempty"`
+}
+
+// ParseHistoryFilter builds a HistoryFilter from named parameters, such as the
+// query string of a request. The parameters are ip, cidr, country, from and to
+// (RFC 3339), status (success or failure), provider, sort (asc or desc),
+// limit and cursor. All invalid parameters are reported together.
+func ParseHistoryFilter(param func(key string) string) (HistoryFilter, error) {
+	var filter HistoryFilter
+	var problems []string
+
+	filter.IpAddress = param("ip")
+	if filter.IpAddress != "" {
+		if _, err := netip.ParseAddr(filter.IpAddress); err != nil {
+			problems = append(problems, fmt.Sprintf("ip %q is not a valid address", filter.IpAddress))
+		}
+	}
+
+	if v := param("cidr"); v != "" {
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cidr %q is not a valid network", v))
+		}
+		filter.CIDR = prefix.Masked()
+	}
+
+	filter.Country = strings.ToUpper(param("country"))
+	filter.Provider = param("provider")
+
+	for key, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := param(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s %q is not an RFC 3339 time", key, v))
+			}
+			*target = t.UTC()
+		}
+	}
+
+	switch v := param("status"); v {
+	case "":
+	case "success":
+		status := true
+		filter.Status = &status
+	case "failure":
+		status := false
+		filter.Status = &status
+	default:
+		problems = append(problems, fmt.Sprintf("status %q must be success or failure", v))
+	}
+
+	switch v := param("sort"); v {
+	case "", "desc":
+	case "asc":
+		filter.Ascending = true
+	default:
+		problems = append(problems, fmt.Sprintf("sort %q must be asc or desc", v))
+	}
+
+	if v := param("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			problems = append(problems, fmt.Sprintf("limit %q must be a positive number", v))
+		}
+		filter.Limit = limit
+	}
+
+	filter.Cursor = param("cursor")
+	if filter.Cursor != "" {
+		if _, _, err := decodeCursor(filter.Cursor); err != nil {
+			problems = append(problems, "cursor is not valid")
+		}
+	}
+
+	if len(problems) > 0 {
+		return filter, errors.New(strings.Join(problems, "; "))
+	}
+	return filter, nil
+}
+
+// QueryHistory returns a page of the recorded lookups matching the filter,
+// ordered by lookup time, with the geolocation of each lookup. Pass the
+// NextCursor of a page as the Cursor of the filter to get the next page.
+//
+// The ip address of the filter is matched in the form the StoragePrivacy stores
+// it in. Network blocks cannot be matched when the addresses are hashed.
+func QueryHistory(filter HistoryFilter) (HistoryPage, error) {
+	page := HistoryPage{Items: []model.LookupRequest{}}
+	if db == nil {
+		return page, nil
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if limit > maxHistoryLimit {
+		limit = maxHistoryLimit
+	}
+
+	query, err := historyQuery(filter)
+	if err != nil {
+		return page, err
+	}
+
+	// Fetch one more than the limit to know whether there is a next page
+	tx := query.Preload("GeoLocation").Limit(limit + 1).Find(&page.Items)
+	if tx.Error != nil {
+		return page, errors.New(tx.Error)
+	}
+
+	if len(page.Items) > limit {
+		page.Items = page.Items[:limit]
+		last := page.Items[limit-1]
+		page.NextCursor = encodeCursor(last.LookupTime, last.ID)
+	}
+	return page, nil
+}
+
+// historyQuery builds the filtered and ordered query over the recorded lookups,
+// starting after the cursor of the filter, if any.
+func historyQuery(filter HistoryFilter) (*gorm.DB, error) {
+	query := db.Model(&model.LookupRequest{})
+
+	if filter.IpAddress != "" {
+		query = query.Where("lookup_requests.ip_address IN ?", StoragePrivacy().StoredAddresses(filter.IpAddress))
+	}
+	if filter.CIDR.IsValid() {
+		first, last := prefixRange(filter.CIDR)
+		query = query.Where("lookup_requests.ip_bytes BETWEEN ? AND ?", first, last)
+	}
+	if filter.Country != "" {
+		query = query.
+			Joins("JOIN geo_locations ON geo_locations.id = lookup_requests.geo_location_id").
+			Where("geo_locations.country_code = ?", filter.Country)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("lookup_requests.lookup_time >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("lookup_requests.lookup_time < ?", filter.To)
+	}
+	if filter.Status != nil {
+		query = query.Where("lookup_requests.lookup_status = ?", *filter.Status)
+	}
+	if filter.Provider != "" {
+		query = query.Where("lookup_requests.provider = ?", filter.Provider)
+	}
+
+	direction, after := "DESC", "<"
+	if filter.Ascending {
+		direction, after = "ASC", ">"
+	}
+
+	if filter.Cursor != "" {
+		lookupTime, id, err := decodeCursor(filter.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		query = query.Where(
+			fmt.Sprintf("(lookup_requests.lookup_time %[1]s ? OR (lookup_requests.lookup_time = ? AND lookup_requests.id %[1]s ?))", after),
+			lookupTime, lookupTime, id)
+	}
+
+	return query.Order("lookup_requests.lookup_time " + direction).Order("lookup_requests.id " + direction), nil
+}
+
+// prefixRange returns the first and last address of the network block,
+// in the 16 byte form stored in the ip_bytes column.
+func prefixRange(prefix netip.Prefix) ([]byte, []byte) {
+	first := prefix.Masked().Addr().As16()
+	last := first
+
+	bits := prefix.Bits()
+	if prefix.Addr().Is4() {
+		bits += 96
+	}
+	for i := bits; i < 128; i++ {
+		last[i/8] |= 1 << (7 - i%8)
+	}
+	return first[:], last[:]
+}
+
+func encodeCursor(lookupTime time.Time, id uint) string {
+	raw := strconv.FormatInt(lookupTime.UnixNano(), 10) + ":" + strconv.FormatUint(uint64(id), 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (time.Time, uint, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return time.Time{}, 0, errors.New(err)
+	}
+	nanos, id, found := strings.Cut(string(raw), ":")
+	if !found {
+		return time.Time{}, 0, errors.New("malformed cursor")
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New(err)
+	}
+	i, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return time.Time{}, 0, errors.New(err)
+	}
+	// Times are stored in UTC, and compared as text by SQLite
+	return time.Unix(0, n).UTC(), uint(i), nil
+}
@@ -0,0 +1,197 @@
+package api
+
+import (
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestParseHistoryFilter(t *testing.T) {
+
+	query := url.Values{
+		"ip":      {"41.160.113.136"},
+		"cidr":    {"41.160.113.7/24"},
+		"country": {"za"},
+		"from":    {"2024-01-01T00:00:00Z"},
+		"status":  {"failure"},
+		"sort":    {"asc"},
+		"limit":   {"10"},
+	}
+	filter, err := ParseHistoryFilter(query.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.CIDR != netip.MustParsePrefix("41.160.113.0/24") {
+		t.Errorf("expected the network to be masked but got %s", filter.CIDR)
+	}
+	if filter.Country != "ZA" || filter.Status == nil || *filter.Status || !filter.Ascending || filter.Limit != 10 {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+
+	bad := url.Values{"ip": {"nope"}, "status": {"maybe"}, "limit": {"-1"}, "cursor": {"!"}}
+	if _, err := ParseHistoryFilter(bad.Get); err == nil {
+		t.Error("expected invalid parameters to be rejected")
+	}
+}
+
+func TestPrefixRange(t *testing.T) {
+
+	first, last := prefixRange(netip.MustParsePrefix("10.1.2.0/23"))
+	if ipBytes("10.1.2.0") == nil || string(first) != string(ipBytes("10.1.2.0")) || string(last) != string(ipBytes("10.1.3.255")) {
+		t.Errorf("unexpected range %v - %v", first, last)
+	}
+}
+
+func TestQueryHistory(t *testing.T) {
+
+	resetDatabase(t)
+
+	start := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	lookups := []struct {
+		ip      string
+		country string
+		ok      bool
+	}{
+		{"41.160.113.136", "ZA", true},
+		{"41.160.113.200", "ZA", true},
+		{"41.160.114.1", "ZA", false},
+		{"8.8.8.8", "US", true},
+		{"2001:db8::1", "NL", true},
+	}
+	for i, l := range lookups {
+		req := &model.LookupRequest{
+			IpAddress:    l.ip,
+			LookupTime:   start.Add(time.Duration(i) * time.Minute),
+			LookupStatus: l.ok,
+			Provider:     Provider,
+			CacheStatus:  "miss",
+		}
+		if l.ok {
+			req.GeoLocation = &model.GeoLocation{CountryCode: l.country}
+		}
+		if err := Record(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page, err := QueryHistory(HistoryFilter{CIDR: netip.MustParsePrefix("41.160.113.0/24")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || page.Items[0].IpAddress != "41.160.113.200" {
+		t.Errorf("expected the two lookups in the network, newest first, but got %+v", page.Items)
+	}
+	if page.Items[0].GeoLocation == nil || page.Items[0].GeoLocation.CountryCode != "ZA" {
+		t.Error("expected the geolocation to be loaded with the lookup")
+	}
+
+	page, err = QueryHistory(HistoryFilter{Country: "US"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].IpAddress != "8.8.8.8" {
+		t.Errorf("expected the lookup in the US but got %+v", page.Items)
+	}
+
+	failed := false
+	page, err = QueryHistory(HistoryFilter{Status: &failed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].IpAddress != "41.160.114.1" {
+		t.Errorf("expected the failed lookup but got %+v", page.Items)
+	}
+
+	page, err = QueryHistory(HistoryFilter{From: start.Add(3 * time.Minute)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 {
+		t.Errorf("expected the two latest lookups but got %+v", page.Items)
+	}
+
+	// Page through all lookups two at a time, oldest first
+	var seen []string
+	filter := HistoryFilter{Ascending: true, Limit: 2}
+	for {
+		page, err := QueryHistory(filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range page.Items {
+			seen = append(seen, item.IpAddress)
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		filter.Cursor = page.NextCursor
+	}
+	if len(seen) != len(lookups) {
+		t.Fatalf("expected %d lookups over all pages but got %v", len(lookups), seen)
+	}
+	for i, l := range lookups {
+		if seen[i] != l.ip {
+			t.Errorf("expected %s at position %d but got %s", l.ip, i, seen[i])
+		}
+	}
+}
+
+func TestQueryHistoryOutsideUTC(t *testing.T) {
+
+	// SQLite compares the stored times as text, so the times written, filtered
+	// on and carried by the cursor must all be in UTC
+	local := time.Local
+	time.Local = time.FixedZone("EST", -5*60*60)
+	t.Cleanup(func() { time.Local = local })
+	resetDatabase(t)
+
+	start := time.Date(2024, 5, 1, 22, 0, 0, 0, time.Local)
+	for i := 0; i < 4; i++ {
+		req := &model.LookupRequest{
+			IpAddress:  "41.160.113.136",
+			LookupTime: start.Add(time.Duration(i) * time.Hour),
+			Provider:   Provider,
+		}
+		if err := Record(req); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, ascending := range []bool{true, false} {
+		seen := 0
+		filter := HistoryFilter{Ascending: ascending, Limit: 1}
+		for pages := 0; ; pages++ {
+			if pages > 4 {
+				t.Fatalf("expected paging with ascending %t to end after 4 pages", ascending)
+			}
+			page, err := QueryHistory(filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			seen += len(page.Items)
+			if page.NextCursor == "" {
+				break
+			}
+			filter.Cursor = page.NextCursor
+		}
+		if seen != 4 {
+			t.Errorf("expected 4 lookups paging with ascending %t but got %d", ascending, seen)
+		}
+	}
+
+	// The third lookup was made at midnight EST, 03:00 at an offset of -02:00
+	filter, err := ParseHistoryFilter(url.Values{"from": {"2024-05-02T03:00:00-02:00"}}.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, err := QueryHistory(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 {
+		t.Errorf("expected the two lookups from the third on but got %+v", page.Items)
+	}
+}
@@ -0,0 +1,193 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redacted replaces the value of a sensitive attribute in the logs.
+const redacted = "[redacted]"
+
+// sensitiveKeys are the attributes never written to the logs as they are.
+// The connection strings are logged with their password removed, see RedactDSN.
+var sensitiveKeys = map[string]bool{
+	"authorization": true,
+	"api_key":       true,
+	"hmac_keys":     true,
+	"password":      true,
+	"secret":        true,
+	"token":         true,
+}
+
+var connectionKeys = map[string]bool{
+	"connection": true,
+	"dsn":        true,
+}
+
+// dsnPassword matches the password of a key/value connection string, quoted or not.
+var dsnPassword = regexp.MustCompile(`(?i)(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactDSN returns the connection string without its password, as a URL or as
+// key/value pairs.
+func RedactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.User != nil {
+		return u.Redacted()
+	}
+	return dsnPassword.ReplaceAllString(dsn, "${1}"+redacted)
+}
+
+// logLevel is the lowest level logged, set by ConfigureLogging.
+var logLevel slog.LevelVar
+
+// logSampling holds the sampling of the logs, set by ConfigureLogging.
+var logSampling struct {
+	initial    atomic.Int64
+	thereafter atomic.Int64
+}
+
+// ConfigureLogging applies the level and the sampling of the logs written
+// through LogHandler. It is called again when the configuration is reloaded.
+func ConfigureLogging(cfg config.LogConfig) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+	logLevel.Set(level)
+	logSampling.initial.Store(int64(cfg.SampleInitial))
+	logSampling.thereafter.Store(int64(cfg.SampleThereafter))
+}
+
+// RequestIDHeader carries the id of a request, received from the caller or
+// generated, returned with the response and sent with the upstream lookups.
+const RequestIDHeader = "X-Request-ID"
+
+type requestIDKey struct{}
+
+// WithRequestID returns ctx carrying the id correlating the log lines written
+// while handling a request.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the id of the request handled with ctx, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// LogHandler wraps the handler writing the logs. Records below the configured
+// level are dropped and the debug and info records sampled; sensitive attributes
+// are redacted; and the request_id, trace_id and span_id found in the context
+// of a record are added, so that log lines can be matched with a request and
+// its trace.
+func LogHandler(handler slog.Handler) slog.Handler {
+	return logHandler{handler: handler, sampler: &logSampler{}}
+}
+
+type logHandler struct {
+	handler slog.Handler
+	sampler *logSampler
+}
+
+func (h logHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return level >= logLevel.Level() && h.handler.Enabled(ctx, level)
+}
+
+func (h logHandler) Handle(ctx context.Context, record slog.Record) error {
+	if record.Level < slog.LevelWarn && !h.sampler.keep(record.Level, record.Message, record.Time) {
+		return nil
+	}
+
+	out := slog.NewRecord(record.Time, record.Level, record.Message, record.PC)
+	record.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redact(a))
+		return true
+	})
+	if id := RequestID(ctx); id != "" {
+		out.AddAttrs(slog.String("request_id", id))
+	}
+	if span := trace.SpanContextFromContext(ctx); span.IsValid() {
+		out.AddAttrs(
+			slog.String("trace_id", span.TraceID().String()),
+			slog.String("span_id", span.SpanID().String()),
+		)
+	}
+	return h.handler.Handle(ctx, out)
+}
+
+func (h logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	safe := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		safe[i] = redact(a)
+	}
+	return logHandler{handler: h.handler.WithAttrs(safe), sampler: h.sampler}
+}
+
+func (h logHandler) WithGroup(name string) slog.Handler {
+	return logHandler{handler: h.handler.WithGroup(name), sampler: h.sampler}
+}
+
+// redact returns the attribute with the values of sensitive keys redacted,
+// looking into groups.
+func redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	key := strings.ToLower(a.Key)
+	switch {
+	case a.Value.Kind() == slog.KindGroup:
+		attrs := a.Value.Group()
+		safe := make([]slog.Attr, len(attrs))
+		for i, attr := range attrs {
+			safe[i] = redact(attr)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(safe...)}
+	case connectionKeys[key]:
+		return slog.String(a.Key, RedactDSN(a.Value.String()))
+	case sensitiveKeys[key]:
+		return slog.String(a.Key, redacted)
+	}
+	return a
+}
+
+// logSampler keeps, for each level and message, the first records of every
+// second and one in so many of the following ones.
+type logSampler struct {
+	mu     sync.Mutex
+	second int64
+	counts map[sampleKey]int64
+}
+
+type sampleKey struct {
+	level   slog.Level
+	message string
+}
+
+func (s *logSampler) keep(level slog.Level, message string, at time.Time) bool {
+	initial := logSampling.initial.Load()
+	if initial <= 0 {
+		return true
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if second := at.Unix(); second != s.second || s.counts == nil {
+		s.second = second
+		s.counts = make(map[sampleKey]int64)
+	}
+	key := sampleKey{level: level, message: message}
+	s.counts[key]++
+	n := s.counts[key]
+	if n <= initial {
+		return true
+	}
+	thereafter := logSampling.thereafter.Load()
+	return thereafter <= 1 || (n-initial)%thereafter == 0
+}
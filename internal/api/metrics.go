@@ -0,0 +1,128 @@
+package api
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// MetricsRegistry holds the Prometheus metrics of the service, served on /metrics.
+var MetricsRegistry = prometheus.NewRegistry()
+
+var (
+	providerDuration = promauto.With(MetricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "brgeo_provider_request_duration_seconds",
+		Help:    "Duration of upstream lookups, retries included, by provider and outcome.",
+		Buckets: []float64{.05, .1, .25, .5, 1, 2.5, 5, 10, 20},
+	}, []string{"provider", "outcome"})
+
+	providerRetries = promauto.With(MetricsRegistry).NewCounterVec(prometheus.CounterOpts{
+		Name: "brgeo_provider_retries_total",
+		Help: "Upstream lookup attempts retried after a failure, by provider.",
+	}, []string{"provider"})
+
+	providerBackoff = promauto.With(MetricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "brgeo_provider_backoff_seconds",
+		Help:    "Time waited before retrying an upstream lookup, by provider.",
+		Buckets: []float64{.5, 1, 2, 4, 8, 16},
+	}, []string{"provider"})
+
+	dbWriteDuration = promauto.With(MetricsRegistry).NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "brgeo_db_write_duration_seconds",
+		Help:    "Duration of the transactions recording lookups, by operation (lookup or batch) and outcome.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "outcome"})
+)
+
+var (
+	cacheEntriesDesc = prometheus.NewDesc("brgeo_cache_entries",
+		"Entries in the lookup cache, expired ones included until they are removed.", nil, nil)
+	cacheEvictionsDesc = prometheus.NewDesc("brgeo_cache_evictions_total",
+		"Entries evicted from the bounded cache to respect its limits.", nil, nil)
+	cacheExpirationsDesc = prometheus.NewDesc("brgeo_cache_expirations_total",
+		"Entries removed from the bounded cache after their hard timeout.", nil, nil)
+	tierDesc = prometheus.NewDesc("brgeo_lookups_answered_total",
+		"Lookups answered, by the tier that answered them.", []string{"tier"}, nil)
+	recorderQueuedDesc = prometheus.NewDesc("brgeo_recorder_queued",
+		"Lookups queued for recording.", nil, nil)
+	recorderLookupsDesc = prometheus.NewDesc("brgeo_recorder_lookups_total",
+		"Lookups handled by the recorder, by outcome: recorded, dropped or failed.", []string{"outcome"}, nil)
+	recorderBatchesDesc = prometheus.NewDesc("brgeo_recorder_batches_total",
+		"Batch writes of the recorder, by outcome: retried, or failed when the batch was dropped.", []string{"outcome"}, nil)
+	retentionPurgedDesc = prometheus.NewDesc("brgeo_retention_purged_total",
+		"Recorded lookups purged by the retention job, by reason: age or rows.", []string{"reason"}, nil)
+)
+
+func init() {
+	MetricsRegistry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		statsCollector{},
+	)
+}
+
+// statsCollector exposes the counters the package already keeps for its
+// JSON statistics endpoints, read when the metrics are scraped.
+type statsCollector struct{}
+
+func (statsCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range []*prometheus.Desc{
+		cacheEntriesDesc, cacheEvictionsDesc, cacheExpirationsDesc, tierDesc,
+		recorderQueuedDesc, recorderLookupsDesc, recorderBatchesDesc, retentionPurgedDesc,
+	} {
+		ch <- desc
+	}
+}
+
+func (statsCollector) Collect(ch chan<- prometheus.Metric) {
+	if Cache != nil {
+		ch <- prometheus.MustNewConstMetric(cacheEntriesDesc, prometheus.GaugeValue, float64(Cache.ItemCount()))
+	}
+	var bounded BoundedCacheStats
+	if b, ok := Cache.(*BoundedCache); ok {
+		bounded = b.Stats()
+	}
+	ch <- prometheus.MustNewConstMetric(cacheEvictionsDesc, prometheus.CounterValue, float64(bounded.Evictions))
+	ch <- prometheus.MustNewConstMetric(cacheExpirationsDesc, prometheus.CounterValue, float64(bounded.Expirations))
+
+	tiers := GetTierStats()
+	ch <- prometheus.MustNewConstMetric(tierDesc, prometheus.CounterValue, float64(tiers.Memory), string(TierMemory))
+	ch <- prometheus.MustNewConstMetric(tierDesc, prometheus.CounterValue, float64(tiers.Database), string(TierDatabase))
+	ch <- prometheus.MustNewConstMetric(tierDesc, prometheus.CounterValue, float64(tiers.Provider), string(TierProvider))
+
+	if recorder, ok := GetRecorderStats(); ok {
+		ch <- prometheus.MustNewConstMetric(recorderQueuedDesc, prometheus.GaugeValue, float64(recorder.Queued))
+		ch <- prometheus.MustNewConstMetric(recorderLookupsDesc, prometheus.CounterValue, float64(recorder.Recorded), "recorded")
+		ch <- prometheus.MustNewConstMetric(recorderLookupsDesc, prometheus.CounterValue, float64(recorder.Dropped), "dropped")
+		ch <- prometheus.MustNewConstMetric(recorderLookupsDesc, prometheus.CounterValue, float64(recorder.Failed), "failed")
+		ch <- prometheus.MustNewConstMetric(recorderBatchesDesc, prometheus.CounterValue, float64(recorder.Retries), "retried")
+		ch <- prometheus.MustNewConstMetric(recorderBatchesDesc, prometheus.CounterValue, float64(recorder.FailedBatches), "failed")
+	}
+
+	retention := GetRetentionStats()
+	ch <- prometheus.MustNewConstMetric(retentionPurgedDesc, prometheus.CounterValue, float64(retention.PurgedByAge), "age")
+	ch <- prometheus.MustNewConstMetric(retentionPurgedDesc, prometheus.CounterValue, float64(retention.PurgedByRows), "rows")
+}
+
+// observeProviderCall records the duration, outcome and retries of an upstream lookup.
+func observeProviderCall(duration time.Duration, retries int, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = ErrorCode(err)
+	}
+	providerDuration.WithLabelValues(Provider, outcome).Observe(duration.Seconds())
+	if retries > 0 {
+		providerRetries.WithLabelValues(Provider).Add(float64(retries))
+	}
+}
+
+// observeDBWrite records the duration and outcome of a transaction recording lookups.
+func observeDBWrite(operation string, start time.Time, err error) {
+	outcome := "success"
+	if err != nil {
+		outcome = "error"
+	}
+	dbWriteDuration.WithLabelValues(operation, outcome).Observe(time.Since(start).Seconds())
+}
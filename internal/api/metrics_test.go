@@ -0,0 +1,83 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// gather returns the metric families of the registry by name.
+func gather(t *testing.T) map[string]*dto.MetricFamily {
+	t.Helper()
+	families, err := MetricsRegistry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := make(map[string]*dto.MetricFamily, len(families))
+	for _, family := range families {
+		byName[family.GetName()] = family
+	}
+	return byName
+}
+
+// labelled returns the metric of the family with the label set to value.
+func labelled(family *dto.MetricFamily, label, value string) *dto.Metric {
+	for _, metric := range family.GetMetric() {
+		for _, pair := range metric.GetLabel() {
+			if pair.GetName() == label && pair.GetValue() == value {
+				return metric
+			}
+		}
+	}
+	return nil
+}
+
+func TestMetricsExposeStatistics(t *testing.T) {
+
+	families := gather(t)
+	for _, name := range []string{
+		"brgeo_cache_entries",
+		"brgeo_cache_evictions_total",
+		"brgeo_lookups_answered_total",
+		"brgeo_retention_purged_total",
+		"go_goroutines",
+	} {
+		if _, ok := families[name]; !ok {
+			t.Errorf("expected metric %s to be exposed", name)
+		}
+	}
+
+	before := GetTierStats().Provider
+	CountTier(TierProvider)
+	tiers := gather(t)["brgeo_lookups_answered_total"]
+	metric := labelled(tiers, "tier", string(TierProvider))
+	if metric == nil || metric.GetCounter().GetValue() != float64(before+1) {
+		t.Errorf("expected %d lookups answered by the provider but got %v", before+1, metric)
+	}
+}
+
+func TestObserveProviderCall(t *testing.T) {
+
+	observeProviderCall(20*time.Millisecond, 2, ErrUpstream)
+
+	families := gather(t)
+	duration := labelled(families["brgeo_provider_request_duration_seconds"], "outcome", ErrorCode(ErrUpstream))
+	if duration == nil || duration.GetHistogram().GetSampleCount() == 0 {
+		t.Errorf("expected the failed call to be observed but got %v", duration)
+	}
+	retries := labelled(families["brgeo_provider_retries_total"], "provider", Provider)
+	if retries == nil || retries.GetCounter().GetValue() < 2 {
+		t.Errorf("expected the retries to be counted but got %v", retries)
+	}
+}
+
+func TestObserveDBWrite(t *testing.T) {
+
+	observeDBWrite("lookup", time.Now(), nil)
+
+	writes := labelled(gather(t)["brgeo_db_write_duration_seconds"], "operation", "lookup")
+	if writes == nil || writes.GetHistogram().GetSampleCount() == 0 {
+		t.Errorf("expected the write to be observed but got %v", writes)
+	}
+}
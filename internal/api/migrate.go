@@ -0,0 +1,305 @@
+package api
+
+import (
+	"embed"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"gorm.io/gorm"
+)
+
+// migrationFiles holds the versioned schema migrations, one directory per
+// driver. Each migration is a pair of NNNN_name.up.sql and NNNN_name.down.sql files.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+// Migration is a single versioned schema change with its rollback.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// SchemaMigration is a row of the schema_migrations table, recording an applied migration.
+type SchemaMigration struct {
+	Version   int       `json:"version" gorm:"primaryKey;autoIncrement:false"`
+	Name      string    `json:"name"`
+	AppliedAt time.Time `json:"applied_at"`
+}
+
+const createSchemaMigrations = `CREATE TABLE IF NOT EXISTS schema_migrations (
+    version    INTEGER PRIMARY KEY,
+    name       VARCHAR(255) NOT NULL,
+    applied_at TIMESTAMP NOT NULL
+)`
+
+// Migrations returns the migrations embedded for the database driver, ordered by version.
+func Migrations(driver string) ([]Migration, error) {
+	dir := path.Join("migrations", driver)
+	entries, err := fs.ReadDir(migrationFiles, dir)
+	if err != nil {
+		return nil, errors.Errorf("no migrations for driver %q", driver)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		name := entry.Name()
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		number, label, found := strings.Cut(base, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || !found || err != nil || (direction != "up" && direction != "down") {
+			return nil, errors.Errorf("invalid migration file name %q", name)
+		}
+
+		content, err := migrationFiles.ReadFile(path.Join(dir, name))
+		if err != nil {
+			return nil, errors.New(err)
+		}
+
+		m, exists := byVersion[version]
+		if !exists {
+			m = &Migration{Version: version, Name: label}
+			byVersion[version] = m
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, errors.Errorf("migration %04d_%s needs both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// LatestSchemaVersion returns the version of the newest migration known to
+// this build for the database driver.
+func LatestSchemaVersion(driver string) (int, error) {
+	migrations, err := Migrations(driver)
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// SchemaVersion returns the version of the newest migration applied to the
+// database, or 0 when no migration was applied yet.
+func SchemaVersion() (int, error) {
+	if db == nil {
+		return 0, errors.New("database is disabled")
+	}
+	if err := db.Exec(createSchemaMigrations).Error; err != nil {
+		return 0, errors.New(err)
+	}
+
+	var versions []int
+	err := db.Model(&SchemaMigration{}).Order("version desc").Limit(1).Pluck("version", &versions).Error
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	if len(versions) == 0 {
+		return 0, nil
+	}
+	return versions[0], nil
+}
+
+// CheckSchemaVersion refuses to run against a database whose schema was
+// migrated by a newer build, which this build does not know how to use.
+func CheckSchemaVersion() error {
+	current, err := SchemaVersion()
+	if err != nil {
+		return err
+	}
+	latest, err := LatestSchemaVersion(dbDriver)
+	if err != nil {
+		return err
+	}
+	if current > latest {
+		return errors.Errorf("database schema version %d is newer than version %d supported by this build", current, latest)
+	}
+	return nil
+}
+
+// migrationBackfills fill in, by migration version, the data the SQL of the
+// migration cannot compute, in the transaction of the migration.
+var migrationBackfills = map[int]func(tx *gorm.DB) error{
+	2: backfillIpBytes,
+}
+
+// backfillIpBytes fills in the ip_bytes column added by the history migration
+// for the lookups recorded before it, so that the network block filters find
+// them too. Addresses stored hashed have no byte form and are left without.
+func backfillIpBytes(tx *gorm.DB) error {
+	var lastID uint
+	for {
+		var rows []struct {
+			ID        uint
+			IpAddress string
+		}
+		err := tx.Table("lookup_requests").Select("id", "ip_address").
+			Where("ip_bytes IS NULL AND id > ?", lastID).
+			Order("id").Limit(purgeBatchSize).
+			Find(&rows).Error
+		if err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			b := ipBytes(row.IpAddress)
+			if b == nil {
+				continue
+			}
+			if err := tx.Table("lookup_requests").Where("id = ?", row.ID).Update("ip_bytes", b).Error; err != nil {
+				return err
+			}
+		}
+		if len(rows) < purgeBatchSize {
+			return nil
+		}
+		lastID = rows[len(rows)-1].ID
+	}
+}
+
+// MigrateUp applies up to steps pending migrations, or all of them when steps
+// is 0 or less, and returns the number applied. Each migration runs in its
+// own transaction together with its schema_migrations row.
+func MigrateUp(steps int) (int, error) {
+	current, err := SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	migrations, err := Migrations(dbDriver)
+	if err != nil {
+		return 0, err
+	}
+
+	applied := 0
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+		if steps > 0 && applied == steps {
+			break
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := execStatements(tx, m.Up); err != nil {
+				return err
+			}
+			if backfill := migrationBackfills[m.Version]; backfill != nil {
+				if err := backfill(tx); err != nil {
+					return err
+				}
+			}
+			return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+		})
+		if err != nil {
+			return applied, errors.New(fmt.Errorf("migration %04d_%s up: %w", m.Version, m.Name, err))
+		}
+		slog.Info("Applied migration", "version", m.Version, "name", m.Name)
+		applied++
+	}
+	return applied, nil
+}
+
+// MigrateDown rolls back up to steps applied migrations, newest first, and
+// returns the number rolled back. A steps of 0 or less rolls back one migration.
+func MigrateDown(steps int) (int, error) {
+	if steps <= 0 {
+		steps = 1
+	}
+	current, err := SchemaVersion()
+	if err != nil {
+		return 0, err
+	}
+	migrations, err := Migrations(dbDriver)
+	if err != nil {
+		return 0, err
+	}
+
+	rolledBack := 0
+	for i := len(migrations) - 1; i >= 0 && rolledBack < steps; i-- {
+		m := migrations[i]
+		if m.Version > current {
+			continue
+		}
+
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := execStatements(tx, m.Down); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{}, m.Version).Error
+		})
+		if err != nil {
+			return rolledBack, errors.New(fmt.Errorf("migration %04d_%s down: %w", m.Version, m.Name, err))
+		}
+		slog.Info("Rolled back migration", "version", m.Version, "name", m.Name)
+		rolledBack++
+	}
+	return rolledBack, nil
+}
+
+// AppliedMigrations returns the migrations recorded in the schema_migrations table.
+func AppliedMigrations() ([]SchemaMigration, error) {
+	if _, err := SchemaVersion(); err != nil {
+		return nil, err
+	}
+
+	var applied []SchemaMigration
+	if err := db.Order("version").Find(&applied).Error; err != nil {
+		return nil, errors.New(err)
+	}
+	return applied, nil
+}
+
+// execStatements runs the statements of a migration one by one, as not every
+// driver accepts several statements in a single call. Statements are separated
+// by a semicolon at the end of a line; lines starting with -- are comments.
+func execStatements(tx *gorm.DB, script string) error {
+	var statement strings.Builder
+	for _, line := range strings.Split(script, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "--") {
+			continue
+		}
+		statement.WriteString(line)
+		statement.WriteString("\n")
+
+		if strings.HasSuffix(trimmed, ";") {
+			if err := tx.Exec(statement.String()).Error; err != nil {
+				return err
+			}
+			statement.Reset()
+		}
+	}
+	if strings.TrimSpace(statement.String()) != "" {
+		return tx.Exec(statement.String()).Error
+	}
+	return nil
+}
+
+// TableName places SchemaMigration rows in the schema_migrations table.
+func (SchemaMigration) TableName() string {
+	return "schema_migrations"
+}
@@ -0,0 +1,112 @@
+package api
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestMigrationsExistForEveryDriver(t *testing.T) {
+
+	postgresMigrations, err := Migrations(DriverPostgres)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sqliteMigrations, err := Migrations(DriverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(postgresMigrations) != len(sqliteMigrations) {
+		t.Fatalf("postgres has %d migrations but sqlite has %d", len(postgresMigrations), len(sqliteMigrations))
+	}
+	for i := range postgresMigrations {
+		if postgresMigrations[i].Version != sqliteMigrations[i].Version || postgresMigrations[i].Name != sqliteMigrations[i].Name {
+			t.Errorf("migration %d differs: %04d_%s and %04d_%s", i,
+				postgresMigrations[i].Version, postgresMigrations[i].Name,
+				sqliteMigrations[i].Version, sqliteMigrations[i].Name)
+		}
+	}
+}
+
+func TestMigrateDownAndUp(t *testing.T) {
+
+	latest, err := LatestSchemaVersion(DriverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current, _ := SchemaVersion(); current != latest {
+		t.Fatalf("expected schema version %d but got %d", latest, current)
+	}
+
+	rolledBack, err := MigrateDown(latest)
+	if err != nil || rolledBack != latest {
+		t.Fatalf("expected %d migrations rolled back, got %d (%v)", latest, rolledBack, err)
+	}
+	if db.Migrator().HasTable("lookup_requests") {
+		t.Error("lookup_requests should have been dropped")
+	}
+
+	applied, err := MigrateUp(0)
+	if err != nil || applied != latest {
+		t.Fatalf("expected %d migrations applied, got %d (%v)", latest, applied, err)
+	}
+	if current, _ := SchemaVersion(); current != latest {
+		t.Errorf("expected schema version %d but got %d", latest, current)
+	}
+}
+
+func TestCheckSchemaVersionRefusesNewerSchema(t *testing.T) {
+
+	latest, err := LatestSchemaVersion(DriverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newer := SchemaMigration{Version: latest + 1, Name: "from_the_future", AppliedAt: time.Now()}
+	if err := db.Create(&newer).Error; err != nil {
+		t.Fatal(err)
+	}
+	defer db.Delete(&newer)
+
+	if err := CheckSchemaVersion(); err == nil {
+		t.Error("a newer schema should be refused")
+	}
+}
+
+func TestHistoryMigrationBackfillsIpBytes(t *testing.T) {
+
+	resetDatabase(t)
+	latest, err := LatestSchemaVersion(DriverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := MigrateDown(latest - 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// Lookups recorded before the history migration have no ip_bytes column
+	for _, ip := range []string{"41.160.113.136", "2001:db8::1", "hmac:k1:0123abcd"} {
+		if err := db.Exec("INSERT INTO lookup_requests (ip_address, lookup_time) VALUES (?, ?)", ip, time.Now().UTC()).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := MigrateUp(0); err != nil {
+		t.Fatal(err)
+	}
+
+	page, err := QueryHistory(HistoryFilter{CIDR: netip.MustParsePrefix("41.160.113.0/24")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 1 || page.Items[0].IpAddress != "41.160.113.136" {
+		t.Errorf("expected the lookup recorded before the migration to be found by network but got %+v", page.Items)
+	}
+	var missing int64
+	db.Model(&model.LookupRequest{}).Where("ip_bytes IS NULL").Count(&missing)
+	if missing != 1 {
+		t.Errorf("expected only the hashed address to be left without bytes but got %d", missing)
+	}
+}
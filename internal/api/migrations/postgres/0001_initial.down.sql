@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS lookup_requests;
+DROP TABLE IF EXISTS geo_locations;
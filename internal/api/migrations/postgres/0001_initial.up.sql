@@ -0,0 +1,39 @@
+CREATE TABLE IF NOT EXISTS geo_locations (
+    id             BIGSERIAL PRIMARY KEY,
+    ip_address     VARCHAR(64) NOT NULL,
+    rdns           TEXT,
+    isp            TEXT,
+    country_name   TEXT,
+    country_code   VARCHAR(2),
+    region_name    TEXT,
+    region_code    TEXT,
+    city           TEXT,
+    postal_code    TEXT,
+    continent_name TEXT,
+    continent_code VARCHAR(2),
+    latitude       DOUBLE PRECISION,
+    longitude      DOUBLE PRECISION,
+    timezone       TEXT,
+    updated_at     TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_geo_locations_ip_address ON geo_locations (ip_address);
+
+CREATE TABLE IF NOT EXISTS lookup_requests (
+    ip_address    VARCHAR(64),
+    lookup_time   TIMESTAMPTZ,
+    lookup_status BOOLEAN
+);
+
+-- Tables created by AutoMigrate before versioned migrations may lack the columns below
+ALTER TABLE lookup_requests ADD COLUMN IF NOT EXISTS id BIGSERIAL PRIMARY KEY;
+ALTER TABLE lookup_requests ADD COLUMN IF NOT EXISTS provider VARCHAR(32);
+ALTER TABLE lookup_requests ADD COLUMN IF NOT EXISTS latency_ms BIGINT;
+ALTER TABLE lookup_requests ADD COLUMN IF NOT EXISTS retries BIGINT;
+ALTER TABLE lookup_requests ADD COLUMN IF NOT EXISTS cache_status VARCHAR(16);
+ALTER TABLE lookup_requests ADD COLUMN IF NOT EXISTS error_code VARCHAR(32);
+ALTER TABLE lookup_requests ADD COLUMN IF NOT EXISTS geo_location_id BIGINT REFERENCES geo_locations (id);
+
+CREATE INDEX IF NOT EXISTS idx_lookup_requests_ip_address ON lookup_requests (ip_address);
+CREATE INDEX IF NOT EXISTS idx_lookup_requests_lookup_time ON lookup_requests (lookup_time);
+CREATE INDEX IF NOT EXISTS idx_lookup_requests_geo_location_id ON lookup_requests (geo_location_id);
@@ -0,0 +1,8 @@
+CREATE INDEX IF NOT EXISTS idx_lookup_requests_lookup_time ON lookup_requests (lookup_time);
+
+DROP INDEX IF EXISTS idx_geo_locations_country_code;
+DROP INDEX IF EXISTS idx_lookup_requests_provider;
+DROP INDEX IF EXISTS idx_lookup_requests_lookup_time_id;
+DROP INDEX IF EXISTS idx_lookup_requests_ip_bytes;
+
+ALTER TABLE lookup_requests DROP COLUMN ip_bytes;
@@ -0,0 +1,27 @@
+-- Hourly lookup counts per dimension, kept up to date as lookups are recorded
+CREATE TABLE IF NOT EXISTS lookup_rollups (
+    id            BIGSERIAL PRIMARY KEY,
+    bucket        TIMESTAMPTZ NOT NULL,
+    provider      VARCHAR(32) NOT NULL DEFAULT '',
+    cache_status  VARCHAR(16) NOT NULL DEFAULT '',
+    lookup_status BOOLEAN NOT NULL DEFAULT FALSE,
+    error_code    VARCHAR(32) NOT NULL DEFAULT '',
+    country_code  VARCHAR(2) NOT NULL DEFAULT '',
+    city          TEXT NOT NULL DEFAULT '',
+    isp           TEXT NOT NULL DEFAULT '',
+    lookups       BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_lookup_rollups_key
+    ON lookup_rollups (bucket, provider, cache_status, lookup_status, error_code, country_code, city, isp);
+
+-- Roll up the lookups recorded before this migration
+INSERT INTO lookup_rollups (bucket, provider, cache_status, lookup_status, error_code, country_code, city, isp, lookups)
+SELECT date_trunc('hour', r.lookup_time AT TIME ZONE 'UTC') AT TIME ZONE 'UTC',
+       COALESCE(r.provider, ''), COALESCE(r.cache_status, ''), COALESCE(r.lookup_status, FALSE),
+       COALESCE(r.error_code, ''), COALESCE(g.country_code, ''), COALESCE(g.city, ''), COALESCE(g.isp, ''),
+       COUNT(*)
+FROM lookup_requests r
+LEFT JOIN geo_locations g ON g.id = r.geo_location_id
+WHERE r.lookup_time IS NOT NULL
+GROUP BY 1, 2, 3, 4, 5, 6, 7, 8;
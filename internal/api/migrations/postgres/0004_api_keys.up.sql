@@ -0,0 +1,23 @@
+-- API keys, stored as a hash of the key, and their daily usage
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           BIGSERIAL PRIMARY KEY,
+    name         TEXT NOT NULL DEFAULT '',
+    prefix       VARCHAR(16) NOT NULL DEFAULT '',
+    hash         VARCHAR(64) NOT NULL,
+    scopes       TEXT NOT NULL DEFAULT '',
+    rate_limit   INTEGER NOT NULL DEFAULT 0,
+    daily_quota  BIGINT NOT NULL DEFAULT 0,
+    created_at   TIMESTAMPTZ,
+    last_used_at TIMESTAMPTZ,
+    revoked_at   TIMESTAMPTZ
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys (hash);
+
+CREATE TABLE IF NOT EXISTS api_key_usages (
+    api_key_id BIGINT NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE,
+    day        TIMESTAMPTZ NOT NULL,
+    requests   BIGINT NOT NULL DEFAULT 0,
+    rejected   BIGINT NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, day)
+);
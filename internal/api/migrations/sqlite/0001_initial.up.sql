@@ -0,0 +1,37 @@
+CREATE TABLE IF NOT EXISTS geo_locations (
+    id             INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip_address     TEXT NOT NULL,
+    rdns           TEXT,
+    isp            TEXT,
+    country_name   TEXT,
+    country_code   TEXT,
+    region_name    TEXT,
+    region_code    TEXT,
+    city           TEXT,
+    postal_code    TEXT,
+    continent_name TEXT,
+    continent_code TEXT,
+    latitude       REAL,
+    longitude      REAL,
+    timezone       TEXT,
+    updated_at     DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_geo_locations_ip_address ON geo_locations (ip_address);
+
+CREATE TABLE IF NOT EXISTS lookup_requests (
+    id              INTEGER PRIMARY KEY AUTOINCREMENT,
+    ip_address      TEXT,
+    lookup_time     DATETIME,
+    lookup_status   NUMERIC,
+    provider        TEXT,
+    latency_ms      INTEGER,
+    retries         INTEGER,
+    cache_status    TEXT,
+    error_code      TEXT,
+    geo_location_id INTEGER REFERENCES geo_locations (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_lookup_requests_ip_address ON lookup_requests (ip_address);
+CREATE INDEX IF NOT EXISTS idx_lookup_requests_lookup_time ON lookup_requests (lookup_time);
+CREATE INDEX IF NOT EXISTS idx_lookup_requests_geo_location_id ON lookup_requests (geo_location_id);
@@ -0,0 +1,9 @@
+-- Addresses as 16 bytes (IPv4 mapped into IPv6), so network blocks can be queried as a range
+ALTER TABLE lookup_requests ADD COLUMN ip_bytes BLOB;
+
+CREATE INDEX idx_lookup_requests_ip_bytes ON lookup_requests (ip_bytes);
+CREATE INDEX idx_lookup_requests_lookup_time_id ON lookup_requests (lookup_time, id);
+CREATE INDEX idx_lookup_requests_provider ON lookup_requests (provider);
+CREATE INDEX idx_geo_locations_country_code ON geo_locations (country_code);
+
+DROP INDEX IF EXISTS idx_lookup_requests_lookup_time;
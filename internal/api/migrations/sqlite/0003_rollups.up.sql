@@ -0,0 +1,28 @@
+-- Hourly lookup counts per dimension, kept up to date as lookups are recorded
+CREATE TABLE IF NOT EXISTS lookup_rollups (
+    id            INTEGER PRIMARY KEY AUTOINCREMENT,
+    bucket        DATETIME NOT NULL,
+    provider      TEXT NOT NULL DEFAULT '',
+    cache_status  TEXT NOT NULL DEFAULT '',
+    lookup_status NUMERIC NOT NULL DEFAULT 0,
+    error_code    TEXT NOT NULL DEFAULT '',
+    country_code  TEXT NOT NULL DEFAULT '',
+    city          TEXT NOT NULL DEFAULT '',
+    isp           TEXT NOT NULL DEFAULT '',
+    lookups       INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_lookup_rollups_key
+    ON lookup_rollups (bucket, provider, cache_status, lookup_status, error_code, country_code, city, isp);
+
+-- Roll up the lookups recorded before this migration, with buckets in the
+-- format the driver writes times in
+INSERT INTO lookup_rollups (bucket, provider, cache_status, lookup_status, error_code, country_code, city, isp, lookups)
+SELECT strftime('%Y-%m-%d %H:00:00+00:00', r.lookup_time),
+       COALESCE(r.provider, ''), COALESCE(r.cache_status, ''), COALESCE(r.lookup_status, 0),
+       COALESCE(r.error_code, ''), COALESCE(g.country_code, ''), COALESCE(g.city, ''), COALESCE(g.isp, ''),
+       COUNT(*)
+FROM lookup_requests r
+LEFT JOIN geo_locations g ON g.id = r.geo_location_id
+WHERE r.lookup_time IS NOT NULL
+GROUP BY 1, 2, 3, 4, 5, 6, 7, 8;
@@ -0,0 +1,23 @@
+-- API keys, stored as a hash of the key, and their daily usage
+CREATE TABLE IF NOT EXISTS api_keys (
+    id           INTEGER PRIMARY KEY AUTOINCREMENT,
+    name         TEXT NOT NULL DEFAULT '',
+    prefix       TEXT NOT NULL DEFAULT '',
+    hash         TEXT NOT NULL,
+    scopes       TEXT NOT NULL DEFAULT '',
+    rate_limit   INTEGER NOT NULL DEFAULT 0,
+    daily_quota  INTEGER NOT NULL DEFAULT 0,
+    created_at   DATETIME,
+    last_used_at DATETIME,
+    revoked_at   DATETIME
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_keys_hash ON api_keys (hash);
+
+CREATE TABLE IF NOT EXISTS api_key_usages (
+    api_key_id INTEGER NOT NULL REFERENCES api_keys (id) ON DELETE CASCADE,
+    day        DATETIME NOT NULL,
+    requests   INTEGER NOT NULL DEFAULT 0,
+    rejected   INTEGER NOT NULL DEFAULT 0,
+    PRIMARY KEY (api_key_id, day)
+);
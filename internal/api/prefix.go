@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"net/netip"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+// prefixKeyPrefix namespaces the cache keys of network blocks,
+// so they never collide with the keys of single addresses.
+const prefixKeyPrefix = "prefix:"
+
+// PrefixCacheEnabled reports whether lookups are also cached per network block,
+// as configured by the PrefixMode of the cache.
+func PrefixCacheEnabled() bool {
+	return Settings().Cache.PrefixMode
+}
+
+// PrefixFor returns the network block covering the ip address, using the
+// PrefixV4Len (default 24) of the cache for IPv4 and its PrefixV6Len
+// (default 48) for IPv6 addresses.
+//
+// KeyCDN does not return the network range of an address, so the block
+// is always derived from the configured prefix length.
+func PrefixFor(ipaddress string) (netip.Prefix, error) {
+	addr, err := netip.ParseAddr(ipaddress)
+	if err != nil {
+		return netip.Prefix{}, errors.New(err)
+	}
+	addr = addr.Unmap()
+
+	cfg := Settings().Cache
+	bits, fallback := cfg.PrefixV6Len, 48
+	if addr.Is4() {
+		bits, fallback = cfg.PrefixV4Len, 24
+	}
+	if bits < 0 || bits > addr.BitLen() {
+		slog.Warn("Ignoring invalid prefix length", "bits", bits)
+		bits = fallback
+	}
+
+	prefix, err := addr.Prefix(bits)
+	if err != nil {
+		return netip.Prefix{}, errors.New(err)
+	}
+	return prefix, nil
+}
+
+// AddPrefixCacheItem stores a successful lookup under the network block
+// covering the ip address, with the same timeouts as AddCacheItem.
+func AddPrefixCacheItem(ctx context.Context, ipaddress string, data *model.LookupResponse) error {
+	prefix, err := PrefixFor(ipaddress)
+	if err != nil {
+		return err
+	}
+	return AddCacheItem(ctx, prefixKeyPrefix+prefix.String(), data)
+}
+
+// GetPrefixCacheEntry retrieves the entry cached for the network block
+// covering the ip address, together with that block. Only positive entries
+// are stored per block.
+func GetPrefixCacheEntry(ctx context.Context, ipaddress string) (*CacheEntry, netip.Prefix, error) {
+	prefix, err := PrefixFor(ipaddress)
+	if err != nil {
+		return nil, netip.Prefix{}, err
+	}
+
+	entry, err := GetCacheEntry(ctx, prefixKeyPrefix+prefix.String())
+	if err != nil {
+		return nil, prefix, err
+	}
+	return entry, prefix, nil
+}
+
+// isPrefixKey reports whether the cache key belongs to a network block.
+func isPrefixKey(key string) bool {
+	return strings.HasPrefix(key, prefixKeyPrefix)
+}
@@ -0,0 +1,71 @@
+package api
+
+import (
+	"context"
+	"testing"
+
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestPrefixFor(t *testing.T) {
+
+	testCases := map[string]struct {
+		ip   string
+		v4   int
+		want string
+	}{
+		"ipv4 default":   {ip: "169.1.245.236", want: "169.1.245.0/24"},
+		"ipv4 /16":       {ip: "169.1.245.236", v4: 16, want: "169.1.0.0/16"},
+		"ipv4 invalid":   {ip: "169.1.245.236", v4: 40, want: "169.1.245.0/24"},
+		"ipv4 mapped":    {ip: "::ffff:169.1.245.236", want: "169.1.245.0/24"},
+		"ipv6 default":   {ip: "2001:db8:1234:5678::1", want: "2001:db8:1234::/48"},
+		"ipv6 uppercase": {ip: "2001:DB8:1234:5678::1", want: "2001:db8:1234::/48"},
+	}
+
+	for n, tc := range testCases {
+		t.Run(n, func(t *testing.T) {
+			useSettings(t, func(c *config.Config) {
+				if tc.v4 != 0 {
+					c.Cache.PrefixV4Len = tc.v4
+				}
+			})
+			got, err := PrefixFor(tc.ip)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.String() != tc.want {
+				t.Errorf("expected %s but got %s", tc.want, got)
+			}
+		})
+	}
+
+	if _, err := PrefixFor("not-an-ip"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
+
+func TestPrefixCacheServesNeighbours(t *testing.T) {
+
+	Cache.Flush()
+
+	_ = AddCacheItem(context.Background(), "169.1.245.236", &model.LookupResponse{City: "Johannesburg"})
+	_ = AddPrefixCacheItem(context.Background(), "169.1.245.236", &model.LookupResponse{City: "Johannesburg"})
+
+	entry, prefix, err := GetPrefixCacheEntry(context.Background(), "169.1.245.10")
+	if err != nil {
+		t.Fatalf("expected neighbour to be served from the prefix, got %v", err)
+	}
+	if entry.Data.City != "Johannesburg" || prefix.String() != "169.1.245.0/24" {
+		t.Errorf("unexpected entry %+v for %s", entry.Data, prefix)
+	}
+
+	if _, _, err := GetPrefixCacheEntry(context.Background(), "169.1.246.10"); err == nil {
+		t.Error("an address in another block should not be served")
+	}
+
+	stats := GetCacheStats()
+	if stats.Found != 1 || stats.Prefixes != 1 {
+		t.Errorf("unexpected cache stats %+v", stats)
+	}
+}
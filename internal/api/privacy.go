@@ -0,0 +1,200 @@
+package api
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"log/slog"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+)
+
+// PrivacyMode decides how the ip address of a lookup is stored in the database.
+type PrivacyMode string
+
+const (
+	// PrivacyFull stores the ip address as is.
+	PrivacyFull PrivacyMode = "full"
+	// PrivacyTruncate stores the network block of the ip address,
+	// a /24 for IPv4 and a /48 for IPv6 addresses.
+	PrivacyTruncate PrivacyMode = "truncate"
+	// PrivacyHMAC stores a keyed hash of the ip address, which can only be
+	// matched by hashing an ip address with the same key.
+	PrivacyHMAC PrivacyMode = "hmac"
+)
+
+// Network block lengths the ip addresses are truncated to by PrivacyTruncate.
+const (
+	truncateV4Len = 24
+	truncateV6Len = 48
+)
+
+// maxHMACKeyIDLen keeps the stored hashes, prefixed with the id of their key,
+// within the 64 characters of the ip_address columns.
+const maxHMACKeyIDLen = 16
+
+// HMACKey is a key used to hash ip addresses. Its ID is stored with each hash,
+// so the key a hash was made with can be told after the keys are rotated.
+type HMACKey struct {
+	ID     string
+	Secret []byte
+}
+
+// Privacy applies a PrivacyMode to the ip addresses stored with lookups.
+// With PrivacyHMAC, addresses are hashed with the first of Keys; the other keys
+// are older ones, still used to find the lookups hashed with them.
+type Privacy struct {
+	Mode PrivacyMode
+	Keys []HMACKey
+}
+
+// storagePrivacy is the Privacy applied when recording lookups, set by InitPrivacy.
+var storagePrivacy atomic.Pointer[Privacy]
+
+// NewPrivacy validates the mode and the keys it needs.
+func NewPrivacy(mode PrivacyMode, keys []HMACKey) (*Privacy, error) {
+	switch mode {
+	case "":
+		mode = PrivacyFull
+	case PrivacyFull, PrivacyTruncate:
+	case PrivacyHMAC:
+		if len(keys) == 0 {
+			return nil, errors.New("hmac privacy mode needs at least one key")
+		}
+	default:
+		return nil, errors.Errorf("unknown privacy mode %q", mode)
+	}
+	return &Privacy{Mode: mode, Keys: keys}, nil
+}
+
+// ParseHMACKeys parses a comma separated list of id:secret pairs, the current
+// key first. Key ids are letters and digits, at most 16 of them.
+func ParseHMACKeys(value string) ([]HMACKey, error) {
+	var keys []HMACKey
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		id, secret, found := strings.Cut(pair, ":")
+		if !found || secret == "" {
+			return nil, errors.Errorf("hmac key %q must be written as id:secret", id)
+		}
+		if id == "" || len(id) > maxHMACKeyIDLen || strings.TrimFunc(id, isAlphanumeric) != "" {
+			return nil, errors.Errorf("hmac key id %q must be 1 to %d letters or digits", id, maxHMACKeyIDLen)
+		}
+		if seen[id] {
+			return nil, errors.Errorf("hmac key id %q is used twice", id)
+		}
+		seen[id] = true
+		keys = append(keys, HMACKey{ID: id, Secret: []byte(secret)})
+	}
+	return keys, nil
+}
+
+// InitPrivacy sets the Privacy applied when recording lookups from the
+// PrivacyMode ("full", the default, "truncate" or "hmac") and HMACKeys of
+// the storage configuration.
+func InitPrivacy(cfg config.StorageConfig) error {
+	keys, err := ParseHMACKeys(cfg.HMACKeys)
+	if err != nil {
+		return err
+	}
+	p, err := NewPrivacy(PrivacyMode(cfg.PrivacyMode), keys)
+	if err != nil {
+		return err
+	}
+	storagePrivacy.Store(p)
+	slog.Info("Storing ip addresses of lookups", "mode", p.Mode, "keys", len(p.Keys))
+	return nil
+}
+
+// StoragePrivacy returns the Privacy applied when recording lookups.
+func StoragePrivacy() *Privacy {
+	if p := storagePrivacy.Load(); p != nil {
+		return p
+	}
+	return &Privacy{Mode: PrivacyFull}
+}
+
+// StoredAddress returns the form of the ip address stored in the database.
+func (p *Privacy) StoredAddress(ipaddress string) string {
+	switch p.Mode {
+	case PrivacyTruncate:
+		if addr, ok := truncateAddr(ipaddress); ok {
+			return addr.String()
+		}
+		return ""
+	case PrivacyHMAC:
+		return hashAddress(p.Keys[0], ipaddress)
+	}
+	return ipaddress
+}
+
+// StoredAddresses returns every form the ip address may have been stored in,
+// one per key for PrivacyHMAC, so lookups recorded before a key rotation are
+// still found.
+func (p *Privacy) StoredAddresses(ipaddress string) []string {
+	if p.Mode != PrivacyHMAC {
+		return []string{p.StoredAddress(ipaddress)}
+	}
+	addresses := make([]string, 0, len(p.Keys))
+	for _, key := range p.Keys {
+		addresses = append(addresses, hashAddress(key, ipaddress))
+	}
+	return addresses
+}
+
+// StoredBytes returns the 16 byte form of the stored ip address, used to query
+// network blocks, or nil when the address is hashed.
+func (p *Privacy) StoredBytes(ipaddress string) []byte {
+	switch p.Mode {
+	case PrivacyTruncate:
+		if addr, ok := truncateAddr(ipaddress); ok {
+			b := addr.As16()
+			return b[:]
+		}
+		return nil
+	case PrivacyHMAC:
+		return nil
+	}
+	return ipBytes(ipaddress)
+}
+
+// truncateAddr returns the first address of the network block of the ip address.
+func truncateAddr(ipaddress string) (netip.Addr, bool) {
+	addr, err := netip.ParseAddr(ipaddress)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	addr = addr.Unmap()
+	bits := truncateV6Len
+	if addr.Is4() {
+		bits = truncateV4Len
+	}
+	prefix, err := addr.WithZone("").Prefix(bits)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return prefix.Addr(), true
+}
+
+// hashAddress returns the id of the key and the HMAC-SHA256 of the ip address,
+// in its canonical form so different spellings of an address hash the same.
+func hashAddress(key HMACKey, ipaddress string) string {
+	if addr, err := netip.ParseAddr(ipaddress); err == nil {
+		ipaddress = addr.Unmap().String()
+	}
+	mac := hmac.New(sha256.New, key.Secret)
+	mac.Write([]byte(ipaddress))
+	return key.ID + "$" + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func isAlphanumeric(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9'
+}
@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+// usePrivacy applies the privacy settings to the lookups recorded by the test.
+func usePrivacy(t *testing.T, p *Privacy) {
+	t.Helper()
+	previous := storagePrivacy.Swap(p)
+	t.Cleanup(func() { storagePrivacy.Store(previous) })
+}
+
+func TestParseHMACKeys(t *testing.T) {
+
+	keys, err := ParseHMACKeys("k2:new secret, k1:old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 || keys[0].ID != "k2" || string(keys[0].Secret) != "new secret" || keys[1].ID != "k1" {
+		t.Errorf("unexpected keys %+v", keys)
+	}
+
+	for _, bad := range []string{"k1", "k1:", "k-1:secret", "k1:a,k1:b", strings.Repeat("k", 17) + ":secret"} {
+		if _, err := ParseHMACKeys(bad); err == nil {
+			t.Errorf("expected %q to be rejected", bad)
+		}
+	}
+
+	if _, err := NewPrivacy(PrivacyHMAC, nil); err == nil {
+		t.Error("expected the hmac mode to require a key")
+	}
+}
+
+func TestTruncatedAddresses(t *testing.T) {
+
+	p := &Privacy{Mode: PrivacyTruncate}
+	if got := p.StoredAddress("41.160.113.136"); got != "41.160.113.0" {
+		t.Errorf("expected the /24 of the address but got %s", got)
+	}
+	if got := p.StoredAddress("2001:db8:1234:5678::1"); got != "2001:db8:1234::" {
+		t.Errorf("expected the /48 of the address but got %s", got)
+	}
+	if got := p.StoredBytes("::ffff:41.160.113.136"); string(got) != string(ipBytes("41.160.113.0")) {
+		t.Errorf("unexpected stored bytes %v", got)
+	}
+}
+
+func TestHashedAddressesSurviveKeyRotation(t *testing.T) {
+
+	resetDatabase(t)
+
+	old := HMACKey{ID: "k1", Secret: []byte("old")}
+	usePrivacy(t, &Privacy{Mode: PrivacyHMAC, Keys: []HMACKey{old}})
+	recordAt(t, "41.160.113.136", time.Now().Add(-time.Minute))
+
+	// Rotate the key: new lookups are hashed with k2, k1 is kept to find the older ones
+	current := HMACKey{ID: "k2", Secret: []byte("new")}
+	usePrivacy(t, &Privacy{Mode: PrivacyHMAC, Keys: []HMACKey{current, old}})
+	recordAt(t, "41.160.113.136", time.Now())
+
+	var stored []model.LookupRequest
+	db.Find(&stored)
+	for _, req := range stored {
+		if strings.Contains(req.IpAddress, "41.160") || req.IpBytes != nil || len(req.IpAddress) > 64 {
+			t.Errorf("expected only a hash of the address to be stored but got %q", req.IpAddress)
+		}
+	}
+
+	page, err := QueryHistory(HistoryFilter{IpAddress: "41.160.113.136"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Items) != 2 || !strings.HasPrefix(page.Items[0].IpAddress, "k2$") || !strings.HasPrefix(page.Items[1].IpAddress, "k1$") {
+		t.Errorf("expected the lookups hashed with both keys but got %+v", page.Items)
+	}
+
+	result, err := EraseIpAddress(context.Background(), "41.160.113.136")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lookups != 2 {
+		t.Errorf("expected both lookups erased but got %+v", result)
+	}
+}
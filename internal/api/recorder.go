@@ -0,0 +1,321 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/model"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DropPolicy decides what a Recorder does with a lookup when its queue is full.
+type DropPolicy string
+
+const (
+	// DropNewest discards the lookup being recorded.
+	DropNewest DropPolicy = "drop_newest"
+	// DropOldest discards the oldest queued lookup to make room.
+	DropOldest DropPolicy = "drop_oldest"
+	// Block waits for room in the queue, slowing down the caller.
+	Block DropPolicy = "block"
+)
+
+// RecorderOptions configures the queue and batching of a Recorder.
+type RecorderOptions struct {
+	QueueSize     int
+	BatchSize     int
+	FlushInterval time.Duration
+	DropPolicy    DropPolicy
+}
+
+// RecorderStats holds the counters of a Recorder. Failed counts the lookups of
+// the batches dropped after every write attempt failed, FailedBatches those
+// batches and Retries the writes attempted again.
+type RecorderStats struct {
+	Queued        int    `json:"queued"`
+	Recorded      uint64 `json:"recorded"`
+	Dropped       uint64 `json:"dropped"`
+	Failed        uint64 `json:"failed"`
+	FailedBatches uint64 `json:"failed_batches"`
+	Retries       uint64 `json:"retries"`
+}
+
+// Writing a batch is attempted writeAttempts times, waiting writeRetryDelay
+// times the attempt between them, before the batch is dropped.
+const (
+	writeAttempts   = 3
+	writeRetryDelay = 100 * time.Millisecond
+)
+
+// Recorder writes lookups to the database in the background. Lookups are
+// buffered in a bounded queue and written in batches, either when a batch is
+// full or when the flush interval passes, whichever comes first.
+type Recorder struct {
+	opts  RecorderOptions
+	write func([]*model.LookupRequest, ...trace.Link) error
+	queue chan queued
+	done  chan struct{}
+
+	// closing is closed first by Close, to release the callers waiting for
+	// room in the queue before the queue is closed.
+	closing     chan struct{}
+	closingOnce sync.Once
+
+	mu     sync.RWMutex
+	closed bool
+
+	recorded      atomic.Uint64
+	dropped       atomic.Uint64
+	failed        atomic.Uint64
+	failedBatches atomic.Uint64
+	retries       atomic.Uint64
+}
+
+// queued is a lookup waiting to be recorded, with the link to the span of the
+// request that made it.
+type queued struct {
+	req  *model.LookupRequest
+	link trace.Link
+}
+
+// recorder is the Recorder used by RecordAsync, started by StartRecorder.
+var recorder atomic.Pointer[Recorder]
+
+// NewRecorder starts a Recorder that hands its batches to write, with the links
+// to the spans of the requests that made the lookups.
+func NewRecorder(opts RecorderOptions, write func([]*model.LookupRequest, ...trace.Link) error) *Recorder {
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 1000
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 100
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.DropPolicy != DropOldest && opts.DropPolicy != Block {
+		opts.DropPolicy = DropNewest
+	}
+
+	r := &Recorder{
+		opts:    opts,
+		write:   write,
+		queue:   make(chan queued, opts.QueueSize),
+		done:    make(chan struct{}),
+		closing: make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Enqueue queues the lookup made by the request traced in ctx for recording and
+// reports whether it was accepted. When the queue is full, the DropPolicy of the
+// Recorder applies. With the Block policy, a lookup waiting for room is dropped
+// once the Recorder is closing.
+func (r *Recorder) Enqueue(ctx context.Context, lookupRequest *model.LookupRequest) bool {
+	req := queued{req: lookupRequest, link: trace.LinkFromContext(ctx)}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if r.closed {
+		r.dropped.Add(1)
+		return false
+	}
+
+	switch r.opts.DropPolicy {
+	case Block:
+		select {
+		case r.queue <- req:
+			return true
+		case <-r.closing:
+			r.dropped.Add(1)
+			return false
+		}
+	case DropOldest:
+		for {
+			select {
+			case r.queue <- req:
+				return true
+			default:
+			}
+			select {
+			case <-r.queue:
+				r.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case r.queue <- req:
+			return true
+		default:
+			r.dropped.Add(1)
+			return false
+		}
+	}
+}
+
+// Close stops accepting lookups and waits until the queued ones are written,
+// or until ctx is done.
+func (r *Recorder) Close(ctx context.Context) error {
+	r.closingOnce.Do(func() { close(r.closing) })
+
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return nil
+	case <-ctx.Done():
+		return errors.New(ctx.Err())
+	}
+}
+
+// Stats returns the counters of the Recorder.
+func (r *Recorder) Stats() RecorderStats {
+	return RecorderStats{
+		Queued:        len(r.queue),
+		Recorded:      r.recorded.Load(),
+		Dropped:       r.dropped.Load(),
+		Failed:        r.failed.Load(),
+		FailedBatches: r.failedBatches.Load(),
+		Retries:       r.retries.Load(),
+	}
+}
+
+func (r *Recorder) run() {
+	defer close(r.done)
+
+	ticker := time.NewTicker(r.opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]queued, 0, r.opts.BatchSize)
+	for {
+		select {
+		case req, ok := <-r.queue:
+			if !ok {
+				r.flush(batch)
+				return
+			}
+			batch = append(batch, req)
+			if len(batch) >= r.opts.BatchSize {
+				r.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			r.flush(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// flush writes the batch, attempting it again when the write fails, and drops
+// it once writeAttempts writes failed. Each attempt writes copies of the
+// lookups, as they are changed by the write.
+func (r *Recorder) flush(batch []queued) {
+	if len(batch) == 0 {
+		return
+	}
+
+	lookups := make([]*model.LookupRequest, len(batch))
+	links := make([]trace.Link, len(batch))
+	for i, q := range batch {
+		lookups[i], links[i] = q.req, q.link
+	}
+
+	var err error
+	for attempt := 1; attempt <= writeAttempts; attempt++ {
+		if err = r.write(cloneLookups(lookups), links...); err == nil {
+			r.recorded.Add(uint64(len(batch)))
+			return
+		}
+		if attempt < writeAttempts {
+			r.retries.Add(1)
+			slog.Warn("Error recording batch of lookups, retrying", "size", len(batch), "attempt", attempt, "error", err)
+			time.Sleep(time.Duration(attempt) * writeRetryDelay)
+		}
+	}
+
+	r.failed.Add(uint64(len(batch)))
+	r.failedBatches.Add(1)
+	slog.Error("Dropped batch of lookups after failed writes", "size", len(batch), "attempts", writeAttempts, "error", err)
+}
+
+// StartRecorder starts the background Recorder used by RecordAsync, with the queue
+// size, batch size, flush interval and drop policy ("drop_newest", "drop_oldest"
+// or "block") of the configuration. Nothing is started when the database is disabled.
+func StartRecorder(cfg config.RecorderConfig) {
+	if db == nil {
+		return
+	}
+
+	r := NewRecorder(RecorderOptions{
+		QueueSize:     cfg.QueueSize,
+		BatchSize:     cfg.BatchSize,
+		FlushInterval: cfg.FlushInterval,
+		DropPolicy:    DropPolicy(cfg.DropPolicy),
+	}, RecordBatch)
+	recorder.Store(r)
+	slog.Info("Started lookup recorder", "options", r.opts)
+}
+
+// StopRecorder stops the background Recorder, writing the lookups still queued.
+func StopRecorder(ctx context.Context) error {
+	r := recorder.Swap(nil)
+	if r == nil {
+		return nil
+	}
+
+	err := r.Close(ctx)
+	slog.Info("Stopped lookup recorder", "stats", r.Stats())
+	return err
+}
+
+// RecordAsync queues the lookup made by the request traced in ctx for the
+// background Recorder. When no Recorder is running, the lookup is recorded
+// synchronously with Record instead.
+func RecordAsync(ctx context.Context, lookupRequest *model.LookupRequest) {
+	r := recorder.Load()
+	if r == nil {
+		_ = Record(lookupRequest, trace.LinkFromContext(ctx))
+		return
+	}
+	if !r.Enqueue(ctx, lookupRequest) {
+		slog.WarnContext(ctx, "Recorder queue is full, lookup dropped", "ipaddress", lookupRequest.IpAddress)
+	}
+}
+
+// GetRecorderStats returns the counters of the background Recorder, if it is running.
+func GetRecorderStats() (RecorderStats, bool) {
+	r := recorder.Load()
+	if r == nil {
+		return RecorderStats{}, false
+	}
+	return r.Stats(), true
+}
+
+// cloneLookups returns copies of the lookups and their geolocations. Recording
+// a lookup replaces its ip address by the stored form and sets the ids of the
+// rows written, which a write attempted again must not start from.
+func cloneLookups(batch []*model.LookupRequest) []*model.LookupRequest {
+	clones := make([]*model.LookupRequest, len(batch))
+	for i, req := range batch {
+		clone := *req
+		if req.GeoLocation != nil {
+			geo := *req.GeoLocation
+			clone.GeoLocation = &geo
+		}
+		clones[i] = &clone
+	}
+	return clones
+}
@@ -0,0 +1,288 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/model"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// batchCollector collects the batches written by a Recorder.
+type batchCollector struct {
+	mu      sync.Mutex
+	batches [][]string
+	links   []trace.Link
+	release chan struct{}
+}
+
+func (b *batchCollector) write(batch []*model.LookupRequest, links ...trace.Link) error {
+	if b.release != nil {
+		<-b.release
+	}
+	ips := make([]string, 0, len(batch))
+	for _, req := range batch {
+		ips = append(ips, req.IpAddress)
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.batches = append(b.batches, ips)
+	b.links = append(b.links, links...)
+	return nil
+}
+
+func (b *batchCollector) count() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	n := 0
+	for _, batch := range b.batches {
+		n += len(batch)
+	}
+	return n
+}
+
+func TestRecorderFlushesFullBatches(t *testing.T) {
+
+	collector := &batchCollector{}
+	r := NewRecorder(RecorderOptions{QueueSize: 10, BatchSize: 2, FlushInterval: time.Hour}, collector.write)
+
+	for _, ip := range []string{"1", "2", "3"} {
+		r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: ip})
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for collector.count() < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if collector.count() != 2 {
+		t.Fatalf("expected the full batch to be written, got %v", collector.batches)
+	}
+
+	// Closing drains the partial batch
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if collector.count() != 3 || r.Stats().Recorded != 3 {
+		t.Errorf("expected 3 lookups recorded, got %v", collector.batches)
+	}
+	if r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "4"}) {
+		t.Error("a closed recorder should not accept lookups")
+	}
+}
+
+func TestRecorderFlushesOnInterval(t *testing.T) {
+
+	collector := &batchCollector{}
+	r := NewRecorder(RecorderOptions{BatchSize: 100, FlushInterval: 10 * time.Millisecond}, collector.write)
+	defer func() { _ = r.Close(context.Background()) }()
+
+	r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "1"})
+
+	deadline := time.Now().Add(time.Second)
+	for collector.count() < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if collector.count() != 1 {
+		t.Error("expected the lookup to be written after the flush interval")
+	}
+}
+
+func TestRecorderDropPolicies(t *testing.T) {
+
+	testCases := map[string]struct {
+		policy DropPolicy
+		want   []string
+	}{
+		"drop newest": {policy: DropNewest, want: []string{"1", "2", "3"}},
+		"drop oldest": {policy: DropOldest, want: []string{"1", "3", "4"}},
+	}
+
+	for n, tc := range testCases {
+		t.Run(n, func(t *testing.T) {
+			// Hold the writer on the first lookup, so the queue of two fills up
+			collector := &batchCollector{release: make(chan struct{})}
+			r := NewRecorder(RecorderOptions{QueueSize: 2, BatchSize: 1, FlushInterval: time.Hour, DropPolicy: tc.policy}, collector.write)
+
+			r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "1"})
+			deadline := time.Now().Add(time.Second)
+			for r.Stats().Queued > 0 && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			for _, ip := range []string{"2", "3", "4"} {
+				r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: ip})
+			}
+
+			close(collector.release)
+			if err := r.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var got []string
+			for _, batch := range collector.batches {
+				got = append(got, batch...)
+			}
+			if len(got) != len(tc.want) {
+				t.Fatalf("expected %v but got %v", tc.want, got)
+			}
+			for i := range got {
+				if got[i] != tc.want[i] {
+					t.Fatalf("expected %v but got %v", tc.want, got)
+				}
+			}
+			if r.Stats().Dropped != 1 {
+				t.Errorf("expected 1 lookup dropped but got %d", r.Stats().Dropped)
+			}
+		})
+	}
+}
+
+func TestRecorderCloseReleasesBlockedLookups(t *testing.T) {
+
+	// Hold the writer on the first lookup, so the queue of one fills up
+	collector := &batchCollector{release: make(chan struct{})}
+	defer close(collector.release)
+	r := NewRecorder(RecorderOptions{QueueSize: 1, BatchSize: 1, FlushInterval: time.Hour, DropPolicy: Block}, collector.write)
+
+	r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "1"})
+	deadline := time.Now().Add(time.Second)
+	for r.Stats().Queued > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "2"})
+
+	accepted := make(chan bool)
+	go func() { accepted <- r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "3"}) }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := r.Close(ctx); err == nil {
+		t.Error("expected the close to time out while the writer is held")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the close to give up after its timeout but it took %s", elapsed)
+	}
+	if <-accepted {
+		t.Error("expected the blocked lookup to be dropped once closing")
+	}
+	if r.Stats().Dropped != 1 {
+		t.Errorf("expected 1 lookup dropped but got %d", r.Stats().Dropped)
+	}
+}
+
+func TestRecorderLinksTheRequests(t *testing.T) {
+
+	ctx, _ := recordSpans(t)
+	collector := &batchCollector{}
+	r := NewRecorder(RecorderOptions{BatchSize: 2, FlushInterval: time.Hour}, collector.write)
+
+	r.Enqueue(ctx, &model.LookupRequest{IpAddress: "1"})
+	r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "2"})
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(collector.links) != 2 || collector.links[0].SpanContext.SpanID() != trace.SpanContextFromContext(ctx).SpanID() {
+		t.Fatalf("expected the batch to be written with the span of each request but got %v", collector.links)
+	}
+	if collector.links[1].SpanContext.IsValid() {
+		t.Errorf("expected no span for the request made without one but got %v", collector.links[1])
+	}
+}
+
+func TestRecorderRetriesFailedBatches(t *testing.T) {
+
+	var mu sync.Mutex
+	attempts := 0
+	r := NewRecorder(RecorderOptions{BatchSize: 1, FlushInterval: time.Hour}, func(batch []*model.LookupRequest, _ ...trace.Link) error {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if batch[0].IpAddress == "fails" || attempts == 1 {
+			return errors.Errorf("database is locked")
+		}
+		return nil
+	})
+
+	r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "retried"})
+	r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "fails"})
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := r.Stats()
+	if stats.Recorded != 1 || stats.Failed != 1 || stats.FailedBatches != 1 {
+		t.Errorf("expected 1 lookup recorded and 1 failed batch but got %+v", stats)
+	}
+	if stats.Retries != writeAttempts || attempts != writeAttempts+2 {
+		t.Errorf("expected %d retries but got %d after %d attempts", writeAttempts, stats.Retries, attempts)
+	}
+}
+
+func TestRecorderRetriesFromTheLookupsGiven(t *testing.T) {
+
+	resetDatabase(t)
+	key := HMACKey{ID: "k1", Secret: []byte("secret")}
+	usePrivacy(t, &Privacy{Mode: PrivacyHMAC, Keys: []HMACKey{key}})
+
+	// The first write changes the lookups, then fails and is rolled back
+	failed := false
+	r := NewRecorder(RecorderOptions{BatchSize: 1, FlushInterval: time.Hour}, func(batch []*model.LookupRequest, _ ...trace.Link) error {
+		if !failed {
+			failed = true
+			if err := db.Transaction(func(tx *gorm.DB) error {
+				if err := prepareLookup(tx, batch[0]); err != nil {
+					return err
+				}
+				return errors.Errorf("database is locked")
+			}); err != nil {
+				return err
+			}
+		}
+		return RecordBatch(batch)
+	})
+
+	r.Enqueue(context.Background(), &model.LookupRequest{IpAddress: "41.160.113.136", LookupTime: time.Now(), LookupStatus: true,
+		GeoLocation: &model.GeoLocation{City: "Johannesburg"}})
+	if err := r.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var stored model.LookupRequest
+	if err := db.Preload("GeoLocation").Take(&stored).Error; err != nil {
+		t.Fatal(err)
+	}
+	if want := hashAddress(key, "41.160.113.136"); stored.IpAddress != want || stored.GeoLocation == nil || stored.GeoLocation.IpAddress != want {
+		t.Errorf("expected the address to be hashed once as %q but got %+v", want, stored)
+	}
+	if r.Stats().Retries != 1 || r.Stats().Recorded != 1 {
+		t.Errorf("expected the lookup to be recorded on the second attempt but got %+v", r.Stats())
+	}
+}
+
+func TestRecordBatch(t *testing.T) {
+
+	resetDatabase(t)
+
+	batch := []*model.LookupRequest{
+		{IpAddress: "10.1.0.1", LookupTime: time.Now(), LookupStatus: true, GeoLocation: &model.GeoLocation{City: "Durban"}},
+		{IpAddress: "10.1.0.1", LookupTime: time.Now(), LookupStatus: true},
+		{IpAddress: "10.1.0.2", LookupTime: time.Now(), ErrorCode: "not_found"},
+	}
+	if err := RecordBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	var count int64
+	db.Model(&model.LookupRequest{}).Count(&count)
+	if count != 3 {
+		t.Errorf("expected 3 lookups recorded but got %d", count)
+	}
+	if batch[1].GeoLocationID == nil || *batch[1].GeoLocationID != *batch[0].GeoLocationID {
+		t.Error("lookups of the same address should share a geolocation")
+	}
+}
@@ -0,0 +1,280 @@
+package api
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/model"
+	"gorm.io/gorm"
+)
+
+// purgeBatchSize bounds the rows removed by a single delete statement,
+// so a large purge does not hold long locks on the lookup table.
+const purgeBatchSize = 10000
+
+// RetentionPolicy limits how long and how many recorded lookups are kept.
+// A zero value does not limit.
+type RetentionPolicy struct {
+	MaxAge  time.Duration
+	MaxRows int64
+}
+
+// PurgeResult counts the rows removed by a purge.
+type PurgeResult struct {
+	ByAge        int64 `json:"by_age"`
+	ByRows       int64 `json:"by_rows"`
+	GeoLocations int64 `json:"geo_locations"`
+}
+
+// EraseResult counts the rows removed by an erasure of an ip address.
+type EraseResult struct {
+	Lookups      int64 `json:"lookups"`
+	GeoLocations int64 `json:"geo_locations"`
+}
+
+// RetentionStats holds the counters of the retention job and of erasures.
+type RetentionStats struct {
+	Runs               uint64     `json:"runs"`
+	Failures           uint64     `json:"failures"`
+	PurgedByAge        uint64     `json:"purged_by_age"`
+	PurgedByRows       uint64     `json:"purged_by_rows"`
+	PurgedGeoLocations uint64     `json:"purged_geo_locations"`
+	Erasures           uint64     `json:"erasures"`
+	ErasedLookups      uint64     `json:"erased_lookups"`
+	ErasedGeoLocations uint64     `json:"erased_geo_locations"`
+	LastRun            *time.Time `json:"last_run,omitempty"`
+}
+
+var retentionStats struct {
+	runs               atomic.Uint64
+	failures           atomic.Uint64
+	purgedByAge        atomic.Uint64
+	purgedByRows       atomic.Uint64
+	purgedGeoLocations atomic.Uint64
+	erasures           atomic.Uint64
+	erasedLookups      atomic.Uint64
+	erasedGeoLocations atomic.Uint64
+	lastRun            atomic.Int64
+}
+
+// RetentionJob enforces a RetentionPolicy on a schedule.
+type RetentionJob struct {
+	policy   RetentionPolicy
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	once     sync.Once
+}
+
+// retentionJob is the job started by StartRetention.
+var retentionJob atomic.Pointer[RetentionJob]
+
+// PurgeLookups removes the recorded lookups older than the maximum age of the
+// policy, then the oldest lookups beyond its maximum number of rows, and
+// finally the geolocations no longer referenced by any lookup. The hourly
+// rollups hold no addresses and are kept.
+func PurgeLookups(policy RetentionPolicy) (PurgeResult, error) {
+	var result PurgeResult
+	if db == nil {
+		return result, nil
+	}
+
+	if policy.MaxAge > 0 {
+		cutoff := time.Now().UTC().Add(-policy.MaxAge)
+		n, err := deleteInBatches(func(tx *gorm.DB) *gorm.DB {
+			return tx.Where("lookup_time < ?", cutoff)
+		})
+		result.ByAge = n
+		if err != nil {
+			return result, err
+		}
+	}
+
+	if policy.MaxRows > 0 {
+		// The newest lookup beyond the maximum is the last one to remove
+		var oldest []model.LookupRequest
+		err := db.Select("id", "lookup_time").
+			Order("lookup_time DESC").Order("id DESC").
+			Offset(int(policy.MaxRows)).Limit(1).
+			Find(&oldest).Error
+		if err != nil {
+			return result, errors.New(err)
+		}
+		if len(oldest) > 0 {
+			last := oldest[0]
+			n, err := deleteInBatches(func(tx *gorm.DB) *gorm.DB {
+				lookupTime := last.LookupTime.UTC()
+				return tx.Where("lookup_time < ? OR (lookup_time = ? AND id <= ?)", lookupTime, lookupTime, last.ID)
+			})
+			result.ByRows = n
+			if err != nil {
+				return result, err
+			}
+		}
+	}
+
+	if result.ByAge > 0 || result.ByRows > 0 {
+		tx := db.Where("NOT EXISTS (SELECT 1 FROM lookup_requests WHERE lookup_requests.geo_location_id = geo_locations.id)").
+			Delete(&model.GeoLocation{})
+		if tx.Error != nil {
+			return result, errors.New(tx.Error)
+		}
+		result.GeoLocations = tx.RowsAffected
+	}
+	return result, nil
+}
+
+// EraseIpAddress removes every recorded lookup and the geolocation stored for
+// the ip address, and evicts it from the cache. Lookups of the address still
+// queued by the background Recorder are written afterwards. When addresses are
+// truncated, the records of the whole network block of the address are removed.
+func EraseIpAddress(ctx context.Context, ipaddress string) (EraseResult, error) {
+	var result EraseResult
+	Cache.Delete(ipaddress)
+	if db == nil {
+		return result, nil
+	}
+
+	stored := StoragePrivacy().StoredAddresses(ipaddress)
+	err := db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		lookups := tx.Where("ip_address IN ?", stored).Delete(&model.LookupRequest{})
+		if lookups.Error != nil {
+			return lookups.Error
+		}
+		geos := tx.Where("ip_address IN ?", stored).Delete(&model.GeoLocation{})
+		if geos.Error != nil {
+			return geos.Error
+		}
+		result.Lookups, result.GeoLocations = lookups.RowsAffected, geos.RowsAffected
+		return nil
+	})
+	if err != nil {
+		return EraseResult{}, errors.New(err)
+	}
+
+	retentionStats.erasures.Add(1)
+	retentionStats.erasedLookups.Add(uint64(result.Lookups))
+	retentionStats.erasedGeoLocations.Add(uint64(result.GeoLocations))
+	slog.InfoContext(ctx, "Erased recorded lookups of ip address", "lookups", result.Lookups, "geo_locations", result.GeoLocations)
+	return result, nil
+}
+
+// deleteInBatches deletes the lookups selected by where, purgeBatchSize rows at
+// a time, and returns the number of rows deleted.
+func deleteInBatches(where func(tx *gorm.DB) *gorm.DB) (int64, error) {
+	var total int64
+	for {
+		batch := where(db.Model(&model.LookupRequest{})).Select("id").Limit(purgeBatchSize)
+		tx := db.Where("id IN (?)", batch).Delete(&model.LookupRequest{})
+		if tx.Error != nil {
+			return total, errors.New(tx.Error)
+		}
+		total += tx.RowsAffected
+		if tx.RowsAffected < purgeBatchSize {
+			return total, nil
+		}
+	}
+}
+
+// NewRetentionJob starts a job that purges lookups by the policy every interval,
+// starting right away.
+func NewRetentionJob(policy RetentionPolicy, interval time.Duration) *RetentionJob {
+	if interval <= 0 {
+		interval = time.Hour
+	}
+	j := &RetentionJob{
+		policy:   policy,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go j.run()
+	return j
+}
+
+// Stop stops the job, waiting for a purge in progress to finish.
+func (j *RetentionJob) Stop() {
+	j.once.Do(func() { close(j.stop) })
+	<-j.done
+}
+
+func (j *RetentionJob) run() {
+	defer close(j.done)
+
+	ticker := time.NewTicker(j.interval)
+	defer ticker.Stop()
+
+	for {
+		j.purge()
+		select {
+		case <-ticker.C:
+		case <-j.stop:
+			return
+		}
+	}
+}
+
+func (j *RetentionJob) purge() {
+	retentionStats.runs.Add(1)
+	retentionStats.lastRun.Store(time.Now().UnixNano())
+
+	result, err := PurgeLookups(j.policy)
+	retentionStats.purgedByAge.Add(uint64(result.ByAge))
+	retentionStats.purgedByRows.Add(uint64(result.ByRows))
+	retentionStats.purgedGeoLocations.Add(uint64(result.GeoLocations))
+	if err != nil {
+		retentionStats.failures.Add(1)
+		slog.Error("Error purging recorded lookups", "error", err)
+		return
+	}
+	slog.Info("Purged recorded lookups", "by_age", result.ByAge, "by_rows", result.ByRows, "geo_locations", result.GeoLocations)
+}
+
+// StartRetention starts the retention job, purging lookups older than MaxAge or
+// beyond MaxRows every Interval (default an hour). Nothing is started when the
+// database is disabled or neither limit is set.
+func StartRetention(cfg config.RetentionConfig) {
+	if db == nil {
+		return
+	}
+
+	policy := RetentionPolicy{MaxAge: cfg.MaxAge, MaxRows: cfg.MaxRows}
+	if policy.MaxAge <= 0 && policy.MaxRows <= 0 {
+		return
+	}
+
+	j := NewRetentionJob(policy, cfg.Interval)
+	retentionJob.Store(j)
+	slog.Info("Started retention job", "policy", policy, "interval", j.interval)
+}
+
+// StopRetention stops the retention job, if it is running.
+func StopRetention() {
+	if j := retentionJob.Swap(nil); j != nil {
+		j.Stop()
+	}
+}
+
+// GetRetentionStats returns the counters of the retention job and of erasures.
+func GetRetentionStats() RetentionStats {
+	stats := RetentionStats{
+		Runs:               retentionStats.runs.Load(),
+		Failures:           retentionStats.failures.Load(),
+		PurgedByAge:        retentionStats.purgedByAge.Load(),
+		PurgedByRows:       retentionStats.purgedByRows.Load(),
+		PurgedGeoLocations: retentionStats.purgedGeoLocations.Load(),
+		Erasures:           retentionStats.erasures.Load(),
+		ErasedLookups:      retentionStats.erasedLookups.Load(),
+		ErasedGeoLocations: retentionStats.erasedGeoLocations.Load(),
+	}
+	if last := retentionStats.lastRun.Load(); last > 0 {
+		lastRun := time.Unix(0, last)
+		stats.LastRun = &lastRun
+	}
+	return stats
+}
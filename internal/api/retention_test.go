@@ -0,0 +1,113 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+// recordAt records a successful lookup of the ip address at the given time.
+func recordAt(t *testing.T, ipaddress string, lookupTime time.Time) {
+	t.Helper()
+	req := &model.LookupRequest{
+		IpAddress:    ipaddress,
+		LookupTime:   lookupTime,
+		LookupStatus: true,
+		Provider:     Provider,
+		CacheStatus:  "miss",
+		GeoLocation:  &model.GeoLocation{CountryCode: "ZA"},
+	}
+	if err := Record(req); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func countRows(t *testing.T, table interface{}) int64 {
+	t.Helper()
+	var n int64
+	if err := db.Model(table).Count(&n).Error; err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestPurgeLookupsByAge(t *testing.T) {
+
+	resetDatabase(t)
+
+	now := time.Now()
+	recordAt(t, "10.0.0.1", now.Add(-48*time.Hour))
+	recordAt(t, "10.0.0.2", now.Add(-47*time.Hour))
+	recordAt(t, "10.0.0.3", now.Add(-time.Hour))
+
+	result, err := PurgeLookups(RetentionPolicy{MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ByAge != 2 || result.GeoLocations != 2 {
+		t.Errorf("expected 2 lookups and their geolocations purged but got %+v", result)
+	}
+	if n := countRows(t, &model.LookupRequest{}); n != 1 {
+		t.Errorf("expected 1 lookup left but got %d", n)
+	}
+	if n := countRows(t, &model.LookupRollup{}); n == 0 {
+		t.Error("expected the rollups to be kept")
+	}
+}
+
+func TestPurgeLookupsByRows(t *testing.T) {
+
+	resetDatabase(t)
+
+	now := time.Now()
+	for i := 0; i < 5; i++ {
+		recordAt(t, "10.0.0.9", now.Add(time.Duration(i)*time.Minute))
+	}
+
+	result, err := PurgeLookups(RetentionPolicy{MaxRows: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.ByRows != 2 || result.GeoLocations != 0 {
+		t.Errorf("expected the 2 oldest lookups purged but got %+v", result)
+	}
+
+	var remaining []model.LookupRequest
+	db.Order("lookup_time").Find(&remaining)
+	if len(remaining) != 3 || remaining[0].LookupTime.Before(now.Add(2*time.Minute).Add(-time.Second)) {
+		t.Errorf("expected the 3 newest lookups kept but got %+v", remaining)
+	}
+}
+
+func TestEraseIpAddress(t *testing.T) {
+
+	resetDatabase(t)
+	defer Cache.Flush()
+
+	recordAt(t, "10.0.0.1", time.Now())
+	recordAt(t, "10.0.0.1", time.Now())
+	recordAt(t, "10.0.0.2", time.Now())
+	if err := AddCacheItem(context.Background(), "10.0.0.1", &model.LookupResponse{City: "Cape Town"}); err != nil {
+		t.Fatal(err)
+	}
+
+	before := GetRetentionStats()
+	result, err := EraseIpAddress(context.Background(), "10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Lookups != 2 || result.GeoLocations != 1 {
+		t.Errorf("unexpected erase result %+v", result)
+	}
+	if _, err := GetCacheEntry(context.Background(), "10.0.0.1"); err == nil {
+		t.Error("expected the address to be evicted from the cache")
+	}
+	if n := countRows(t, &model.LookupRequest{}); n != 1 {
+		t.Errorf("expected the other address to be kept but got %d lookups", n)
+	}
+	if after := GetRetentionStats(); after.Erasures != before.Erasures+1 || after.ErasedLookups != before.ErasedLookups+2 {
+		t.Errorf("unexpected erasure counters %+v", after)
+	}
+}
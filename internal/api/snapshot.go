@@ -0,0 +1,164 @@
+package api
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/patrickmn/go-cache"
+)
+
+// SnapshotRecord is a single line of a cache snapshot. A zero ExpiresAt
+// means the entry does not expire.
+type SnapshotRecord struct {
+	Key       string      `json:"key"`
+	Entry     *CacheEntry `json:"entry"`
+	ExpiresAt time.Time   `json:"expires_at,omitempty"`
+}
+
+// ExportCache writes every unexpired cache entry to w as JSON lines,
+// one SnapshotRecord per line, and returns the number of entries written.
+func ExportCache(w io.Writer) (int, error) {
+	encoder := json.NewEncoder(w)
+	count := 0
+	for key, item := range Cache.Items() {
+		entry, ok := item.Object.(*CacheEntry)
+		if !ok {
+			continue
+		}
+
+		record := SnapshotRecord{Key: key, Entry: entry}
+		if item.Expiration > 0 {
+			record.ExpiresAt = time.Unix(0, item.Expiration)
+		}
+		if err := encoder.Encode(record); err != nil {
+			return count, errors.New(err)
+		}
+		count++
+	}
+	return count, nil
+}
+
+// ImportResult counts the records read by ImportCache: those imported, those
+// skipped as expired or already cached, and the invalid ones left out.
+type ImportResult struct {
+	Imported int `json:"imported"`
+	Skipped  int `json:"skipped"`
+	Invalid  int `json:"invalid"`
+}
+
+// ImportCache reads JSON lines written by ExportCache from r into the cache.
+// Expired records and keys that are already cached are skipped, so an import
+// never replaces newer data. Records without a key, of an unknown kind, or
+// found without data are invalid and left out, as the lookups would serve them
+// as an empty answer.
+func ImportCache(ctx context.Context, r io.Reader) (ImportResult, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	now := time.Now()
+	var result ImportResult
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var record SnapshotRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return result, errors.New(err)
+		}
+		if !record.valid() {
+			result.Invalid++
+			continue
+		}
+
+		duration := time.Duration(cache.NoExpiration)
+		if !record.ExpiresAt.IsZero() {
+			duration = record.ExpiresAt.Sub(now)
+			if duration <= 0 {
+				result.Skipped++
+				continue
+			}
+		}
+		if _, found := Cache.Get(record.Key); found {
+			result.Skipped++
+			continue
+		}
+
+		Cache.Set(record.Key, record.Entry, duration)
+		result.Imported++
+	}
+	if err := scanner.Err(); err != nil {
+		return result, errors.New(err)
+	}
+	if result.Invalid > 0 {
+		slog.WarnContext(ctx, "Invalid cache records left out of the import", "invalid", result.Invalid)
+	}
+	return result, nil
+}
+
+// valid reports whether the record holds an entry the lookups can serve.
+func (r SnapshotRecord) valid() bool {
+	if r.Key == "" || r.Entry == nil {
+		return false
+	}
+	switch r.Entry.Kind {
+	case EntryFound:
+		return r.Entry.Data != nil
+	case EntryNotFound, EntryFailed:
+		return true
+	}
+	return false
+}
+
+// SaveCacheSnapshot exports the cache to the file at path. The snapshot is
+// written to a temporary file first, so a failed save never leaves a
+// truncated snapshot behind.
+func SaveCacheSnapshot(path string) (int, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+
+	writer := bufio.NewWriter(tmp)
+	count, err := ExportCache(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return 0, errors.New(err)
+	}
+
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return 0, errors.New(err)
+	}
+	slog.Info("Saved cache snapshot", "path", path, "entries", count)
+	return count, nil
+}
+
+// LoadCacheSnapshot imports the snapshot file at path into the cache.
+func LoadCacheSnapshot(path string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, errors.New(err)
+	}
+	defer func() { _ = file.Close() }()
+
+	result, err := ImportCache(context.Background(), file)
+	if err != nil {
+		return result.Imported, err
+	}
+	slog.Info("Loaded cache snapshot", "path", path, "entries", result.Imported, "skipped", result.Skipped, "invalid", result.Invalid)
+	return result.Imported, nil
+}
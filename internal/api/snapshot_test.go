@@ -0,0 +1,89 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestCacheSnapshotRoundTrip(t *testing.T) {
+
+	Cache.Flush()
+
+	_ = AddCacheItem(context.Background(), "1", &model.LookupResponse{City: "Cape Town"})
+	_ = AddNegativeCacheItem(context.Background(), "2", EntryNotFound)
+
+	path := filepath.Join(t.TempDir(), "cache.jsonl")
+	saved, err := SaveCacheSnapshot(path)
+	if err != nil || saved != 2 {
+		t.Fatalf("expected 2 entries saved, got %d (%v)", saved, err)
+	}
+
+	Cache.Flush()
+	loaded, err := LoadCacheSnapshot(path)
+	if err != nil || loaded != 2 {
+		t.Fatalf("expected 2 entries loaded, got %d (%v)", loaded, err)
+	}
+
+	got, err := GetCacheById(context.Background(), "1")
+	if err != nil || got.City != "Cape Town" {
+		t.Errorf("unexpected entry %+v (%v)", got, err)
+	}
+	entry, err := GetCacheEntry(context.Background(), "2")
+	if err != nil || entry.Kind != EntryNotFound {
+		t.Errorf("unexpected entry %+v (%v)", entry, err)
+	}
+}
+
+func TestImportCacheSkipsExpiredAndCachedEntries(t *testing.T) {
+
+	Cache.Flush()
+	_ = AddCacheItem(context.Background(), "cached", &model.LookupResponse{City: "Durban"})
+
+	expired := time.Now().Add(-time.Minute).Format(time.RFC3339)
+	snapshot := strings.Join([]string{
+		`{"key":"expired","entry":{"kind":"found","data":{"city":"Pretoria"}},"expires_at":"` + expired + `"}`,
+		`{"key":"cached","entry":{"kind":"found","data":{"city":"Pretoria"}}}`,
+		`{"key":"forever","entry":{"kind":"found","data":{"city":"Pretoria"}}}`,
+	}, "\n")
+
+	result, err := ImportCache(context.Background(), bytes.NewBufferString(snapshot))
+	if err != nil || result.Imported != 1 || result.Skipped != 2 {
+		t.Fatalf("expected 1 entry imported and 2 skipped, got %+v (%v)", result, err)
+	}
+
+	if got, _ := GetCacheById(context.Background(), "cached"); got.City != "Durban" {
+		t.Errorf("a cached entry should not be replaced, got %q", got.City)
+	}
+	if _, err := GetCacheById(context.Background(), "expired"); err == nil {
+		t.Error("an expired entry should not be imported")
+	}
+}
+
+func TestImportCacheRejectsInvalidRecords(t *testing.T) {
+
+	Cache.Flush()
+
+	snapshot := strings.Join([]string{
+		`{"key":"nokind","entry":{"data":{"city":"Pretoria"}}}`,
+		`{"key":"unknown","entry":{"kind":"maybe"}}`,
+		`{"key":"nodata","entry":{"kind":"found"}}`,
+		`{"key":"","entry":{"kind":"not_found"}}`,
+		`{"key":"negative","entry":{"kind":"not_found"}}`,
+	}, "\n")
+
+	result, err := ImportCache(context.Background(), bytes.NewBufferString(snapshot))
+	if err != nil || result.Imported != 1 || result.Invalid != 4 {
+		t.Fatalf("expected 1 entry imported and 4 invalid, got %+v (%v)", result, err)
+	}
+	for _, key := range []string{"nokind", "unknown", "nodata"} {
+		if _, found := Cache.Get(key); found {
+			t.Errorf("expected the invalid record %q not to be imported", key)
+		}
+	}
+}
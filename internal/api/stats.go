@@ -0,0 +1,342 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/model"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	defaultStatsWindow = 7 * 24 * time.Hour
+	defaultStatsLimit  = 10
+	maxStatsLimit      = 100
+)
+
+// StatsFilter selects the time window and granularity of the lookup statistics.
+type StatsFilter struct {
+	From time.Time
+	To   time.Time
+	// Interval is the width of the buckets of a time series, an hour or a day.
+	Interval time.Duration
+	Limit    int
+}
+
+// TopEntry is a value of a dimension with the number of lookups that returned it.
+type TopEntry struct {
+	Value       string `json:"value"`
+	CountryCode string `json:"country_code,omitempty"`
+	Lookups     int64  `json:"lookups"`
+}
+
+// VolumeBucket counts the lookups made in a bucket of a time series.
+type VolumeBucket struct {
+	Bucket    time.Time `json:"bucket"`
+	Lookups   int64     `json:"lookups"`
+	Succeeded int64     `json:"succeeded"`
+	Failed    int64     `json:"failed"`
+}
+
+// CacheBucket counts the lookups in a bucket of a time series by how they were
+// answered. HitRatio is the share of them answered from the cache,
+// in memory or in the database.
+type CacheBucket struct {
+	Bucket   time.Time `json:"bucket"`
+	Hits     int64     `json:"hits"`
+	Stale    int64     `json:"stale"`
+	Negative int64     `json:"negative"`
+	Inferred int64     `json:"inferred"`
+	Database int64     `json:"database"`
+	Misses   int64     `json:"misses"`
+	HitRatio float64   `json:"hit_ratio"`
+}
+
+// ProviderErrors counts the upstream lookups made against a provider and
+// how many of them failed, by error code.
+type ProviderErrors struct {
+	Provider  string           `json:"provider"`
+	Lookups   int64            `json:"lookups"`
+	Failed    int64            `json:"failed"`
+	ErrorRate float64          `json:"error_rate"`
+	Errors    map[string]int64 `json:"errors"`
+}
+
+// topDimensions maps the dimensions of TopLookups to their rollup column.
+var topDimensions = map[string]string{
+	"countries": "country_code",
+	"cities":    "city",
+	"isps":      "isp",
+}
+
+// ParseStatsFilter builds a StatsFilter from named parameters, such as the query
+// string of a request. The parameters are from and to (RFC 3339, the last 7 days
+// by default), interval (hour or day) and limit. All invalid parameters are
+// reported together.
+func ParseStatsFilter(param func(key string) string) (StatsFilter, error) {
+	filter := StatsFilter{To: time.Now(), Interval: time.Hour, Limit: defaultStatsLimit}
+	var problems []string
+
+	for key, target := range map[string]*time.Time{"from": &filter.From, "to": &filter.To} {
+		if v := param(key); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s %q is not an RFC 3339 time", key, v))
+			}
+			*target = t
+		}
+	}
+	if filter.From.IsZero() {
+		filter.From = filter.To.Add(-defaultStatsWindow)
+	}
+	if !filter.From.Before(filter.To) {
+		problems = append(problems, "from must be before to")
+	}
+
+	switch v := param("interval"); v {
+	case "", "hour":
+	case "day":
+		filter.Interval = 24 * time.Hour
+	default:
+		problems = append(problems, fmt.Sprintf("interval %q must be hour or day", v))
+	}
+
+	if v := param("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			problems = append(problems, fmt.Sprintf("limit %q must be a positive number", v))
+		}
+		filter.Limit = min(limit, maxStatsLimit)
+	}
+
+	if len(problems) > 0 {
+		return filter, errors.New(strings.Join(problems, "; "))
+	}
+	return filter, nil
+}
+
+// IsTopDimension reports whether TopLookups can rank the dimension.
+func IsTopDimension(dimension string) bool {
+	_, ok := topDimensions[dimension]
+	return ok
+}
+
+// TopLookups returns the most looked up values of the dimension, "countries",
+// "cities" or "isps", in the window of the filter. Cities are ranked together
+// with their country, as the same name is used in different countries.
+func TopLookups(dimension string, filter StatsFilter) ([]TopEntry, error) {
+	column, ok := topDimensions[dimension]
+	if !ok {
+		return nil, errors.Errorf("unknown dimension %q", dimension)
+	}
+	entries := []TopEntry{}
+	if db == nil {
+		return entries, nil
+	}
+
+	groupBy := column
+	selected := column + " AS value, SUM(lookups) AS lookups"
+	if column == "city" {
+		groupBy = "city, country_code"
+		selected += ", country_code"
+	}
+
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = defaultStatsLimit
+	}
+
+	err := rollupWindow(filter).
+		Select(selected).
+		Where(column + " <> ''").
+		Group(groupBy).
+		Order("lookups DESC").Order("value").
+		Limit(limit).
+		Scan(&entries).Error
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	return entries, nil
+}
+
+// LookupVolume returns the number of lookups per interval in the window of the filter.
+func LookupVolume(filter StatsFilter) ([]VolumeBucket, error) {
+	var rows []VolumeBucket
+	if db != nil {
+		err := rollupWindow(filter).
+			Select("bucket, SUM(lookups) AS lookups, " +
+				"SUM(CASE WHEN lookup_status THEN lookups ELSE 0 END) AS succeeded, " +
+				"SUM(CASE WHEN lookup_status THEN 0 ELSE lookups END) AS failed").
+			Group("bucket").
+			Order("bucket").
+			Scan(&rows).Error
+		if err != nil {
+			return nil, errors.New(err)
+		}
+	}
+
+	buckets := []VolumeBucket{}
+	for _, row := range rows {
+		bucket := row.Bucket.UTC().Truncate(filter.Interval)
+		if n := len(buckets); n > 0 && buckets[n-1].Bucket.Equal(bucket) {
+			buckets[n-1].Lookups += row.Lookups
+			buckets[n-1].Succeeded += row.Succeeded
+			buckets[n-1].Failed += row.Failed
+			continue
+		}
+		row.Bucket = bucket
+		buckets = append(buckets, row)
+	}
+	return buckets, nil
+}
+
+// CacheHitRatio returns, per interval in the window of the filter, how the
+// lookups made by clients were answered. Background refreshes and the cache
+// warm-up are left out.
+func CacheHitRatio(filter StatsFilter) ([]CacheBucket, error) {
+	var rows []struct {
+		Bucket      time.Time
+		CacheStatus string
+		Lookups     int64
+	}
+	if db != nil {
+		err := rollupWindow(filter).
+			Select("bucket, cache_status, SUM(lookups) AS lookups").
+			Where("cache_status IN ?", []string{"hit", "stale", "negative", "inferred", "database", "miss"}).
+			Group("bucket, cache_status").
+			Order("bucket").
+			Scan(&rows).Error
+		if err != nil {
+			return nil, errors.New(err)
+		}
+	}
+
+	buckets := []CacheBucket{}
+	for _, row := range rows {
+		bucket := row.Bucket.UTC().Truncate(filter.Interval)
+		if n := len(buckets); n == 0 || !buckets[n-1].Bucket.Equal(bucket) {
+			buckets = append(buckets, CacheBucket{Bucket: bucket})
+		}
+		b := &buckets[len(buckets)-1]
+		switch row.CacheStatus {
+		case "hit":
+			b.Hits += row.Lookups
+		case "stale":
+			b.Stale += row.Lookups
+		case "negative":
+			b.Negative += row.Lookups
+		case "inferred":
+			b.Inferred += row.Lookups
+		case "database":
+			b.Database += row.Lookups
+		case "miss":
+			b.Misses += row.Lookups
+		}
+	}
+	for i := range buckets {
+		b := &buckets[i]
+		cached := b.Hits + b.Stale + b.Negative + b.Inferred + b.Database
+		b.HitRatio = ratio(cached, cached+b.Misses)
+	}
+	return buckets, nil
+}
+
+// ProviderErrorRates returns, per provider, the upstream lookups made in the
+// window of the filter and the share of them that failed.
+func ProviderErrorRates(filter StatsFilter) ([]ProviderErrors, error) {
+	var rows []struct {
+		Provider     string
+		LookupStatus bool
+		ErrorCode    string
+		Lookups      int64
+	}
+	if db != nil {
+		err := rollupWindow(filter).
+			Select("provider, lookup_status, error_code, SUM(lookups) AS lookups").
+			Where("provider <> ''").
+			Group("provider, lookup_status, error_code").
+			Scan(&rows).Error
+		if err != nil {
+			return nil, errors.New(err)
+		}
+	}
+
+	byProvider := map[string]*ProviderErrors{}
+	for _, row := range rows {
+		p, ok := byProvider[row.Provider]
+		if !ok {
+			p = &ProviderErrors{Provider: row.Provider, Errors: map[string]int64{}}
+			byProvider[row.Provider] = p
+		}
+		p.Lookups += row.Lookups
+		if !row.LookupStatus {
+			p.Failed += row.Lookups
+			p.Errors[row.ErrorCode] += row.Lookups
+		}
+	}
+
+	providers := make([]ProviderErrors, 0, len(byProvider))
+	for _, p := range byProvider {
+		p.ErrorRate = ratio(p.Failed, p.Lookups)
+		providers = append(providers, *p)
+	}
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Provider < providers[j].Provider
+	})
+	return providers, nil
+}
+
+// rollupWindow starts a query over the rollups in the window of the filter.
+func rollupWindow(filter StatsFilter) *gorm.DB {
+	return db.Model(&model.LookupRollup{}).
+		Where("bucket >= ? AND bucket < ?", filter.From.UTC().Truncate(time.Hour), filter.To.UTC())
+}
+
+// updateRollups adds the lookups to the hourly rollups, in the transaction
+// that records them.
+func updateRollups(tx *gorm.DB, lookupRequests []*model.LookupRequest) error {
+	byKey := map[model.LookupRollup]int64{}
+	for _, req := range lookupRequests {
+		key := model.LookupRollup{
+			Bucket:       req.LookupTime.UTC().Truncate(time.Hour),
+			Provider:     req.Provider,
+			CacheStatus:  req.CacheStatus,
+			LookupStatus: req.LookupStatus,
+			ErrorCode:    req.ErrorCode,
+		}
+		if geo := req.GeoLocation; geo != nil {
+			key.CountryCode = geo.CountryCode
+			key.City = geo.City
+			key.ISP = geo.ISP
+		}
+		byKey[key]++
+	}
+
+	rollups := make([]model.LookupRollup, 0, len(byKey))
+	for key, lookups := range byKey {
+		key.Lookups = lookups
+		rollups = append(rollups, key)
+	}
+
+	return tx.Clauses(clause.OnConflict{
+		Columns: []clause.Column{
+			{Name: "bucket"}, {Name: "provider"}, {Name: "cache_status"}, {Name: "lookup_status"},
+			{Name: "error_code"}, {Name: "country_code"}, {Name: "city"}, {Name: "isp"},
+		},
+		DoUpdates: clause.Assignments(map[string]interface{}{
+			"lookups": gorm.Expr("lookup_rollups.lookups + excluded.lookups"),
+		}),
+	}).Create(&rollups).Error
+}
+
+func ratio(part, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(part) / float64(total)
+}
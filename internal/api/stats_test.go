@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestParseStatsFilter(t *testing.T) {
+
+	filter, err := ParseStatsFilter(url.Values{"to": {"2024-05-08T00:00:00Z"}, "interval": {"day"}}.Get)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !filter.From.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("expected the window to default to 7 days but got %s", filter.From)
+	}
+	if filter.Interval != 24*time.Hour || filter.Limit != defaultStatsLimit {
+		t.Errorf("unexpected filter %+v", filter)
+	}
+
+	bad := url.Values{"from": {"2024-05-08T00:00:00Z"}, "to": {"2024-05-01T00:00:00Z"}, "interval": {"week"}}
+	if _, err := ParseStatsFilter(bad.Get); err == nil {
+		t.Error("expected invalid parameters to be rejected")
+	}
+}
+
+func TestStatsFromRollups(t *testing.T) {
+
+	resetDatabase(t)
+
+	start := time.Date(2024, 5, 1, 10, 15, 0, 0, time.UTC)
+	za := &model.GeoLocation{CountryCode: "ZA", City: "Cape Town", ISP: "Telkom"}
+	us := &model.GeoLocation{CountryCode: "US", City: "Ashburn", ISP: "Google"}
+
+	batch := []*model.LookupRequest{
+		{IpAddress: "41.160.113.136", LookupTime: start, LookupStatus: true, Provider: Provider, CacheStatus: "miss", GeoLocation: za},
+		{IpAddress: "8.8.8.8", LookupTime: start, LookupStatus: true, Provider: Provider, CacheStatus: "miss", GeoLocation: us},
+		{IpAddress: "10.0.0.1", LookupTime: start.Add(time.Minute), Provider: Provider, CacheStatus: "miss", ErrorCode: "not_found"},
+	}
+	if err := RecordBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+
+	// Cached lookups are counted against the geolocation stored for the address
+	hits := []*model.LookupRequest{
+		{IpAddress: "41.160.113.136", LookupTime: start.Add(2 * time.Minute), LookupStatus: true, CacheStatus: "hit"},
+		{IpAddress: "41.160.113.136", LookupTime: start.Add(time.Hour), LookupStatus: true, CacheStatus: "hit"},
+		{IpAddress: "41.160.113.136", LookupTime: start.Add(time.Hour), LookupStatus: true, CacheStatus: "refresh", Provider: Provider},
+	}
+	if err := RecordBatch(hits); err != nil {
+		t.Fatal(err)
+	}
+
+	filter := StatsFilter{From: start.Add(-time.Hour), To: start.Add(2 * time.Hour), Interval: time.Hour, Limit: 10}
+
+	countries, err := TopLookups("countries", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(countries) != 2 || countries[0].Value != "ZA" || countries[0].Lookups != 4 || countries[1].Value != "US" {
+		t.Errorf("unexpected top countries %+v", countries)
+	}
+
+	cities, err := TopLookups("cities", filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cities) == 0 || cities[0].Value != "Cape Town" || cities[0].CountryCode != "ZA" {
+		t.Errorf("unexpected top cities %+v", cities)
+	}
+
+	volume, err := LookupVolume(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volume) != 2 || volume[0].Lookups != 4 || volume[0].Failed != 1 || volume[1].Lookups != 2 {
+		t.Errorf("unexpected hourly volume %+v", volume)
+	}
+
+	filter.Interval = 24 * time.Hour
+	volume, err = LookupVolume(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(volume) != 1 || volume[0].Lookups != 6 || !volume[0].Bucket.Equal(time.Date(2024, 5, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("unexpected daily volume %+v", volume)
+	}
+
+	ratios, err := CacheHitRatio(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ratios) != 1 || ratios[0].Hits != 2 || ratios[0].Misses != 3 || ratios[0].HitRatio != 0.4 {
+		t.Errorf("unexpected cache hit ratio %+v", ratios)
+	}
+
+	providers, err := ProviderErrorRates(filter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(providers) != 1 || providers[0].Lookups != 4 || providers[0].Failed != 1 || providers[0].Errors["not_found"] != 1 {
+		t.Errorf("unexpected provider error rates %+v", providers)
+	}
+}
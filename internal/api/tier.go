@@ -0,0 +1,90 @@
+package api
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+// Tier names the layer a lookup was answered from.
+type Tier string
+
+const (
+	// TierMemory is the in-memory cache, including entries of network blocks.
+	TierMemory Tier = "memory"
+	// TierDatabase is the geolocation stored in the database by an earlier lookup.
+	TierDatabase Tier = "database"
+	// TierProvider is the upstream service.
+	TierProvider Tier = "provider"
+)
+
+// TierStats counts the lookups answered from each tier.
+type TierStats struct {
+	Memory   uint64 `json:"memory"`
+	Database uint64 `json:"database"`
+	Provider uint64 `json:"provider"`
+}
+
+var tierCounters struct {
+	memory   atomic.Uint64
+	database atomic.Uint64
+	provider atomic.Uint64
+}
+
+// CountTier counts a lookup answered from the tier.
+func CountTier(tier Tier) {
+	switch tier {
+	case TierMemory:
+		tierCounters.memory.Add(1)
+	case TierDatabase:
+		tierCounters.database.Add(1)
+	case TierProvider:
+		tierCounters.provider.Add(1)
+	}
+}
+
+// GetTierStats returns the number of lookups answered from each tier.
+func GetTierStats() TierStats {
+	return TierStats{
+		Memory:   tierCounters.memory.Load(),
+		Database: tierCounters.database.Load(),
+		Provider: tierCounters.provider.Load(),
+	}
+}
+
+// DatabaseCacheMaxAge returns how long after it was stored a geolocation in
+// the database still answers lookups, the CacheMaxAge of the database
+// configuration (default 24 hours). Zero means the database tier is disabled, which it also is
+// without a database or when addresses are stored truncated, as the stored
+// geolocation is then that of another address of the network block.
+func DatabaseCacheMaxAge() time.Duration {
+	if db == nil || StoragePrivacy().Mode == PrivacyTruncate {
+		return 0
+	}
+	return max(Settings().Database.CacheMaxAge, 0)
+}
+
+// GetStoredGeoLocation returns the geolocation stored in the database for the
+// ip address when it was updated within DatabaseCacheMaxAge. It returns
+// ErrNotFound when there is none or it is too old.
+func GetStoredGeoLocation(ipaddress string) (*model.GeoLocation, error) {
+	maxAge := DatabaseCacheMaxAge()
+	if maxAge <= 0 {
+		return nil, ErrNotFound
+	}
+
+	var geos []model.GeoLocation
+	err := db.Where("ip_address IN ? AND updated_at >= ?", StoragePrivacy().StoredAddresses(ipaddress), time.Now().Add(-maxAge)).
+		Order("updated_at DESC").
+		Limit(1).
+		Find(&geos).Error
+	if err != nil {
+		return nil, errors.New(err)
+	}
+	if len(geos) == 0 {
+		return nil, ErrNotFound
+	}
+	return &geos[0], nil
+}
@@ -0,0 +1,59 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/model"
+)
+
+func TestGetStoredGeoLocation(t *testing.T) {
+
+	resetDatabase(t)
+	useSettings(t, func(c *config.Config) { c.Database.CacheMaxAge = time.Hour })
+
+	recordAt(t, "10.0.0.1", time.Now())
+	recordAt(t, "10.0.0.2", time.Now())
+	db.Model(&model.GeoLocation{}).Where("ip_address = ?", "10.0.0.2").UpdateColumn("updated_at", time.Now().Add(-2*time.Hour))
+
+	geo, err := GetStoredGeoLocation("10.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if geo.CountryCode != "ZA" {
+		t.Errorf("unexpected geolocation %+v", geo)
+	}
+
+	if _, err := GetStoredGeoLocation("10.0.0.2"); err != ErrNotFound {
+		t.Errorf("expected a geolocation older than the maximum age to be ignored but got %v", err)
+	}
+	if _, err := GetStoredGeoLocation("10.0.0.3"); err != ErrNotFound {
+		t.Errorf("expected an unknown address not to be found but got %v", err)
+	}
+
+	useSettings(t, func(c *config.Config) { c.Database.CacheMaxAge = 0 })
+	if _, err := GetStoredGeoLocation("10.0.0.1"); err != ErrNotFound {
+		t.Errorf("expected the database tier to be disabled but got %v", err)
+	}
+
+	useSettings(t, func(c *config.Config) { c.Database.CacheMaxAge = time.Hour })
+	usePrivacy(t, &Privacy{Mode: PrivacyTruncate})
+	if DatabaseCacheMaxAge() != 0 {
+		t.Error("expected the database tier to be disabled when addresses are truncated")
+	}
+}
+
+func TestCountTier(t *testing.T) {
+
+	before := GetTierStats()
+	CountTier(TierMemory)
+	CountTier(TierDatabase)
+	CountTier(TierDatabase)
+	CountTier(TierProvider)
+
+	after := GetCacheStats().Tiers
+	if after.Memory != before.Memory+1 || after.Database != before.Database+2 || after.Provider != before.Provider+1 {
+		t.Errorf("unexpected tier counters %+v", after)
+	}
+}
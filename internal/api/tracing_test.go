@@ -0,0 +1,117 @@
+package api
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jvanrhyn/brgeo/config"
+	"github.com/jvanrhyn/brgeo/model"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var (
+	spanRecorderOnce sync.Once
+	spanRecorder     *tracetest.SpanRecorder
+)
+
+// recordSpans installs a tracer provider keeping the spans in memory and starts
+// a span for the test, so that its spans can be told apart from the others.
+func recordSpans(t *testing.T) (context.Context, func() []sdktrace.ReadOnlySpan) {
+	t.Helper()
+	spanRecorderOnce.Do(func() {
+		spanRecorder = tracetest.NewSpanRecorder()
+		otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(spanRecorder)))
+	})
+
+	ctx, span := otel.Tracer("test").Start(context.Background(), t.Name())
+	t.Cleanup(func() { span.End() })
+
+	traceID := span.SpanContext().TraceID()
+	return ctx, func() []sdktrace.ReadOnlySpan {
+		var spans []sdktrace.ReadOnlySpan
+		for _, s := range spanRecorder.Ended() {
+			if s.SpanContext().TraceID() == traceID {
+				spans = append(spans, s)
+				continue
+			}
+			for _, link := range s.Links() {
+				if link.SpanContext.TraceID() == traceID {
+					spans = append(spans, s)
+				}
+			}
+		}
+		return spans
+	}
+}
+
+func spansNamed(spans []sdktrace.ReadOnlySpan, name string) []sdktrace.ReadOnlySpan {
+	var named []sdktrace.ReadOnlySpan
+	for _, s := range spans {
+		if s.Name() == name {
+			named = append(named, s)
+		}
+	}
+	return named
+}
+
+func TestGetGeoInfoIsTraced(t *testing.T) {
+
+	resetProviderHealth(t)
+	useSettings(t, func(c *config.Config) {
+		c.Provider.ServiceURL = "http://127.0.0.1:1"
+		c.Provider.MaxRetries = 2
+	})
+	ctx, ended := recordSpans(t)
+
+	if _, _, err := GetGeoInfo(ctx, "41.160.113.136"); err == nil {
+		t.Fatal("expected the lookup to fail")
+	}
+
+	spans := ended()
+	lookups := spansNamed(spans, "provider.lookup")
+	if len(lookups) != 1 || lookups[0].Status().Code != codes.Error {
+		t.Fatalf("expected a failed provider.lookup span but got %v", lookups)
+	}
+	lookup := lookups[0].SpanContext().SpanID()
+
+	attempts := spansNamed(spans, "provider.attempt")
+	if len(attempts) != 2 {
+		t.Errorf("expected a span for each of the 2 attempts but got %d", len(attempts))
+	}
+	backoffs := spansNamed(spans, "provider.backoff")
+	if len(backoffs) != 1 {
+		t.Errorf("expected a span for the backoff before the retry but got %d", len(backoffs))
+	}
+	for _, s := range append(attempts, backoffs...) {
+		if s.Parent().SpanID() != lookup {
+			t.Errorf("expected %s to be a child of the provider.lookup span", s.Name())
+		}
+	}
+}
+
+func TestRecordIsLinkedToRequest(t *testing.T) {
+
+	ctx, ended := recordSpans(t)
+
+	req := &model.LookupRequest{
+		IpAddress:  "10.7.0.1",
+		LookupTime: time.Now(),
+	}
+	if err := Record(req, trace.LinkFromContext(ctx)); err != nil {
+		t.Fatal(err)
+	}
+
+	writes := spansNamed(ended(), "db.insert lookup")
+	if len(writes) != 1 {
+		t.Fatalf("expected a span for the insert but got %d", len(writes))
+	}
+	if links := writes[0].Links(); len(links) != 1 || links[0].SpanContext.SpanID() != trace.SpanContextFromContext(ctx).SpanID() {
+		t.Errorf("expected the insert to be linked to the request but got %v", links)
+	}
+}
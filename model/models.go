@@ -37,9 +37,84 @@ type (
 		CountryName string `json:"country"`
 	}
 
+	// LookupRequest records a single lookup: how it was answered, by whom,
+	// how long it took and, when it succeeded, the geolocation it returned.
 	LookupRequest struct {
-		IpAddress    string    `json:"ip_address"`
-		LookupTime   time.Time `json:"lookup_time"`
+		ID            uint         `json:"id" gorm:"primaryKey"`
+		IpAddress     string       `json:"ip_address" gorm:"size:64;index"`
+		IpBytes       []byte       `json:"-" gorm:"column:ip_bytes"`
+		LookupTime    time.Time    `json:"lookup_time" gorm:"index"`
+		LookupStatus  bool         `json:"lookup_status"`
+		Provider      string       `json:"provider" gorm:"size:32"`
+		LatencyMs     int64        `json:"latency_ms"`
+		Retries       int          `json:"retries"`
+		CacheStatus   string       `json:"cache_status" gorm:"size:16"`
+		ErrorCode     string       `json:"error_code,omitempty" gorm:"size:32"`
+		GeoLocationID *uint        `json:"geo_location_id,omitempty" gorm:"index"`
+		GeoLocation   *GeoLocation `json:"geo_location,omitempty"`
+	}
+
+	// GeoLocation is the normalized geolocation last returned for an ip address.
+	// There is a single row per ip address, shared by all of its lookups.
+	GeoLocation struct {
+		ID            uint      `json:"id" gorm:"primaryKey"`
+		IpAddress     string    `json:"ip_address" gorm:"size:64;uniqueIndex"`
+		RDNS          string    `json:"rdns" gorm:"column:rdns"`
+		ISP           string    `json:"isp"`
+		CountryName   string    `json:"country_name"`
+		CountryCode   string    `json:"country_code" gorm:"size:2"`
+		RegionName    string    `json:"region_name"`
+		RegionCode    string    `json:"region_code"`
+		City          string    `json:"city"`
+		PostalCode    string    `json:"postal_code"`
+		ContinentName string    `json:"continent_name"`
+		ContinentCode string    `json:"continent_code" gorm:"size:2"`
+		Latitude      *float64  `json:"latitude"`
+		Longitude     *float64  `json:"longitude"`
+		Timezone      string    `json:"timezone"`
+		UpdatedAt     time.Time `json:"updated_at"`
+	}
+
+	// LookupRollup counts the lookups recorded in an hour that share the same
+	// provider, outcome and geolocation. Aggregates are computed from these rows
+	// instead of scanning every recorded lookup.
+	LookupRollup struct {
+		ID           uint      `json:"-" gorm:"primaryKey"`
+		Bucket       time.Time `json:"bucket"`
+		Provider     string    `json:"provider"`
+		CacheStatus  string    `json:"cache_status"`
 		LookupStatus bool      `json:"lookup_status"`
+		ErrorCode    string    `json:"error_code"`
+		CountryCode  string    `json:"country_code"`
+		City         string    `json:"city"`
+		ISP          string    `json:"isp" gorm:"column:isp"`
+		Lookups      int64     `json:"lookups"`
+	}
+
+	// APIKey grants access to the endpoints of its scopes. Only a hash of the
+	// key is stored; the key itself is shown once, when it is created.
+	APIKey struct {
+		ID     uint   `json:"id" gorm:"primaryKey"`
+		Name   string `json:"name"`
+		Prefix string `json:"prefix" gorm:"size:16"`
+		Hash   string `json:"-" gorm:"size:64;uniqueIndex"`
+		// Scopes is the comma separated list of the scopes granted.
+		Scopes string `json:"scopes"`
+		// RateLimit is the number of requests allowed per minute and
+		// DailyQuota per day, in UTC. Zero does not limit.
+		RateLimit  int        `json:"rate_limit"`
+		DailyQuota int64      `json:"daily_quota"`
+		CreatedAt  time.Time  `json:"created_at"`
+		LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+		RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+	}
+
+	// APIKeyUsage counts the requests made with an API key in a day, in UTC,
+	// and those of them that were rejected.
+	APIKeyUsage struct {
+		APIKeyID uint      `json:"api_key_id" gorm:"column:api_key_id;primaryKey;autoIncrement:false"`
+		Day      time.Time `json:"day" gorm:"primaryKey"`
+		Requests int64     `json:"requests"`
+		Rejected int64     `json:"rejected"`
 	}
 )